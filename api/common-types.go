@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,13 +32,39 @@ func (h *HashDigest) UnmarshalJSON(b []byte) error {
 	if len(chonk) < 2 {
 		return fmt.Errorf("Invalid hash format")
 	}
+	value, err := hex.DecodeString(chonk[1])
+	if err != nil {
+		return err
+	}
 	h.Algorithm = chonk[0]
-	h.Value = []byte(chonk[1])
+	h.Value = value
 	return nil
 }
 
 func (h HashDigest) MarshalJSON() ([]byte, error) {
-	return []byte(h.String()), nil
+	return json.Marshal(h.String())
+}
+
+// Quick tells whether the digest only covers the ends of the file
+func (h HashDigest) Quick() bool {
+	return strings.HasPrefix(h.Algorithm, "quick")
+}
+
+// ParseHash reads a stored Hash value, the "algorithm:hex" string or the object with a base64 value
+// that earlier versions stored. It returns nil when the value isn't a digest.
+func ParseHash(value string) *HashDigest {
+	digest := &HashDigest{}
+	if err := json.Unmarshal([]byte(value), digest); err == nil {
+		return digest
+	}
+	var stored struct {
+		Algorithm string
+		Value     []byte
+	}
+	if err := json.Unmarshal([]byte(value), &stored); err != nil || stored.Algorithm == "" {
+		return nil
+	}
+	return &HashDigest{Algorithm: stored.Algorithm, Value: stored.Value}
 }
 
 type FileError struct {
@@ -55,6 +82,17 @@ func NewFileError(err error) FileError {
 	}
 }
 
+func (e FileError) MarshalJSON() ([]byte, error) {
+	msg := ""
+	if e.Error != nil {
+		msg = e.Error.Error()
+	}
+	return json.Marshal(struct {
+		Error     string
+		CreatedAt time.Time
+	}{msg, e.CreatedAt})
+}
+
 // utility convert anything to api.RuleResult
 func ToJSONMap(r interface{}) (map[string]string, error) {
 	data := structs.Map(r)
@@ -74,6 +112,7 @@ type AnnotResultConfig struct {
 	MetaProps    mapset.Set
 	RuleID       int
 	Path         string
+	Priority     int // the tags of results with a higher priority win when tags collide
 }
 
 type AnnotResult interface {
@@ -81,21 +120,71 @@ type AnnotResult interface {
 	GetConfig() AnnotResultConfig
 }
 
-// type AnnotError struct {
-// 	err error
-// }
+// ErrorResult reports that a file could not be processed, it never contributes any tags
+type ErrorResult struct {
+	RuleID int
+	Path   string
+	Errors []FileError
+}
 
-// func (r *AnnotError) GetConfig() AnnotResultConfig {
-// 	return AnnotResultConfig{
-// 		IgnoredProps: mapset.NewSet("MountDir", "RuleID", "Path"),
-// 		MetaProps:    mapset.NewSet("Errors", "QueuedAt", "ProcessedAt"),
-// 		RuleID:       r.RuleID,
-// 		Path:         r.Path,
-// 	}
-// }
-// func (r *AnnotError) toPropsMap() (map[string]string, error) {
-// 	return ToJSONMap(r)
-// }
+func NewErrorResult(ruleID int, path string, err error) *ErrorResult {
+	return &ErrorResult{RuleID: ruleID, Path: path, Errors: []FileError{NewFileError(err)}}
+}
+
+func (r *ErrorResult) GetConfig() AnnotResultConfig {
+	return AnnotResultConfig{
+		IgnoredProps: mapset.NewSet("RuleID", "Path", "Errors"),
+		MetaProps:    mapset.NewSet(),
+		RuleID:       r.RuleID,
+		Path:         r.Path,
+	}
+}
+func (r *ErrorResult) toPropsMap() (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+// OnlyErrors is true when none of the results could be produced, i.e. the state of the file is unknown
+func OnlyErrors(results []AnnotResult) bool {
+	for _, res := range results {
+		if _, ok := res.(*ErrorResult); !ok {
+			return false
+		}
+	}
+	return len(results) > 0
+}
+
+// ToScanErrors extracts all errors reported by a result so that they can be stored in scan_errors
+func ToScanErrors(scan int, a AnnotResult) []ScanErrors {
+	var errs []FileError
+	switch r := a.(type) {
+	case *ErrorResult:
+		errs = r.Errors
+	case *FilePropsResult:
+		errs = r.Errors
+	}
+	config := a.GetConfig()
+	ret := []ScanErrors{}
+	for _, e := range errs {
+		var ruleID *int
+		if config.RuleID != 0 {
+			id := config.RuleID
+			ruleID = &id
+		}
+		msg := ""
+		if e.Error != nil {
+			msg = e.Error.Error()
+		}
+		createdAt := e.CreatedAt
+		ret = append(ret, ScanErrors{
+			ScanID:    scan,
+			Filename:  config.Path,
+			RuleID:    ruleID,
+			Message:   msg,
+			CreatedAt: &createdAt,
+		})
+	}
+	return ret
+}
 
 // TODO: implement the binary file data agregator
 
@@ -124,6 +213,11 @@ func ToRuleResult(a AnnotResult) []*RuleResults {
 		panic(err) // TODO: do something with errors
 	}
 	config := a.GetConfig()
+	// the typed columns come from the Go values of the props, text is never parsed for them
+	native := map[string]interface{}{}
+	if tr, ok := a.(typedResult); ok {
+		native = tr.typedProps()
+	}
 	for tag, value := range annots {
 		if config.IgnoredProps.Contains(tag) {
 			continue
@@ -138,6 +232,11 @@ func ToRuleResult(a AnnotResult) []*RuleResults {
 			RuleID: &ruleid,
 			Meta:   &meta,
 		}
+		if v, ok := native[tag]; ok {
+			rr.JSONValue, rr.NumValue, rr.TimeValue = typedValue(v)
+		} else {
+			rr.JSONValue = value
+		}
 		ret = append(ret, rr)
 	}
 	return ret
@@ -154,7 +253,7 @@ type FilePropsResult struct {
 	ProcessedAt time.Time
 	IsDir       bool
 	OwnerUID    *string
-	Hash        *HashDigest
+	Hash        *HashDigest `structs:",omitnested"` // stored as "algorithm:hex" by its MarshalJSON
 	Errors      []FileError
 }
 
@@ -169,19 +268,24 @@ func (r *FilePropsResult) GetConfig() AnnotResultConfig {
 func (r *FilePropsResult) toPropsMap() (map[string]string, error) {
 	return ToJSONMap(r)
 }
+func (r *FilePropsResult) typedProps() map[string]interface{} {
+	return structs.Map(r)
+}
 
 type PathTagsResult struct {
-	Values map[string]string
-	RuleID int
-	Path   string
+	Values   map[string]string
+	RuleID   int
+	Path     string
+	Priority int
 }
 
 func (r *PathTagsResult) GetConfig() AnnotResultConfig {
 	return AnnotResultConfig{
-		IgnoredProps: mapset.NewSet("RuleID", "Path", "Values"),
+		IgnoredProps: mapset.NewSet("RuleID", "Path", "Fields", "Priority"),
 		MetaProps:    mapset.NewSet("Errors", "QueuedAt", "ProcessedAt"),
 		RuleID:       r.RuleID,
 		Path:         r.Path,
+		Priority:     r.Priority,
 	}
 }
 func (r *PathTagsResult) toPropsMap() (map[string]string, error) {
@@ -189,6 +293,179 @@ func (r *PathTagsResult) toPropsMap() (map[string]string, error) {
 }
 
 
+// RuleViolationResult records why a path does not comply with the rule it came closest to
+type RuleViolationResult struct {
+	RuleID            int
+	Path              string
+	ViolationRule     string // the rule that matched the longest part of the path
+	ViolationPos      int    // where matching stopped
+	ViolationExpected string // the token or separator that was expected there, empty if the path is too long
+	ViolationFound    string // the part of the path found instead
+	ViolationMessage  string
+	Priority          int
+}
+
+func (r *RuleViolationResult) GetConfig() AnnotResultConfig {
+	return AnnotResultConfig{
+		IgnoredProps: mapset.NewSet("RuleID", "Path", "Priority"),
+		MetaProps:    mapset.NewSet(),
+		RuleID:       r.RuleID,
+		Path:         r.Path,
+		Priority:     r.Priority,
+	}
+}
+func (r *RuleViolationResult) toPropsMap() (map[string]string, error) {
+	return ToJSONMap(r)
+}
+func (r *RuleViolationResult) typedProps() map[string]interface{} {
+	return structs.Map(r)
+}
+
+// BundleResult reports whether a folder contains every file a bundle rule requires. The files that
+// share the values of the placeholders common to all members form an instance of the bundle.
+type BundleResult struct {
+	RuleID          int
+	Path            string
+	Priority        int
+	BundleRule      string
+	BundleComplete  bool
+	BundleInstances int
+	BundleMissing   []string // the missing members of every instance with the values of the instance filled in
+	BundleExtra     []string // files in the folder that are not a member of the bundle, relative to the folder
+}
+
+func (r *BundleResult) GetConfig() AnnotResultConfig {
+	return AnnotResultConfig{
+		IgnoredProps: mapset.NewSet("RuleID", "Path", "Priority"),
+		MetaProps:    mapset.NewSet(),
+		RuleID:       r.RuleID,
+		Path:         r.Path,
+		Priority:     r.Priority,
+	}
+}
+func (r *BundleResult) toPropsMap() (map[string]string, error) {
+	return ToJSONMap(r)
+}
+func (r *BundleResult) typedProps() map[string]interface{} {
+	return structs.Map(r)
+}
+
+// LinksResult lists the paths and sample IDs a file refers to, they become file links once
+// they are resolved against the scanned files
+type LinksResult struct {
+	RuleID   int
+	Path     string
+	LinkRefs []string
+}
+
+func (r *LinksResult) GetConfig() AnnotResultConfig {
+	return AnnotResultConfig{
+		IgnoredProps: mapset.NewSet("RuleID", "Path"),
+		MetaProps:    mapset.NewSet(),
+		RuleID:       r.RuleID,
+		Path:         r.Path,
+	}
+}
+func (r *LinksResult) toPropsMap() (map[string]string, error) {
+	return ToJSONMap(r)
+}
+func (r *LinksResult) typedProps() map[string]interface{} {
+	return structs.Map(r)
+}
+
+// DocMetaResult holds the document properties of office documents and pdfs, empty properties are not stored
+type DocMetaResult struct {
+	RuleID            int
+	Path              string
+	DocTitle          string
+	DocAuthor         string
+	DocLastModifiedBy string
+	DocCreated        string // RFC 3339
+	DocModified       string
+	DocPages          int // pages or slides
+	DocSheets         int
+}
+
+func (r *DocMetaResult) GetConfig() AnnotResultConfig {
+	return AnnotResultConfig{
+		IgnoredProps: mapset.NewSet("RuleID", "Path"),
+		MetaProps:    mapset.NewSet(),
+		RuleID:       r.RuleID,
+		Path:         r.Path,
+	}
+}
+
+// toPropsMap stores the properties as plain strings so that documents can be searched by author like by any other tag
+func (r *DocMetaResult) toPropsMap() (map[string]string, error) {
+	ret := map[string]string{}
+	for key, value := range map[string]string{
+		"DocTitle":          r.DocTitle,
+		"DocAuthor":         r.DocAuthor,
+		"DocLastModifiedBy": r.DocLastModifiedBy,
+		"DocCreated":        r.DocCreated,
+		"DocModified":       r.DocModified,
+	} {
+		if value != "" {
+			ret[key] = value
+		}
+	}
+	if r.DocPages > 0 {
+		ret["DocPages"] = strconv.Itoa(r.DocPages)
+	}
+	if r.DocSheets > 0 {
+		ret["DocSheets"] = strconv.Itoa(r.DocSheets)
+	}
+	return ret, nil
+}
+
+// typedProps gives the counts as numbers and the dates as times, dates that aren't RFC 3339 stay text
+func (r *DocMetaResult) typedProps() map[string]interface{} {
+	ret := map[string]interface{}{"DocPages": r.DocPages, "DocSheets": r.DocSheets}
+	for key, value := range map[string]string{"DocCreated": r.DocCreated, "DocModified": r.DocModified} {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			ret[key] = t
+		}
+	}
+	return ret
+}
+
+// ExecResult holds the fields printed by the external converter of an exec rule
+type ExecResult struct {
+	Fields   map[string]interface{}
+	RuleID   int
+	Path     string
+	Priority int
+}
+
+func (r *ExecResult) GetConfig() AnnotResultConfig {
+	return AnnotResultConfig{
+		IgnoredProps: mapset.NewSet("RuleID", "Path", "Values", "Priority"),
+		MetaProps:    mapset.NewSet(),
+		RuleID:       r.RuleID,
+		Path:         r.Path,
+		Priority:     r.Priority,
+	}
+}
+
+// toPropsMap stores strings as is and everything else as JSON, like the values of the other results
+func (r *ExecResult) toPropsMap() (map[string]string, error) {
+	ret := map[string]string{}
+	for k, v := range r.Fields {
+		if s, ok := v.(string); ok {
+			ret[k] = s
+			continue
+		}
+		js, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		ret[k] = string(js)
+	}
+	return ret, nil
+}
+func (r *ExecResult) typedProps() map[string]interface{} {
+	return r.Fields
+}
 
 type MagellanWspResult struct {
 	Values map[string]string
@@ -208,3 +485,98 @@ func (r *MagellanWspResult) toPropsMap() (map[string]string, error) {
 	return r.Values, nil
 }
 
+// StoredResult replays the rule results of a previous file_history record for a single rule
+type StoredResult struct {
+	Values map[string]string
+	Typed  map[string]*RuleResults // the stored rule results by tag, they bring the typed columns along
+	Meta   mapset.Set
+	RuleID int
+	Path   string
+}
+
+func (r *StoredResult) GetConfig() AnnotResultConfig {
+	return AnnotResultConfig{
+		IgnoredProps: mapset.NewSet(),
+		MetaProps:    r.Meta,
+		RuleID:       r.RuleID,
+		Path:         r.Path,
+	}
+}
+func (r *StoredResult) toPropsMap() (map[string]string, error) {
+	return r.Values, nil
+}
+func (r *StoredResult) typedProps() map[string]interface{} {
+	ret := map[string]interface{}{}
+	for tag, rr := range r.Typed {
+		ret[tag] = storedValue{rr}
+	}
+	return ret
+}
+
+// StoredResults groups the rule results of an old record by rule so they can be reused as is
+func StoredResults(path string, fh *FileHistory) []AnnotResult {
+	byRule := map[int]*StoredResult{}
+	ruleIDs := []int{}
+	for _, rr := range fh.RuleResults {
+		if rr == nil || rr.Tag == nil || rr.Value == nil {
+			continue
+		}
+		ruleID := 0
+		if rr.RuleID != nil {
+			ruleID = *rr.RuleID
+		}
+		res, ok := byRule[ruleID]
+		if !ok {
+			res = &StoredResult{Values: map[string]string{}, Typed: map[string]*RuleResults{}, Meta: mapset.NewSet(), RuleID: ruleID, Path: path}
+			byRule[ruleID] = res
+			ruleIDs = append(ruleIDs, ruleID)
+		}
+		res.Values[*rr.Tag] = *rr.Value
+		res.Typed[*rr.Tag] = rr
+		if rr.Meta != nil && *rr.Meta {
+			res.Meta.Add(*rr.Tag)
+		}
+	}
+	ret := []AnnotResult{}
+	for _, id := range ruleIDs {
+		ret = append(ret, byRule[id])
+	}
+	return ret
+}
+
+// StoredHash returns the digest recorded in an old record, nil if the file was not hashed
+func StoredHash(fh *FileHistory) *HashDigest {
+	for _, rr := range fh.RuleResults {
+		if rr == nil || rr.Tag == nil || rr.Value == nil || *rr.Tag != "Hash" {
+			continue
+		}
+		return ParseHash(*rr.Value)
+	}
+	return nil
+}
+
+// StoredPropsMatch checks whether the file props recorded in an old record still describe the file on disk
+func StoredPropsMatch(fh *FileHistory, info os.FileInfo) bool {
+	stored := map[string]string{}
+	for _, rr := range fh.RuleResults {
+		if rr != nil && rr.Tag != nil && rr.Value != nil {
+			stored[*rr.Tag] = *rr.Value
+		}
+	}
+	sizeJS, hasSize := stored["Size"]
+	modTimeJS, hasModTime := stored["ModTime"]
+	isDirJS, hasIsDir := stored["IsDir"]
+	if !hasSize || !hasModTime || !hasIsDir {
+		return false
+	}
+	var size int64
+	var modTime time.Time
+	var isDir bool
+	if json.Unmarshal([]byte(sizeJS), &size) != nil ||
+		json.Unmarshal([]byte(modTimeJS), &modTime) != nil ||
+		json.Unmarshal([]byte(isDirJS), &isDir) != nil {
+		return false
+	}
+	return size == info.Size() && modTime.Equal(info.ModTime()) && isDir == info.IsDir()
+}
+
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+type fakeFileInfo struct {
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi fakeFileInfo) Name() string       { return "file" }
+func (fi fakeFileInfo) Size() int64        { return fi.size }
+func (fi fakeFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi fakeFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fakeFileInfo) IsDir() bool        { return fi.isDir }
+func (fi fakeFileInfo) Sys() interface{}   { return nil }
+
+func storedRecord(ruleID int, tags ...string) *FileHistory {
+	fh := &FileHistory{}
+	for i := 0; i+1 < len(tags); i += 2 {
+		tag, value, id := tags[i], tags[i+1], ruleID
+		fh.RuleResults = append(fh.RuleResults, &RuleResults{RuleID: &id, Tag: &tag, Value: &value})
+	}
+	return fh
+}
+
+func TestStoredPropsMatch(t *testing.T) {
+	modTime := time.Date(2019, 8, 1, 10, 0, 0, 0, time.UTC)
+	info := fakeFileInfo{size: 1234, modTime: modTime}
+	cases := []struct {
+		name string
+		fh   *FileHistory
+		info os.FileInfo
+		want bool
+	}{
+		{"unchanged", storedRecord(0, "Size", "1234", "ModTime", `"2019-08-01T10:00:00Z"`, "IsDir", "false"), info, true},
+		{"same instant in another zone", storedRecord(0, "Size", "1234", "ModTime", `"2019-08-01T13:00:00+03:00"`, "IsDir", "false"), info, true},
+		{"size changed", storedRecord(0, "Size", "1000", "ModTime", `"2019-08-01T10:00:00Z"`, "IsDir", "false"), info, false},
+		{"touched", storedRecord(0, "Size", "1234", "ModTime", `"2019-08-01T10:00:01Z"`, "IsDir", "false"), info, false},
+		{"became a folder", storedRecord(0, "Size", "1234", "ModTime", `"2019-08-01T10:00:00Z"`, "IsDir", "false"), fakeFileInfo{size: 1234, modTime: modTime, isDir: true}, false},
+		{"no mtime stored", storedRecord(0, "Size", "1234", "IsDir", "false"), info, false},
+		{"unreadable size", storedRecord(0, "Size", `"big"`, "ModTime", `"2019-08-01T10:00:00Z"`, "IsDir", "false"), info, false},
+		{"no results", &FileHistory{}, info, false},
+	}
+	for _, c := range cases {
+		if got := StoredPropsMatch(c.fh, c.info); got != c.want {
+			t.Errorf("%v: StoredPropsMatch = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestStoredResults(t *testing.T) {
+	fh := storedRecord(0, "Size", "1234", "ProcessedAt", `"2019-08-01T10:00:00Z"`)
+	fh.RuleResults = append(fh.RuleResults, storedRecord(7, "проект", "X1").RuleResults...)
+	meta := true
+	fh.RuleResults[1].Meta = &meta
+	// results without a tag or value can't be replayed
+	fh.RuleResults = append(fh.RuleResults, nil, &RuleResults{})
+
+	results := StoredResults("/share/a.txt", fh)
+	if len(results) != 2 {
+		t.Fatalf("StoredResults returned %v results, want one per rule", len(results))
+	}
+	cases := []struct {
+		ruleID int
+		values map[string]string
+		meta   []string
+	}{
+		{0, map[string]string{"Size": "1234", "ProcessedAt": `"2019-08-01T10:00:00Z"`}, []string{"ProcessedAt"}},
+		{7, map[string]string{"проект": "X1"}, nil},
+	}
+	for i, c := range cases {
+		cfg := results[i].GetConfig()
+		if cfg.RuleID != c.ruleID || cfg.Path != "/share/a.txt" {
+			t.Errorf("result %v is for rule %v and %v, want rule %v", i, cfg.RuleID, cfg.Path, c.ruleID)
+		}
+		values, err := results[i].toPropsMap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != len(c.values) {
+			t.Errorf("rule %v: values %v, want %v", c.ruleID, values, c.values)
+		}
+		for tag, value := range c.values {
+			if values[tag] != value {
+				t.Errorf("rule %v: %v = %q, want %q", c.ruleID, tag, values[tag], value)
+			}
+		}
+		if cfg.MetaProps.Cardinality() != len(c.meta) {
+			t.Errorf("rule %v: meta tags %v, want %v", c.ruleID, cfg.MetaProps, c.meta)
+		}
+		for _, tag := range c.meta {
+			if !cfg.MetaProps.Contains(tag) {
+				t.Errorf("rule %v: %v is not a meta tag", c.ruleID, tag)
+			}
+		}
+	}
+}
+
+func TestStoredHash(t *testing.T) {
+	digest := &HashDigest{Algorithm: "quick4m-xxhash", Value: []byte{0, 0xff, 0x10}}
+	fh := &FileHistory{RuleResults: ToRuleResult(&FilePropsResult{Size: 3, Hash: digest})}
+	for _, rr := range fh.RuleResults {
+		if *rr.Tag == "Hash" && *rr.Value != `"quick4m-xxhash:00ff10"` {
+			t.Errorf("the Hash tag is stored as %v, want the algorithm and the hex digest", *rr.Value)
+		}
+	}
+	if got := StoredHash(fh); got == nil || got.String() != digest.String() {
+		t.Errorf("StoredHash = %v, want %v", got, digest)
+	}
+
+	cases := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"object stored by earlier versions", `{"Algorithm":"sha256","Value":"AP8Q"}`, "sha256:00ff10"},
+		{"not hashed", "null", ""},
+		{"no algorithm", `"00ff10"`, ""},
+		{"not hex", `"sha256:xyz"`, ""},
+	}
+	for _, c := range cases {
+		got := StoredHash(storedRecord(0, "Hash", c.value))
+		if (got == nil && c.want != "") || (got != nil && got.String() != c.want) {
+			t.Errorf("%v: StoredHash = %v, want %q", c.name, got, c.want)
+		}
+	}
+}
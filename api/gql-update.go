@@ -5,20 +5,28 @@ import (
 	"encoding/json"
 	"log"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/machinebox/graphql"
 )
 
 type GamtracGql struct {
-	Client  *graphql.Client
-	Timeout time.Duration
+	Client    *graphql.Client
+	Timeout   time.Duration
+	BatchSize int // max number of records sent in a single insert mutation
+	Retries   int // how many times a request is repeated after a transient error
 }
 
 func NewGamtracGql(endpoint string, timeout_ms uint32, debugLog bool) *GamtracGql {
 	gg := GamtracGql{
-		Client:  graphql.NewClient(endpoint),
-		Timeout: time.Millisecond * time.Duration(timeout_ms),
+		Client:    graphql.NewClient(endpoint),
+		Timeout:   time.Millisecond * time.Duration(timeout_ms),
+		BatchSize: 500,
+		Retries:   3,
 	}
 	if debugLog {
 		gg.Client.Log = func(s string) { log.Println(s) }
@@ -45,16 +53,266 @@ func (gg *GamtracGql) Run(query string, rslt interface{}, vars map[string]interf
 	return nil
 }
 
+// IsTransient is true for errors that may go away when the request is repeated,
+// i.e. network errors, timeouts and non-JSON responses of an overloaded proxy
+func IsTransient(err error) bool {
+	if _, ok := err.(*url.Error); ok {
+		return true
+	}
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	msg := err.Error()
+	return strings.HasPrefix(msg, "decoding response") || strings.HasPrefix(msg, "reading body")
+}
+
+// RunWithRetry repeats the request with an exponential backoff as long as it fails with transient errors,
+// the request must do the same when it is applied twice
+func (gg *GamtracGql) RunWithRetry(query string, rslt interface{}, vars map[string]interface{}) error {
+	var err error
+	for attempt := 0; attempt <= gg.Retries; attempt++ {
+		if attempt > 0 {
+			wait := time.Second * time.Duration(1<<uint(attempt-1))
+			fmt.Fprintf(os.Stderr, "Request failed: %v; retrying in %v\n", err, wait)
+			time.Sleep(wait)
+		}
+		err = gg.Run(query, rslt, vars)
+		if err == nil || !IsTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// notSent is true for errors of requests that never reached the server, they can't have been applied
+func notSent(err error) bool {
+	uerr, ok := err.(*url.Error)
+	if !ok {
+		return false
+	}
+	operr, ok := uerr.Err.(*net.OpError)
+	return ok && operr.Op == "dial"
+}
+
+// RunMutationWithRetry is RunWithRetry for mutations that must not be applied twice, like inserts.
+// A request that timed out after it was sent may still have been committed, so applied checks that
+// before the request is repeated. Without applied the request is only repeated when it was not sent.
+func (gg *GamtracGql) RunMutationWithRetry(query string, rslt interface{}, vars map[string]interface{}, applied func() (bool, error)) error {
+	var err error
+	for attempt := 0; attempt <= gg.Retries; attempt++ {
+		if attempt > 0 {
+			wait := time.Second * time.Duration(1<<uint(attempt-1))
+			fmt.Fprintf(os.Stderr, "Request failed: %v; retrying in %v\n", err, wait)
+			time.Sleep(wait)
+		}
+		err = gg.Run(query, rslt, vars)
+		if err == nil || !IsTransient(err) {
+			return err
+		}
+		if notSent(err) {
+			continue
+		}
+		if applied == nil {
+			return err
+		}
+		done, cerr := applied()
+		if cerr != nil {
+			return fmt.Errorf("%v; cannot check whether it was applied: %v", err, cerr)
+		}
+		if done {
+			return nil
+		}
+	}
+	return err
+}
+
+// batches splits n records into [start, end) ranges of at most gg.BatchSize records
+func (gg *GamtracGql) batches(n int) [][2]int {
+	size := gg.BatchSize
+	if size <= 0 {
+		size = n
+	}
+	ret := [][2]int{}
+	for start := 0; start < n; start += size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+		ret = append(ret, [2]int{start, end})
+	}
+	return ret
+}
+
 func (gg *GamtracGql) RunFetchFiles() ([]FileHistory, error) {
+	return gg.runFetchFiles(JSON{})
+}
+
+// RunFetchFilesByName fetches the latest records of the given files and of all files below the given directories
+func (gg *GamtracGql) RunFetchFilesByName(filenames []string, dirs []string) ([]FileHistory, error) {
+	or := []JSON{{"filename": JSON{"_in": filenames}}}
+	for _, dir := range dirs {
+		or = append(or, JSON{"filename": JSON{"_like": likePattern(dir) + "%"}})
+	}
+	return gg.runFetchFiles(JSON{"_or": or})
+}
+
+// likePattern escapes the LIKE wildcards of a filename, underscores are common in filenames
+func likePattern(filename string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(filename)
+}
+
+// RunFetchFilesIn fetches the latest records of the files and folders directly in the directory
+func (gg *GamtracGql) RunFetchFilesIn(dir string) ([]FileHistory, error) {
+	pattern := likePattern(dir)
+	return gg.runFetchFiles(JSON{"_and": []JSON{
+		{"filename": JSON{"_like": pattern + "%"}},
+		{"filename": JSON{"_nlike": pattern + "%/_%"}},
+		{"filename": JSON{"_neq": dir}},
+	}})
+}
+
+// RunFetchKnownHashes returns which of the hashes any version of a file had, the values are
+// those of the Hash tag. Modifications store their new hash as a tag change.
+func (gg *GamtracGql) RunFetchKnownHashes(hashes []string) ([]string, error) {
+	var respData struct {
+		RuleResults []RuleResults `json:"rule_results"`
+		TagChanges  []TagChanges  `json:"tag_changes"`
+	}
+	query := `
+	query ($hashes: [String!]!) {
+		rule_results(where: {tag: {_eq: "Hash"}, value: {_in: $hashes}}, distinct_on: value) {
+			value
+		}
+		tag_changes(where: {tag: {_eq: "Hash"}, new_value: {_in: $hashes}}, distinct_on: new_value) {
+			new_value
+		}
+	}
+	`
+	ret := []string{}
+	for _, b := range gg.batches(len(hashes)) {
+		vars := map[string]interface{}{
+			"hashes": hashes[b[0]:b[1]],
+		}
+		if err := gg.RunWithRetry(query, &respData, vars); err != nil {
+			return nil, err
+		}
+		for _, rr := range respData.RuleResults {
+			ret = append(ret, *rr.Value)
+		}
+		for _, tc := range respData.TagChanges {
+			ret = append(ret, *tc.NewValue)
+		}
+	}
+	return ret, nil
+}
+
+// RunFetchLinkRefs returns the files below the dirs that refer to other files along with their LinkRefs tag,
+// at most limit files whose names come after the given one in filename order. With mentions only the files
+// whose LinkRefs tag contains one of them are returned, compared case-insensitively.
+func (gg *GamtracGql) RunFetchLinkRefs(dirs []string, mentions []string, after string, limit int) ([]FileHistory, error) {
+	var respData struct {
+		Files []struct {
+			Filename string         `json:"filename"`
+			Tags     []*RuleResults `json:"tags"`
+		} `json:"files"`
+	}
+	query := `
+	query ($where: files_bool_exp, $limit: Int!) {
+		files(where: $where, order_by: {filename: asc}, limit: $limit) {
+			filename
+			tags(where: {tag: {_eq: "LinkRefs"}}) {
+				tag
+				value
+			}
+		}
+	}
+	`
+	below := []JSON{}
+	for _, dir := range dirs {
+		below = append(below, JSON{"filename": JSON{"_like": likePattern(dir) + "%"}})
+	}
+	if len(below) == 0 {
+		return []FileHistory{}, nil
+	}
+	refs := []JSON{{"tag": JSON{"_eq": "LinkRefs"}}}
+	if len(mentions) > 0 {
+		mentioned := []JSON{}
+		for _, m := range mentions {
+			mentioned = append(mentioned, JSON{"value": JSON{"_ilike": "%" + likePattern(m) + "%"}})
+		}
+		refs = append(refs, JSON{"_or": mentioned})
+	}
+	vars := map[string]interface{}{
+		"where": JSON{"_and": []JSON{
+			{"_or": below},
+			{"filename": JSON{"_gt": after}},
+			{"tags": JSON{"_and": refs}},
+		}},
+		"limit": limit,
+	}
+	if err := gg.RunWithRetry(query, &respData, vars); err != nil {
+		return nil, err
+	}
+	ret := make([]FileHistory, len(respData.Files))
+	for i, f := range respData.Files {
+		ret[i] = FileHistory{Filename: f.Filename, RuleResults: f.Tags}
+	}
+	return ret, nil
+}
+
+// RunFetchFilesByBaseName returns the current files and folders whose last path component is one of
+// the names or whose path contains one of the parts, both compared case-insensitively
+func (gg *GamtracGql) RunFetchFilesByBaseName(names []string, parts []string) ([]string, error) {
+	var respData struct {
+		Files []struct {
+			Filename string `json:"filename"`
+		} `json:"files"`
+	}
+	query := `
+	query ($where: files_bool_exp) {
+		files(where: $where) {
+			filename
+		}
+	}
+	`
+	patterns := []string{}
+	for _, name := range names {
+		patterns = append(patterns, "%/"+likePattern(name), "%/"+likePattern(name)+"/")
+	}
+	for _, part := range parts {
+		patterns = append(patterns, "%"+likePattern(part)+"%")
+	}
+	ret := []string{}
+	for _, b := range gg.batches(len(patterns)) {
+		or := []JSON{}
+		for _, pattern := range patterns[b[0]:b[1]] {
+			or = append(or, JSON{"filename": JSON{"_ilike": pattern}})
+		}
+		vars := map[string]interface{}{
+			"where": JSON{"_or": or},
+		}
+		if err := gg.RunWithRetry(query, &respData, vars); err != nil {
+			return nil, err
+		}
+		for _, f := range respData.Files {
+			ret = append(ret, f.Filename)
+		}
+	}
+	return ret, nil
+}
+
+func (gg *GamtracGql) runFetchFiles(where JSON) ([]FileHistory, error) {
 	var respData struct {
 		FileHistories [] struct {
 			File FileHistory `json:"file_history"`
+			Tags []*RuleResults `json:"tags"`
 		} `json:"files"`
 	}
 
+	// modifications only store the changed tags, file_tags has all current tags of the file
 	query := `
-	query {
-		files {
+	query ($where: files_bool_exp) {
+		files(where: $where) {
 		  file_history {
 			file_history_id
 			action
@@ -62,25 +320,31 @@ func (gg *GamtracGql) RunFetchFiles() ([]FileHistory, error) {
 			filename
 			prev_id
 			scan_id
-			rule_results {
-				file_history_id
-				rule_result_id
-				rule_id
-				created_at
-				tag
-				value
-				meta
-			}
+			delta
+		  }
+		  tags {
+			file_history_id
+			rule_id
+			tag
+			value
+			meta
+			json_value
+			num_value
+			time_value
 		  }
 		}
 	}
 	`
-	if err := gg.Run(query, &respData, nil); err != nil {
+	vars := map[string]interface{}{
+		"where": where,
+	}
+	if err := gg.Run(query, &respData, vars); err != nil {
 		return nil, err
 	}
 	files := make([]FileHistory, len(respData.FileHistories))
 	for i := range respData.FileHistories {
 		files[i] = respData.FileHistories[i].File
+		files[i].RuleResults = respData.FileHistories[i].Tags
 		if (files[i].Filename == "") {
 			return nil, fmt.Errorf("Internal error: empty filename in old file history #%v, id %v", i, files[i].FileHistoryID)
 		}
@@ -120,7 +384,25 @@ func ToNestedInsert(props []string, objects []interface{}) []JSON {
 	return toInsert
 }
 
+// RunInsertFileHistory inserts the records in batches, a failed batch stops the insert
+// and the ids of the records inserted so far are returned with the error
 func (gg *GamtracGql) RunInsertFileHistory(files []FileHistory) ([]int64, error) {
+	ret := []int64{}
+	batches := gg.batches(len(files))
+	for _, b := range batches {
+		ids, err := gg.runInsertFileHistoryBatch(files[b[0]:b[1]])
+		if err != nil {
+			return ret, fmt.Errorf("cannot insert file records %v-%v of %v: %v", b[0], b[1], len(files), err)
+		}
+		ret = append(ret, ids...)
+		if len(batches) > 1 {
+			fmt.Printf("Inserted %v/%v file records\n", b[1], len(files))
+		}
+	}
+	return ret, nil
+}
+
+func (gg *GamtracGql) runInsertFileHistoryBatch(files []FileHistory) ([]int64, error) {
 	var respData struct {
 		InsertFileHistory struct {
 			FileHistories []FileHistory `json:"returning"`
@@ -132,7 +414,7 @@ func (gg *GamtracGql) RunInsertFileHistory(files []FileHistory) ([]int64, error)
 		pfiles[i] = &files[i]
 	}
 
-	insertData := ToNestedInsert([]string{"rule_results"}, pfiles)
+	insertData := ToNestedInsert([]string{"rule_results", "tag_changes"}, pfiles)
 	for i, id := range insertData {
 		if s, ok := id["filename"].(string); !ok {
 			println("File ", i, "is not ok", s)
@@ -155,16 +437,78 @@ func (gg *GamtracGql) RunInsertFileHistory(files []FileHistory) ([]int64, error)
 	vars := map[string]interface{}{
 		"files": insertData,
 	}
-	if err := gg.Run(query, &respData, vars); err != nil {
+	var ret []int64
+	applied := func() (bool, error) {
+		ids, err := gg.findInsertedFileHistory(files)
+		ret = ids
+		return ids != nil, err
+	}
+	if err := gg.RunMutationWithRetry(query, &respData, vars, applied); err != nil {
 		return nil, err
 	}
-	ret := []int64{}
+	if ret != nil {
+		return ret, nil
+	}
+	ret = []int64{}
 	for _, fh := range respData.InsertFileHistory.FileHistories {
 		ret = append(ret, fh.FileHistoryID)
 	}
 	return ret, nil
 }
 
+// findInsertedFileHistory looks for the records of an insert that failed after it was sent, they are
+// identified by scan, filename and prev_id. Returns their ids in order, or nil when none were inserted.
+func (gg *GamtracGql) findInsertedFileHistory(files []FileHistory) ([]int64, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	var respData struct {
+		FileHistories []FileHistory `json:"file_history"`
+	}
+	query := `
+	query ($scan: Int!, $filenames: [String!]!) {
+		file_history(where: {scan_id: {_eq: $scan}, filename: {_in: $filenames}}) {
+			file_history_id
+			filename
+			prev_id
+		}
+	}
+	`
+	filenames := make([]string, len(files))
+	for i, f := range files {
+		filenames[i] = f.Filename
+	}
+	vars := map[string]interface{}{
+		"scan":      files[0].ScanID,
+		"filenames": filenames,
+	}
+	if err := gg.RunWithRetry(query, &respData, vars); err != nil {
+		return nil, err
+	}
+	type key struct {
+		filename string
+		prevID   int
+	}
+	found := map[key]int64{}
+	for _, fh := range respData.FileHistories {
+		found[key{fh.Filename, fh.PrevID}] = fh.FileHistoryID
+	}
+	ret := []int64{}
+	for _, f := range files {
+		if id, ok := found[key{f.Filename, f.PrevID}]; ok {
+			ret = append(ret, id)
+		}
+	}
+	switch len(ret) {
+	case 0:
+		return nil, nil
+	case len(files):
+		return ret, nil
+	}
+	// a batch is a single transaction, it is either there completely or not at all
+	return nil, fmt.Errorf("only %v of %v records of the batch are stored", len(ret), len(files))
+}
+
 func (gg *GamtracGql) RunInsertRuleResults(results []*RuleResults) ([]int, error) {
 	var respData struct {
 		InsertRuleResults struct {
@@ -194,7 +538,101 @@ func (gg *GamtracGql) RunInsertRuleResults(results []*RuleResults) ([]int, error
 	return ret, nil
 }
 
-func (gg *GamtracGql) RunCreateScan() (*int, error) {
+// MetaUpdate brings the meta rule results of a record up to date, like the time the file was last
+// processed or its errors. Meta tags don't make a new version of the file, so they are changed in place.
+type MetaUpdate struct {
+	FileHistoryID int64
+	Set           []*RuleResults // tags whose value changed
+	Add           []*RuleResults
+	Remove        []string
+}
+
+// RunUpdateMeta applies the meta updates in batches, each batch is a single mutation
+func (gg *GamtracGql) RunUpdateMeta(updates []MetaUpdate) error {
+	for _, b := range gg.batches(len(updates)) {
+		if err := gg.runUpdateMetaBatch(updates[b[0]:b[1]]); err != nil {
+			return fmt.Errorf("cannot update meta of records %v-%v of %v: %v", b[0], b[1], len(updates), err)
+		}
+	}
+	return nil
+}
+
+func (gg *GamtracGql) runUpdateMetaBatch(updates []MetaUpdate) error {
+	params, fields := []string{}, []string{}
+	vars := map[string]interface{}{}
+	inserts, removed := []*RuleResults{}, []JSON{}
+	for _, u := range updates {
+		id := int(u.FileHistoryID)
+		for _, rr := range u.Set {
+			// every changed tag needs its own where, hence an aliased update each
+			n := len(fields)
+			params = append(params, fmt.Sprintf("$where%d: rule_results_bool_exp!, $set%d: rule_results_set_input", n, n))
+			fields = append(fields, fmt.Sprintf("u%d: update_rule_results(where: $where%d, _set: $set%d) { affected_rows }", n, n, n))
+			vars[fmt.Sprintf("where%d", n)] = JSON{
+				"file_history_id": JSON{"_eq": id},
+				"tag":             JSON{"_eq": *rr.Tag},
+				"meta":            JSON{"_eq": true},
+			}
+			vars[fmt.Sprintf("set%d", n)] = JSON{
+				"value":      rr.Value,
+				"rule_id":    rr.RuleID,
+				"json_value": rr.JSONValue,
+				"num_value":  rr.NumValue,
+				"time_value": rr.TimeValue,
+			}
+		}
+		for _, rr := range u.Add {
+			rr.FileHistoryID = &id
+			inserts = append(inserts, rr)
+		}
+		if len(u.Remove) > 0 {
+			removed = append(removed, JSON{
+				"file_history_id": JSON{"_eq": id},
+				"tag":             JSON{"_in": u.Remove},
+				"meta":            JSON{"_eq": true},
+			})
+		}
+	}
+	if len(inserts) > 0 {
+		params = append(params, "$inserts: [rule_results_insert_input!]!")
+		fields = append(fields, "insert_rule_results(objects: $inserts) { affected_rows }")
+		vars["inserts"] = inserts
+	}
+	// an empty _or would match every row
+	if len(removed) > 0 {
+		params = append(params, "$removed: rule_results_bool_exp!")
+		fields = append(fields, "delete_rule_results(where: $removed) { affected_rows }")
+		vars["removed"] = JSON{"_or": removed}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	query := "mutation (" + strings.Join(params, ", ") + ") {\n\t" + strings.Join(fields, "\n\t") + "\n}"
+	// the added tags would be inserted twice
+	return gg.RunMutationWithRetry(query, nil, vars, nil)
+}
+
+func (gg *GamtracGql) RunInsertScanErrors(errs []ScanErrors) error {
+	query := `
+	mutation ($errors: [scan_errors_insert_input!]!) {
+		insert_scan_errors(objects: $errors) {
+			affected_rows
+		}
+	}
+	`
+	for _, b := range gg.batches(len(errs)) {
+		vars := map[string]interface{}{
+			"errors": errs[b[0]:b[1]],
+		}
+		if err := gg.RunMutationWithRetry(query, nil, vars, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunCreateScan starts a scan of the given kind: ScanFull, ScanIncremental or ScanWatch
+func (gg *GamtracGql) RunCreateScan(kind string) (*int, error) {
 	var respData struct {
 		CreateScan struct {
 			Scans []Scans `json:"returning"`
@@ -202,9 +640,10 @@ func (gg *GamtracGql) RunCreateScan() (*int, error) {
 	}
 
 	query := `
-	mutation {
+	mutation ($kind: String!) {
 		insert_scans(objects: [{
 			completed_at: null
+			kind: $kind
 		}]) {
 		  returning {
 			scan_id
@@ -212,7 +651,9 @@ func (gg *GamtracGql) RunCreateScan() (*int, error) {
 		}
 	  }
 	`
-	vars := map[string]interface{}{}
+	vars := map[string]interface{}{
+		"kind": kind,
+	}
 	if err := gg.Run(query, &respData, vars); err != nil {
 		return nil, err
 	}
@@ -220,7 +661,8 @@ func (gg *GamtracGql) RunCreateScan() (*int, error) {
 	return &(respData.CreateScan.Scans[0].ScanID), nil
 }
 
-func (gg *GamtracGql) RunFinishScan(scan int) (*Scans, error) {
+// RunFinishScan marks the scan as ended with the given status: completed, failed or abandoned
+func (gg *GamtracGql) RunFinishScan(scan int, status string) (*Scans, error) {
 	var respData struct {
 		FinishScan struct {
 			Scans []Scans `json:"returning"`
@@ -228,13 +670,14 @@ func (gg *GamtracGql) RunFinishScan(scan int) (*Scans, error) {
 	}
 
 	query := `
-	mutation ($scan_id: Int!) {
+	mutation ($scan_id: Int!, $status: String!) {
 		update_scans (where: {scan_id :{_eq: $scan_id}},
-		_set: {completed_at: "now()" }) {
+		_set: {completed_at: "now()", status: $status }) {
 		  returning {
 			scan_id
 			started_at
 			completed_at
+			status
 			file_histories_aggregate {
 			  aggregate {
 				 count
@@ -246,14 +689,167 @@ func (gg *GamtracGql) RunFinishScan(scan int) (*Scans, error) {
 	`
 	vars := map[string]interface{}{
 		"scan_id": scan,
+		"status":  status,
 	}
-	if err := gg.Run(query, &respData, vars); err != nil {
+	if err := gg.RunWithRetry(query, &respData, vars); err != nil {
 		return nil, err
 	}
+	if len(respData.FinishScan.Scans) == 0 {
+		return nil, fmt.Errorf("scan %v does not exist", scan)
+	}
 
 	return &(respData.FinishScan.Scans[0]), nil
 }
 
+// RunFetchUnfinishedScans returns the scans that are still running, i.e. the scanner stopped
+// before finishing them, newest first and with their checkpoints
+func (gg *GamtracGql) RunFetchUnfinishedScans() ([]Scans, error) {
+	var respData struct {
+		Scans []Scans `json:"scans"`
+	}
+
+	query := `
+	query {
+		scans (where: {status: {_eq: "running"}}, order_by: {scan_id: desc}) {
+			scan_id
+			started_at
+			status
+			kind
+			scan_checkpoints {
+				scan_id
+				endpoint
+				last_path
+				updated_at
+			}
+		}
+	}
+	`
+	vars := map[string]interface{}{}
+	if err := gg.Run(query, &respData, vars); err != nil {
+		return nil, err
+	}
+	return respData.Scans, nil
+}
+
+// RunCountScansSinceFull returns how many incremental scans completed after the last completed full
+// scan, or nil if no full scan has completed yet
+func (gg *GamtracGql) RunCountScansSinceFull() (*int, error) {
+	var lastFull struct {
+		Scans []Scans `json:"scans"`
+	}
+	query := `
+	query {
+		scans (where: {status: {_eq: "completed"}, kind: {_eq: "full"}}, order_by: {completed_at: desc}, limit: 1) {
+			scan_id
+			completed_at
+		}
+	}
+	`
+	if err := gg.RunWithRetry(query, &lastFull, map[string]interface{}{}); err != nil {
+		return nil, err
+	}
+	if len(lastFull.Scans) == 0 || lastFull.Scans[0].CompletedAt == nil {
+		return nil, nil
+	}
+
+	var since struct {
+		Scans struct {
+			Aggregate struct {
+				Count int `json:"count"`
+			} `json:"aggregate"`
+		} `json:"scans_aggregate"`
+	}
+	query = `
+	query ($after: timestamptz!) {
+		scans_aggregate (where: {status: {_eq: "completed"}, kind: {_eq: "incremental"}, completed_at: {_gt: $after}}) {
+			aggregate {
+				count
+			}
+		}
+	}
+	`
+	vars := map[string]interface{}{
+		"after": lastFull.Scans[0].CompletedAt,
+	}
+	if err := gg.RunWithRetry(query, &since, vars); err != nil {
+		return nil, err
+	}
+	return &since.Scans.Aggregate.Count, nil
+}
+
+// RunSaveScanCheckpoints stores how far the walk of each endpoint got, replacing the previous checkpoints
+func (gg *GamtracGql) RunSaveScanCheckpoints(checkpoints []ScanCheckpoints) error {
+	query := `
+	mutation ($checkpoints: [scan_checkpoints_insert_input!]!) {
+		insert_scan_checkpoints(objects: $checkpoints,
+		on_conflict: {constraint: scan_checkpoints_pkey, update_columns: [last_path, updated_at]}) {
+			affected_rows
+		}
+	}
+	`
+	vars := map[string]interface{}{
+		"checkpoints": checkpoints,
+	}
+	return gg.RunWithRetry(query, nil, vars)
+}
+
+// RunUpsertFileLinks stores the links found by a scan, links that already exist are moved to that scan
+func (gg *GamtracGql) RunUpsertFileLinks(links []FileLinks) error {
+	query := `
+	mutation ($links: [file_links_insert_input!]!) {
+		insert_file_links(objects: $links,
+		on_conflict: {constraint: file_links_pkey, update_columns: [reference, scan_id]}) {
+			affected_rows
+		}
+	}
+	`
+	for _, b := range gg.batches(len(links)) {
+		vars := map[string]interface{}{
+			"links": links[b[0]:b[1]],
+		}
+		if err := gg.RunWithRetry(query, nil, vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunDeleteStaleFileLinks deletes the links of the given sources and of the sources below the dirs
+// that were not found again by the scan
+func (gg *GamtracGql) RunDeleteStaleFileLinks(scan int, sources []string, dirs []string) error {
+	query := `
+	mutation ($where: file_links_bool_exp!) {
+		delete_file_links(where: $where) {
+			affected_rows
+		}
+	}
+	`
+	// an empty _or would match every link
+	or := [][]JSON{}
+	for _, b := range gg.batches(len(sources)) {
+		or = append(or, []JSON{{"source": JSON{"_in": sources[b[0]:b[1]]}}})
+	}
+	if len(dirs) > 0 {
+		below := []JSON{}
+		for _, dir := range dirs {
+			below = append(below, JSON{"source": JSON{"_like": likePattern(dir) + "%"}})
+		}
+		or = append(or, below)
+	}
+	for _, sel := range or {
+		vars := map[string]interface{}{
+			"where": JSON{"_and": []JSON{
+				{"scan_id": JSON{"_neq": scan}},
+				{"_or": sel},
+			}},
+		}
+		if err := gg.RunWithRetry(query, nil, vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (gg *GamtracGql) RunInsertDomainUsers(users []DomainUsers) error {
 	// var respData struct {
 	// 	InsertDomainUsers struct {
@@ -292,14 +888,15 @@ func (gg *GamtracGql) RunDeleteDomainUsers() error {
 	return gg.Run(query, nil, vars)
 }
 
-func (gg *GamtracGql) RunFetchRules() ([]Rules, error) {
+// RunFetchRules returns the rules of the given rule types
+func (gg *GamtracGql) RunFetchRules(ruleTypes []string) ([]Rules, error) {
 	var respData struct {
 		Rules []Rules `json:"rules"`
 	}
 
 	query := `
-	query {
-		rules(where:{rule_type:{_eq: "pathtags"}}) {
+	query ($rule_types: [String!]!) {
+		rules(where:{rule_type:{_in: $rule_types}}) {
 			rule_id
 			principal
 			priority
@@ -309,8 +906,32 @@ func (gg *GamtracGql) RunFetchRules() ([]Rules, error) {
 		}
 	}
 	`
-	if err := gg.Run(query, &respData, nil); err != nil {
+	vars := map[string]interface{}{
+		"rule_types": ruleTypes,
+	}
+	if err := gg.Run(query, &respData, vars); err != nil {
 		return nil, err
 	}
 	return respData.Rules, nil
 }
+
+func (gg *GamtracGql) RunFetchEndpoints() ([]Endpoints, error) {
+	var respData struct {
+		Endpoints []Endpoints `json:"endpoints"`
+	}
+
+	query := `
+	query {
+		endpoints {
+			endpoint_id
+			path
+			principal
+			ignore
+		}
+	}
+	`
+	if err := gg.Run(query, &respData, nil); err != nil {
+		return nil, err
+	}
+	return respData.Endpoints, nil
+}
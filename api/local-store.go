@@ -0,0 +1,941 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	opSeed        = "seed" // the files of the server as of the last pull or push
+	opCreateScan  = "create_scan"
+	opFinishScan  = "finish_scan"
+	opFiles       = "files"
+	opMeta        = "meta"
+	opErrors      = "errors"
+	opCheckpoints = "checkpoints"
+	opLinks       = "links"
+	opDeleteLinks = "delete_links"
+)
+
+// journalEntry is a line of the journal, one write of a scan
+type journalEntry struct {
+	Op          string            `json:"op"`
+	At          time.Time         `json:"at"`
+	Scan        int               `json:"scan,omitempty"`
+	Status      string            `json:"status,omitempty"`
+	Kind        string            `json:"kind,omitempty"`
+	Files       []FileHistory     `json:"files,omitempty"`
+	Meta        []MetaUpdate      `json:"meta,omitempty"`
+	Errors      []ScanErrors      `json:"errors,omitempty"`
+	Checkpoints []ScanCheckpoints `json:"checkpoints,omitempty"`
+	Links       []FileLinks       `json:"links,omitempty"`
+	Sources     []string          `json:"sources,omitempty"`
+	Dirs        []string          `json:"dirs,omitempty"`
+}
+
+// scanKind is the kind of the scan an opCreateScan entry starts, journals written before scans had
+// kinds count as incremental like the scans on the server
+func (e journalEntry) scanKind() string {
+	if e.Kind == "" {
+		return ScanIncremental
+	}
+	return e.Kind
+}
+
+// LocalStore keeps the scans of a scanner without a server in a directory:
+//
+//	rules.json, endpoints.json  the rules and endpoints to scan with, written by Pull or by hand
+//	journal.jsonl               every write of the scans, one JSON entry per line
+//	push.json                   how far an interrupted Push got
+//
+// The journal is replayed when the store is opened to know the current files. Scans and records
+// created locally get negative ids, Push replays them on the server where they get their real ids.
+type LocalStore struct {
+	BatchSize int
+
+	dir       string
+	mu        sync.Mutex
+	journal   *os.File
+	rules     []Rules
+	endpoints []Endpoints
+	scans     map[int]*Scans
+	counts    map[int]int             // records written per scan
+	files     map[string]*FileHistory // the current record of every file with all of its tags
+	byID      map[int64]string
+	byDir     map[string]map[string]bool // the files directly in a directory
+	lastScan  int
+	lastID    int64
+	unpushed  int // journal entries that are not on the server yet
+}
+
+func OpenLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &LocalStore{BatchSize: 500, dir: dir}
+	if err := readJSONFile(filepath.Join(dir, "rules.json"), &s.rules); err != nil {
+		return nil, err
+	}
+	if err := readJSONFile(filepath.Join(dir, "endpoints.json"), &s.endpoints); err != nil {
+		return nil, err
+	}
+	entries, err := readJournal(s.journalPath())
+	if err != nil {
+		return nil, err
+	}
+	s.reset(entries)
+	s.journal, err = os.OpenFile(s.journalPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *LocalStore) Close() error {
+	return s.journal.Close()
+}
+
+func (s *LocalStore) journalPath() string {
+	return filepath.Join(s.dir, "journal.jsonl")
+}
+
+// readJSONFile decodes the file into v, a missing file leaves v as it is
+func readJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("cannot parse %v: %v", path, err)
+	}
+	return nil
+}
+
+// writeJSONFile replaces the file, it is written next to it first so that a crash can't leave half of it
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, data)
+}
+
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readJournal(path string) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []journalEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := []journalEntry{}
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		complete := err == nil
+		if len(bytes.TrimSpace(line)) > 0 {
+			e := journalEntry{}
+			if jerr := json.Unmarshal(line, &e); jerr != nil {
+				// the scanner was killed while writing the last line, that write never happened
+				if !complete {
+					fmt.Fprintf(os.Stderr, "Ignoring the incomplete last line of %v\n", path)
+					break
+				}
+				return nil, fmt.Errorf("cannot parse line %v of %v: %v", n, path, jerr)
+			}
+			ret = append(ret, e)
+		}
+		if !complete {
+			break
+		}
+	}
+	return ret, nil
+}
+
+func writeJournal(path string, entries []journalEntry) error {
+	buf := bytes.Buffer{}
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return replaceFile(path, buf.Bytes())
+}
+
+// reset rebuilds the state of the store from the journal
+func (s *LocalStore) reset(entries []journalEntry) {
+	s.scans = map[int]*Scans{}
+	s.counts = map[int]int{}
+	s.files = map[string]*FileHistory{}
+	s.byID = map[int64]string{}
+	s.byDir = map[string]map[string]bool{}
+	s.lastScan, s.lastID, s.unpushed = 0, 0, 0
+	for _, e := range entries {
+		s.apply(e)
+	}
+}
+
+// append writes the entry to the journal before it is applied, so the state never gets ahead of the journal
+func (s *LocalStore) append(e journalEntry) error {
+	e.At = time.Now()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := s.journal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := s.journal.Sync(); err != nil {
+		return err
+	}
+	s.apply(e)
+	return nil
+}
+
+func (s *LocalStore) apply(e journalEntry) {
+	if e.Op != opSeed {
+		s.unpushed++
+	}
+	switch e.Op {
+	case opSeed, opFiles:
+		for _, f := range e.Files {
+			s.applyRecord(f)
+			if e.Op == opFiles {
+				s.counts[f.ScanID]++
+			}
+		}
+	case opCreateScan:
+		s.scans[e.Scan] = &Scans{ScanID: e.Scan, StartedAt: e.At, Status: "running", Kind: e.scanKind()}
+		if e.Scan < s.lastScan {
+			s.lastScan = e.Scan
+		}
+	case opFinishScan:
+		if scan, ok := s.scans[e.Scan]; ok {
+			at := e.At
+			scan.Status, scan.CompletedAt = e.Status, &at
+		}
+	case opMeta:
+		for _, u := range e.Meta {
+			s.applyMeta(u)
+		}
+	case opCheckpoints:
+		for i := range e.Checkpoints {
+			s.applyCheckpoint(e.Checkpoints[i])
+		}
+	}
+}
+
+// applyRecord makes the record the current one of its file, a modification only brings the changed tags
+func (s *LocalStore) applyRecord(f FileHistory) {
+	if f.FileHistoryID < s.lastID {
+		s.lastID = f.FileHistoryID
+	}
+	if old, ok := s.files[f.Filename]; ok {
+		delete(s.byID, old.FileHistoryID)
+	}
+	switch {
+	case f.Action == "D":
+		s.removeFile(f.Filename)
+		return
+	case f.Action == "R":
+		// the old name is gone, the changelist doesn't write a deletion for it
+		if from, ok := s.byID[int64(f.PrevID)]; ok {
+			s.removeFile(from)
+			delete(s.byID, int64(f.PrevID))
+		}
+	case f.Delta:
+		base := []*RuleResults{}
+		if old, ok := s.files[f.Filename]; ok {
+			for _, rr := range old.RuleResults {
+				if rr.Meta == nil || !*rr.Meta {
+					base = append(base, rr)
+				}
+			}
+		}
+		f.RuleResults = append(ApplyTagChanges(base, f.TagChanges), f.RuleResults...)
+		f.TagChanges = nil
+	}
+	s.files[f.Filename] = &f
+	s.byID[f.FileHistoryID] = f.Filename
+	dir := parentDir(f.Filename)
+	if s.byDir[dir] == nil {
+		s.byDir[dir] = map[string]bool{}
+	}
+	s.byDir[dir][f.Filename] = true
+}
+
+func (s *LocalStore) removeFile(fn string) {
+	delete(s.files, fn)
+	dir := parentDir(fn)
+	delete(s.byDir[dir], fn)
+	if len(s.byDir[dir]) == 0 {
+		delete(s.byDir, dir)
+	}
+}
+
+// parentDir is the directory a file or folder is in, with a trailing slash like the folders
+func parentDir(fn string) string {
+	trimmed := strings.TrimSuffix(fn, "/")
+	return trimmed[:strings.LastIndex(trimmed, "/")+1]
+}
+
+func (s *LocalStore) applyMeta(u MetaUpdate) {
+	fn, ok := s.byID[u.FileHistoryID]
+	if !ok {
+		return
+	}
+	f := s.files[fn]
+	changed := map[string]*RuleResults{}
+	for _, rr := range append(u.Set, u.Add...) {
+		changed[*rr.Tag] = rr
+	}
+	for _, tag := range u.Remove {
+		changed[tag] = nil
+	}
+	results := []*RuleResults{}
+	for _, rr := range f.RuleResults {
+		if rr.Meta == nil || !*rr.Meta {
+			results = append(results, rr)
+			continue
+		}
+		if cur, ok := changed[*rr.Tag]; ok {
+			delete(changed, *rr.Tag)
+			if cur == nil {
+				continue
+			}
+			rr = cur
+		}
+		results = append(results, rr)
+	}
+	for _, rr := range u.Add {
+		if _, ok := changed[*rr.Tag]; ok {
+			results = append(results, rr)
+		}
+	}
+	f.RuleResults = results
+}
+
+func (s *LocalStore) applyCheckpoint(c ScanCheckpoints) {
+	scan, ok := s.scans[c.ScanID]
+	if !ok {
+		return
+	}
+	for i, old := range scan.ScanCheckpoints {
+		if old.Endpoint == c.Endpoint {
+			scan.ScanCheckpoints[i] = &c
+			return
+		}
+	}
+	scan.ScanCheckpoints = append(scan.ScanCheckpoints, &c)
+}
+
+func (s *LocalStore) WriteBatchSize() int {
+	return s.BatchSize
+}
+
+func (s *LocalStore) RunFetchRules(ruleTypes []string) ([]Rules, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Rules{}
+	for _, r := range s.rules {
+		for _, t := range ruleTypes {
+			if r.RuleType == t {
+				ret = append(ret, r)
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (s *LocalStore) RunFetchEndpoints() ([]Endpoints, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Endpoints{}, s.endpoints...), nil
+}
+
+func (s *LocalStore) RunFetchFiles() ([]FileHistory, error) {
+	return s.fetchFiles(func(string) bool { return true }), nil
+}
+
+// RunFetchFilesByName returns the current records of the given files and of all files below the given directories
+func (s *LocalStore) RunFetchFilesByName(filenames []string, dirs []string) ([]FileHistory, error) {
+	names := map[string]bool{}
+	for _, fn := range filenames {
+		names[fn] = true
+	}
+	return s.fetchFiles(func(fn string) bool {
+		if names[fn] {
+			return true
+		}
+		for _, dir := range dirs {
+			if strings.HasPrefix(fn, dir) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// RunFetchFilesIn returns the current records of the files and folders directly in the directory
+func (s *LocalStore) RunFetchFilesIn(dir string) ([]FileHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []FileHistory{}
+	for fn := range s.byDir[dir] {
+		ret = append(ret, s.copyFile(fn))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Filename < ret[j].Filename })
+	return ret, nil
+}
+
+// RunFetchKnownHashes returns which of the hashes the current files have
+func (s *LocalStore) RunFetchKnownHashes(hashes []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wanted := map[string]bool{}
+	for _, h := range hashes {
+		wanted[h] = true
+	}
+	ret := []string{}
+	for _, f := range s.files {
+		for _, rr := range f.RuleResults {
+			if rr.Tag != nil && *rr.Tag == "Hash" && rr.Value != nil && wanted[*rr.Value] {
+				ret = append(ret, *rr.Value)
+				delete(wanted, *rr.Value)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// RunFetchLinkRefs returns the files below the dirs that have a LinkRefs tag, with only that tag.
+// With mentions only the tags that contain one of them count, compared case-insensitively.
+func (s *LocalStore) RunFetchLinkRefs(dirs []string, mentions []string, after string, limit int) ([]FileHistory, error) {
+	files := s.fetchFiles(func(fn string) bool {
+		if fn <= after {
+			return false
+		}
+		for _, dir := range dirs {
+			if strings.HasPrefix(fn, dir) {
+				return true
+			}
+		}
+		return false
+	})
+	ret := []FileHistory{}
+	for _, f := range files {
+		for _, rr := range f.RuleResults {
+			if rr != nil && rr.Tag != nil && *rr.Tag == "LinkRefs" && rr.Value != nil && mentionsAny(*rr.Value, mentions) {
+				ret = append(ret, FileHistory{Filename: f.Filename, RuleResults: []*RuleResults{rr}})
+				break
+			}
+		}
+		if len(ret) == limit {
+			break
+		}
+	}
+	return ret, nil
+}
+
+// mentionsAny tells whether the value contains one of the mentions ignoring case, any value does without them
+func mentionsAny(value string, mentions []string) bool {
+	if len(mentions) == 0 {
+		return true
+	}
+	value = strings.ToLower(value)
+	for _, m := range mentions {
+		if strings.Contains(value, strings.ToLower(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunFetchFilesByBaseName returns the files whose last path component is one of the names or whose path
+// contains one of the parts, both compared case-insensitively
+func (s *LocalStore) RunFetchFilesByBaseName(names []string, parts []string) ([]string, error) {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[strings.ToLower(name)] = true
+	}
+	lowerParts := []string{}
+	for _, part := range parts {
+		lowerParts = append(lowerParts, strings.ToLower(part))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []string{}
+	for fn := range s.files {
+		trimmed := strings.TrimSuffix(fn, "/")
+		base := strings.ToLower(trimmed[strings.LastIndex(trimmed, "/")+1:])
+		match := wanted[base]
+		for _, part := range lowerParts {
+			match = match || strings.Contains(strings.ToLower(fn), part)
+		}
+		if match {
+			ret = append(ret, fn)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (s *LocalStore) fetchFiles(match func(string) bool) []FileHistory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []FileHistory{}
+	for fn := range s.files {
+		if match(fn) {
+			ret = append(ret, s.copyFile(fn))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Filename < ret[j].Filename })
+	return ret
+}
+
+// copyFile returns the current record of the file, the tags can be changed without changing the store
+func (s *LocalStore) copyFile(fn string) FileHistory {
+	cp := *s.files[fn]
+	cp.RuleResults = append([]*RuleResults{}, cp.RuleResults...)
+	return cp
+}
+
+func (s *LocalStore) RunCreateScan(kind string) (*int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scan := s.lastScan - 1
+	if err := s.append(journalEntry{Op: opCreateScan, Scan: scan, Kind: kind}); err != nil {
+		return nil, err
+	}
+	return &scan, nil
+}
+
+func (s *LocalStore) RunFinishScan(scan int, status string) (*Scans, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.scans[scan]; !ok {
+		return nil, fmt.Errorf("scan %v does not exist", scan)
+	}
+	if err := s.append(journalEntry{Op: opFinishScan, Scan: scan, Status: status}); err != nil {
+		return nil, err
+	}
+	ret := *s.scans[scan]
+	count := s.counts[scan]
+	ret.FileHistoriesAggregate = &FileHistoryAggregate{Aggregate: &FileHistoryAggregateFields{Count: &count}}
+	return &ret, nil
+}
+
+// RunFetchUnfinishedScans returns the scans that are still running, newest first and with their checkpoints
+func (s *LocalStore) RunFetchUnfinishedScans() ([]Scans, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Scans{}
+	for _, scan := range s.scans {
+		if scan.Status == "running" {
+			ret = append(ret, *scan)
+		}
+	}
+	// local scans count down
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ScanID < ret[j].ScanID })
+	return ret, nil
+}
+
+// RunCountScansSinceFull returns how many incremental scans completed after the last completed full
+// scan, or nil if no full scan has completed yet. A push drops the pushed scans, so the next scan after
+// it is a full one.
+func (s *LocalStore) RunCountScansSinceFull() (*int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lastFull *time.Time
+	for _, scan := range s.scans {
+		if scan.Status == "completed" && scan.Kind == ScanFull && (lastFull == nil || scan.CompletedAt.After(*lastFull)) {
+			lastFull = scan.CompletedAt
+		}
+	}
+	if lastFull == nil {
+		return nil, nil
+	}
+	count := 0
+	for _, scan := range s.scans {
+		if scan.Status == "completed" && scan.Kind == ScanIncremental && scan.CompletedAt.After(*lastFull) {
+			count++
+		}
+	}
+	return &count, nil
+}
+
+func (s *LocalStore) RunSaveScanCheckpoints(checkpoints []ScanCheckpoints) error {
+	return s.appendIf(len(checkpoints) > 0, journalEntry{Op: opCheckpoints, Checkpoints: checkpoints})
+}
+
+// RunInsertFileHistory gives the records their ids and writes them as a single entry
+func (s *LocalStore) RunInsertFileHistory(files []FileHistory) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(files) == 0 {
+		return []int64{}, nil
+	}
+	records := make([]FileHistory, len(files))
+	ids := make([]int64, len(files))
+	now := time.Now()
+	for i := range files {
+		records[i] = files[i]
+		ids[i] = s.lastID - int64(i) - 1
+		records[i].FileHistoryID = ids[i]
+		if records[i].ActionTstamp == nil {
+			records[i].ActionTstamp = &now
+		}
+	}
+	if err := s.append(journalEntry{Op: opFiles, Files: records}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *LocalStore) RunUpdateMeta(updates []MetaUpdate) error {
+	return s.appendIf(len(updates) > 0, journalEntry{Op: opMeta, Meta: updates})
+}
+
+func (s *LocalStore) RunInsertScanErrors(errs []ScanErrors) error {
+	return s.appendIf(len(errs) > 0, journalEntry{Op: opErrors, Errors: errs})
+}
+
+func (s *LocalStore) RunUpsertFileLinks(links []FileLinks) error {
+	return s.appendIf(len(links) > 0, journalEntry{Op: opLinks, Links: links})
+}
+
+func (s *LocalStore) RunDeleteStaleFileLinks(scan int, sources []string, dirs []string) error {
+	return s.appendIf(len(sources) > 0 || len(dirs) > 0, journalEntry{Op: opDeleteLinks, Scan: scan, Sources: sources, Dirs: dirs})
+}
+
+func (s *LocalStore) appendIf(cond bool, e journalEntry) error {
+	if !cond {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(e)
+}
+
+// Pull replaces the rules, endpoints and files of the store with those of the server. The scans
+// that were not pushed yet would be lost, so pulling is refused until they are.
+func (s *LocalStore) Pull(gg *GamtracGql, ruleTypes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unpushed > 0 {
+		return fmt.Errorf("%v changes of the local store were not pushed to the server yet", s.unpushed)
+	}
+	rules, err := gg.RunFetchRules(ruleTypes)
+	if err != nil {
+		return err
+	}
+	endpoints, err := gg.RunFetchEndpoints()
+	if err != nil {
+		return err
+	}
+	files, err := gg.RunFetchFiles()
+	if err != nil {
+		return err
+	}
+	if err := writeJSONFile(filepath.Join(s.dir, "rules.json"), rules); err != nil {
+		return err
+	}
+	if err := writeJSONFile(filepath.Join(s.dir, "endpoints.json"), endpoints); err != nil {
+		return err
+	}
+	s.rules, s.endpoints = rules, endpoints
+	return s.replaceJournal([]journalEntry{{Op: opSeed, At: time.Now(), Files: files}})
+}
+
+// replaceJournal rewrites the journal and rebuilds the state from it
+func (s *LocalStore) replaceJournal(entries []journalEntry) error {
+	if err := s.journal.Close(); err != nil {
+		return err
+	}
+	if err := writeJournal(s.journalPath(), entries); err != nil {
+		return err
+	}
+	var err error
+	s.journal, err = os.OpenFile(s.journalPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.reset(entries)
+	return nil
+}
+
+// pushProgress remembers the server ids of the local scans and records while the journal is pushed,
+// an interrupted push continues after the last entry it finished. The records of an entry are inserted
+// in batches, those that have a server id are not inserted again.
+type pushProgress struct {
+	Done  int             `json:"done"`
+	Scans map[int]int     `json:"scans"`
+	IDs   map[int64]int64 `json:"ids"`
+	// the local ids of the batch being inserted, the push may have stopped before its ids were saved
+	Batch []int64 `json:"batch,omitempty"`
+}
+
+func (p *pushProgress) scan(local int) (int, error) {
+	if local >= 0 {
+		return local, nil
+	}
+	if id, ok := p.Scans[local]; ok {
+		return id, nil
+	}
+	return 0, fmt.Errorf("local scan %v was not pushed", local)
+}
+
+func (p *pushProgress) id(local int64) (int64, error) {
+	if local >= 0 {
+		return local, nil
+	}
+	if id, ok := p.IDs[local]; ok {
+		return id, nil
+	}
+	return 0, fmt.Errorf("local record %v was not pushed", local)
+}
+
+// Push replays the journal on the server in the order it was written, the scans keep their local start
+// and completion times. Afterwards the journal only holds the files as they are on the server.
+// Files the server scanned in the meantime end up with the history of both, ordered by when it was pushed.
+func (s *LocalStore) Push(gg *GamtracGql) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, scan := range s.scans {
+		if scan.Status == "running" {
+			return 0, fmt.Errorf("local scan %v is still running, finish it before pushing", scan.ScanID)
+		}
+	}
+	entries, err := readJournal(s.journalPath())
+	if err != nil {
+		return 0, err
+	}
+	progressPath := filepath.Join(s.dir, "push.json")
+	progress := pushProgress{Scans: map[int]int{}, IDs: map[int64]int64{}}
+	if err := readJSONFile(progressPath, &progress); err != nil {
+		return 0, err
+	}
+	save := func() error {
+		return writeJSONFile(progressPath, progress)
+	}
+	pushed := 0
+	for i := progress.Done; i < len(entries); i++ {
+		if err := pushEntry(gg, entries[i], &progress, save); err != nil {
+			return pushed, fmt.Errorf("cannot push entry %v of the journal: %v", i+1, err)
+		}
+		progress.Done = i + 1
+		if err := save(); err != nil {
+			return pushed, err
+		}
+		if entries[i].Op != opSeed {
+			pushed++
+		}
+	}
+	// the files keep their place in the history of the server
+	seed := []FileHistory{}
+	for _, f := range s.files {
+		cp := *f
+		if cp.FileHistoryID, err = progress.id(f.FileHistoryID); err != nil {
+			return pushed, err
+		}
+		if cp.ScanID, err = progress.scan(f.ScanID); err != nil {
+			return pushed, err
+		}
+		seed = append(seed, cp)
+	}
+	sort.Slice(seed, func(i, j int) bool { return seed[i].Filename < seed[j].Filename })
+	if err := s.replaceJournal([]journalEntry{{Op: opSeed, At: time.Now(), Files: seed}}); err != nil {
+		return pushed, err
+	}
+	return pushed, os.Remove(progressPath)
+}
+
+func pushEntry(gg *GamtracGql, e journalEntry, p *pushProgress, save func() error) error {
+	var err error
+	switch e.Op {
+	case opCreateScan:
+		id, err := gg.runCreateScanAt(e.At, e.scanKind())
+		if err != nil {
+			return err
+		}
+		p.Scans[e.Scan] = id
+	case opFinishScan:
+		scan, err := p.scan(e.Scan)
+		if err != nil {
+			return err
+		}
+		return gg.runFinishScanAt(scan, e.Status, e.At)
+	case opFiles:
+		return pushFiles(gg, e.Files, p, save)
+	case opMeta:
+		for i := range e.Meta {
+			if e.Meta[i].FileHistoryID, err = p.id(e.Meta[i].FileHistoryID); err != nil {
+				return err
+			}
+		}
+		return gg.RunUpdateMeta(e.Meta)
+	case opErrors:
+		for i := range e.Errors {
+			if e.Errors[i].ScanID, err = p.scan(e.Errors[i].ScanID); err != nil {
+				return err
+			}
+		}
+		return gg.RunInsertScanErrors(e.Errors)
+	case opLinks:
+		for i := range e.Links {
+			if e.Links[i].ScanID, err = p.scan(e.Links[i].ScanID); err != nil {
+				return err
+			}
+		}
+		return gg.RunUpsertFileLinks(e.Links)
+	case opDeleteLinks:
+		scan, err := p.scan(e.Scan)
+		if err != nil {
+			return err
+		}
+		return gg.RunDeleteStaleFileLinks(scan, e.Sources, e.Dirs)
+	}
+	// seeds are already on the server, checkpoints only matter to resume a local scan
+	return nil
+}
+
+// pushFiles inserts the records that are not on the server yet a batch at a time and saves the progress
+// after every batch, so that an interrupted push doesn't insert a batch twice
+func pushFiles(gg *GamtracGql, files []FileHistory, p *pushProgress, save func() error) error {
+	records, locals := []FileHistory{}, []int64{}
+	for _, f := range files {
+		if _, done := p.IDs[f.FileHistoryID]; done {
+			continue
+		}
+		rec := f
+		rec.FileHistoryID = 0
+		var err error
+		if rec.ScanID, err = p.scan(f.ScanID); err != nil {
+			return err
+		}
+		prev, err := p.id(int64(f.PrevID))
+		if err != nil {
+			return err
+		}
+		rec.PrevID = int(prev)
+		records = append(records, rec)
+		locals = append(locals, f.FileHistoryID)
+	}
+	// the batch the last push was inserting may have been committed after all
+	if len(p.Batch) > 0 {
+		pending := map[int64]bool{}
+		for _, id := range p.Batch {
+			pending[id] = true
+		}
+		batch, batchLocals := []FileHistory{}, []int64{}
+		for i := range records {
+			if pending[locals[i]] {
+				batch = append(batch, records[i])
+				batchLocals = append(batchLocals, locals[i])
+			}
+		}
+		ids, err := gg.findInsertedFileHistory(batch)
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			p.IDs[batchLocals[i]] = id
+		}
+		p.Batch = nil
+		if err := save(); err != nil {
+			return err
+		}
+		// the records left to insert are listed again without the ones found
+		return pushFiles(gg, files, p, save)
+	}
+	for _, b := range gg.batches(len(records)) {
+		p.Batch = locals[b[0]:b[1]]
+		if err := save(); err != nil {
+			return err
+		}
+		ids, err := gg.runInsertFileHistoryBatch(records[b[0]:b[1]])
+		if err != nil {
+			return fmt.Errorf("cannot insert file records %v-%v of %v: %v", b[0], b[1], len(records), err)
+		}
+		if len(ids) != b[1]-b[0] {
+			return fmt.Errorf("invalid number of file records inserted: expected %v, got %v", b[1]-b[0], len(ids))
+		}
+		for i, id := range ids {
+			p.IDs[locals[b[0]+i]] = id
+		}
+		p.Batch = nil
+		if err := save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCreateScanAt creates a scan that was started at the given time, i.e. one run offline
+func (gg *GamtracGql) runCreateScanAt(startedAt time.Time, kind string) (int, error) {
+	var respData struct {
+		CreateScan struct {
+			Scans []Scans `json:"returning"`
+		} `json:"insert_scans"`
+	}
+	query := `
+	mutation ($started_at: timestamptz!, $kind: String!) {
+		insert_scans(objects: [{started_at: $started_at, completed_at: null, kind: $kind}]) {
+			returning {
+				scan_id
+			}
+		}
+	}
+	`
+	vars := map[string]interface{}{
+		"started_at": startedAt,
+		"kind":       kind,
+	}
+	if err := gg.Run(query, &respData, vars); err != nil {
+		return 0, err
+	}
+	return respData.CreateScan.Scans[0].ScanID, nil
+}
+
+func (gg *GamtracGql) runFinishScanAt(scan int, status string, completedAt time.Time) error {
+	query := `
+	mutation ($scan_id: Int!, $status: String!, $completed_at: timestamptz!) {
+		update_scans (where: {scan_id: {_eq: $scan_id}}, _set: {completed_at: $completed_at, status: $status}) {
+			affected_rows
+		}
+	}
+	`
+	vars := map[string]interface{}{
+		"scan_id":      scan,
+		"status":       status,
+		"completed_at": completedAt,
+	}
+	return gg.RunWithRetry(query, nil, vars)
+}
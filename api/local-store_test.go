@@ -0,0 +1,280 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func tempStore(t *testing.T) (*LocalStore, string) {
+	dir, err := ioutil.TempDir("", "gamtrac-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenLocalStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	js, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(js)
+}
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	s, dir := tempStore(t)
+	defer os.RemoveAll(dir)
+	scan, err := s.RunCreateScan(ScanFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := []FileHistory{
+		{Filename: "/share/X1/a.txt", Action: "C", ScanID: *scan, RuleResults: storedRecord(1, "Size", "42", "проект", "X1").RuleResults},
+		{Filename: "/share/X1/b.txt", Action: "C", ScanID: *scan, RuleResults: storedRecord(1, "Size", "7").RuleResults},
+		{Filename: "/share/X1/", Action: "C", ScanID: *scan},
+	}
+	ids, err := s.RunInsertFileHistory(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RunFinishScan(*scan, "completed"); err != nil {
+		t.Fatal(err)
+	}
+	scan, err = s.RunCreateScan(ScanFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := "43"
+	changes := []FileHistory{
+		{Filename: "/share/X1/a.txt", Action: "M", ScanID: *scan, PrevID: int(ids[0]), Delta: true,
+			TagChanges: []*TagChanges{{Tag: "Size", OldValue: created[0].RuleResults[0].Value, NewValue: &size}}},
+		{Filename: "/share/X1/b.txt", Action: "D", ScanID: *scan, PrevID: int(ids[1])},
+	}
+	if _, err := s.RunInsertFileHistory(changes); err != nil {
+		t.Fatal(err)
+	}
+	processed, meta := "\"2019-08-12T14:30:00Z\"", true
+	tag := "ProcessedAt"
+	err = s.RunUpdateMeta([]MetaUpdate{{FileHistoryID: ids[2], Add: []*RuleResults{{Tag: &tag, Value: &processed, Meta: &meta}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RunSaveScanCheckpoints([]ScanCheckpoints{{ScanID: *scan, Endpoint: "/share/", LastPath: "/share/X1/"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := s.RunFetchFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scans, err := s.RunFetchUnfinishedScans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	reloadedFiles, err := reopened.RunFetchFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadedScans, err := reopened.RunFetchUnfinishedScans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mustJSON(t, reloadedFiles), mustJSON(t, files); got != want {
+		t.Errorf("files after reopening:\n got %v\nwant %v", got, want)
+	}
+	if got, want := mustJSON(t, reloadedScans), mustJSON(t, scans); got != want {
+		t.Errorf("unfinished scans after reopening:\n got %v\nwant %v", got, want)
+	}
+	if len(files) != 2 || files[1].Filename != "/share/X1/a.txt" || len(files[1].RuleResults) != 2 {
+		t.Fatalf("unexpected files %v", mustJSON(t, files))
+	}
+	tags := map[string]string{}
+	for _, rr := range files[1].RuleResults {
+		tags[*rr.Tag] = *rr.Value
+	}
+	if tags["Size"] != "43" || tags["проект"] != "X1" {
+		t.Errorf("tags of the modified file are %v, want the new size and the old project", tags)
+	}
+}
+
+func TestCountScansSinceFull(t *testing.T) {
+	s, dir := tempStore(t)
+	defer os.RemoveAll(dir)
+	run := func(kind, status string) {
+		scan, err := s.RunCreateScan(kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.RunFinishScan(*scan, status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() *int {
+		since, err := s.RunCountScansSinceFull()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return since
+	}
+
+	run(ScanFull, "failed")
+	if since := count(); since != nil {
+		t.Errorf("%v scans since a full scan that failed, want none", *since)
+	}
+	run(ScanFull, "completed")
+	run(ScanIncremental, "completed")
+	run(ScanWatch, "completed")
+	run(ScanIncremental, "abandoned")
+	run(ScanIncremental, "completed")
+	if since := count(); since == nil || *since != 2 {
+		t.Errorf("scans since the full scan %v, want 2", since)
+	}
+
+	// the count survives a restart of the scanner
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if s, err = OpenLocalStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if since := count(); since == nil || *since != 2 {
+		t.Errorf("scans since the full scan after reopening %v, want 2", since)
+	}
+	run(ScanFull, "completed")
+	if since := count(); since == nil || *since != 0 {
+		t.Errorf("scans since the new full scan %v, want 0", since)
+	}
+}
+
+// fakeHasura stores the file records inserted by a push, failsAt makes that insert fail after its
+// records were committed, like a connection that drops before the response arrives
+type fakeHasura struct {
+	mu      sync.Mutex
+	records []FileHistory
+	inserts int
+	failsAt int
+	scans   int
+}
+
+func (f *fakeHasura) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query     string                     `json:"query"`
+		Variables map[string]json.RawMessage `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var data interface{} = map[string]interface{}{}
+	switch {
+	case strings.Contains(req.Query, "insert_scans"):
+		f.scans++
+		data = JSON{"insert_scans": JSON{"returning": []JSON{{"scan_id": f.scans}}}}
+	case strings.Contains(req.Query, "insert_file_history"):
+		var files []FileHistory
+		if err := json.Unmarshal(req.Variables["files"], &files); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		returning := []JSON{}
+		for _, fh := range files {
+			fh.FileHistoryID = int64(len(f.records) + 1)
+			f.records = append(f.records, fh)
+			returning = append(returning, JSON{"file_history_id": fh.FileHistoryID})
+		}
+		f.inserts++
+		if f.inserts == f.failsAt {
+			json.NewEncoder(w).Encode(JSON{"errors": []JSON{{"message": "connection reset"}}})
+			return
+		}
+		data = JSON{"insert_file_history": JSON{"returning": returning}}
+	case strings.Contains(req.Query, "file_history(where"):
+		var scan int
+		var filenames []string
+		json.Unmarshal(req.Variables["scan"], &scan)
+		json.Unmarshal(req.Variables["filenames"], &filenames)
+		found := []FileHistory{}
+		for _, fh := range f.records {
+			for _, fn := range filenames {
+				if fh.ScanID == scan && fh.Filename == fn {
+					found = append(found, fh)
+				}
+			}
+		}
+		data = JSON{"file_history": found}
+	}
+	json.NewEncoder(w).Encode(JSON{"data": data})
+}
+
+func TestPushResumesAfterBatch(t *testing.T) {
+	s, dir := tempStore(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	scan, err := s.RunCreateScan(ScanFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []FileHistory{}
+	for _, fn := range []string{"a", "b", "c", "d", "e"} {
+		files = append(files, FileHistory{Filename: "/share/" + fn, Action: "C", ScanID: *scan})
+	}
+	if _, err := s.RunInsertFileHistory(files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RunFinishScan(*scan, "completed"); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeHasura{failsAt: 2}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	gg := NewGamtracGql(ts.URL, 5000, false)
+	gg.BatchSize = 2
+	gg.Retries = 0
+	if _, err := s.Push(gg); err == nil {
+		t.Fatal("the push succeeded although the second batch failed")
+	}
+	if _, err := s.Push(gg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.records) != len(files) {
+		t.Errorf("the server has %v records, want %v: %v", len(server.records), len(files), mustJSON(t, server.records))
+	}
+	if server.scans != 1 {
+		t.Errorf("the server has %v scans, want 1", server.scans)
+	}
+	pushed, err := s.RunFetchFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fh := range pushed {
+		stored := server.records[fh.FileHistoryID-1]
+		if fh.FileHistoryID <= 0 || stored.Filename != fh.Filename || fh.ScanID != 1 {
+			t.Errorf("%v was pushed as record %v of scan %v, the server has %v there", fh.Filename, fh.FileHistoryID, fh.ScanID, stored.Filename)
+		}
+	}
+}
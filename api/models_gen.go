@@ -1437,17 +1437,6 @@ type RulesVarianceOrderBy struct {
 	RuleID    *OrderBy `json:"rule_id"`
 }
 
-// columns and relationships of "scans"
-type Scans struct {
-	CompletedAt *time.Time `json:"completed_at"`
-	// An array relationship
-	FileHistories []*FileHistory `json:"file_histories"`
-	// An aggregated array relationship
-	FileHistoriesAggregate *FileHistoryAggregate `json:"file_histories_aggregate"`
-	ScanID                 int                   `json:"scan_id"`
-	StartedAt              time.Time             `json:"started_at"`
-}
-
 // aggregated selection of "scans"
 type ScansAggregate struct {
 	Aggregate *ScansAggregateFields `json:"aggregate"`
@@ -17,6 +17,10 @@ type RuleResults struct {
 	Tag          *string `json:"tag,omitempty"`
 	Value        *string `json:"value,omitempty"`
 	Meta         *bool   `json:"meta,omitempty"` // use this flag to disable diffing
+	// the value as native json along with its number or time, see typedValue
+	JSONValue interface{} `json:"json_value,omitempty"`
+	NumValue  *float64    `json:"num_value,omitempty"`
+	TimeValue *time.Time  `json:"time_value,omitempty"`
 }
 
 
@@ -36,4 +40,88 @@ type FileHistory struct {
 	// An object relationship
 	Scan   *Scans `json:"scan,omitempty"`
 	ScanID int    `json:"scan_id,omitempty"`
+	// modifications only store the tags that changed in tag_changes instead of all rule results
+	Delta bool `json:"delta,omitempty"`
+	// An array relationship
+	TagChanges []*TagChanges `json:"tag_changes,omitempty"`
+}
+
+// columns and relationships of "tag_changes"
+type TagChanges struct {
+	TagChangeID   *int64 `json:"tag_change_id,omitempty"`
+	FileHistoryID *int64 `json:"file_history_id,omitempty"`
+	// An object relationship
+	FileHistory *FileHistory `json:"file_history,omitempty"`
+	RuleID      *int         `json:"rule_id,omitempty"`
+	Tag         string       `json:"tag"`
+	// nil when the tag was added
+	OldValue *string `json:"old_value"`
+	// nil when the tag was removed
+	NewValue *string `json:"new_value"`
+	Meta     bool    `json:"meta"`
+	// the new value as native json along with its number or time
+	JSONValue interface{} `json:"json_value,omitempty"`
+	NumValue  *float64    `json:"num_value,omitempty"`
+	TimeValue *time.Time  `json:"time_value,omitempty"`
+}
+
+// columns of "tag_history", every value a tag of a file had
+type TagHistory struct {
+	FileHistoryID int64      `json:"file_history_id"`
+	Filename      string     `json:"filename"`
+	ScanID        int        `json:"scan_id"`
+	Action        string     `json:"action"`
+	ActionTstamp  *time.Time `json:"action_tstamp,omitempty"`
+	RuleID        *int       `json:"rule_id,omitempty"`
+	Tag           string     `json:"tag"`
+	OldValue      *string    `json:"old_value"`
+	NewValue      *string    `json:"new_value"`
+	Meta          bool       `json:"meta"`
+}
+
+// columns and relationships of "scan_errors"
+type ScanErrors struct {
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	Filename    string     `json:"filename"`
+	Message     string     `json:"message"`
+	RuleID      *int       `json:"rule_id,omitempty"`
+	ScanErrorID int        `json:"scan_error_id,omitempty"`
+	ScanID      int        `json:"scan_id"`
+}
+
+// columns and relationships of "scans"
+type Scans struct {
+	CompletedAt *time.Time `json:"completed_at"`
+	// An array relationship
+	FileHistories []*FileHistory `json:"file_histories"`
+	// An aggregated array relationship
+	FileHistoriesAggregate *FileHistoryAggregate `json:"file_histories_aggregate"`
+	ScanID                 int                   `json:"scan_id"`
+	StartedAt              time.Time             `json:"started_at"`
+	// running, completed, failed or abandoned
+	Status string `json:"status,omitempty"`
+	// full, incremental or watch, see ScanFull
+	Kind string `json:"kind,omitempty"`
+	// An array relationship
+	ScanCheckpoints []*ScanCheckpoints `json:"scan_checkpoints,omitempty"`
+}
+
+// columns and relationships of "scan_checkpoints"
+type ScanCheckpoints struct {
+	Endpoint  string     `json:"endpoint"`
+	LastPath  string     `json:"last_path"`
+	ScanID    int        `json:"scan_id"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// columns and relationships of "file_links"
+type FileLinks struct {
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// the file that refers to the target
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// the text in the source that was resolved to the target
+	Reference string `json:"reference"`
+	// the scan that found the link
+	ScanID int `json:"scan_id"`
 }
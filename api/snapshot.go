@@ -0,0 +1,413 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Snapshot is the state of the tracked files as of a scan: the latest record of every file
+// written by that scan or an earlier one, unless the file was deleted or renamed by then
+type Snapshot struct {
+	ScanID int
+	Files  map[string]*FileHistory
+}
+
+// Filenames returns the files of the snapshot in order
+func (s *Snapshot) Filenames() []string {
+	ret := make([]string, 0, len(s.Files))
+	for fn := range s.Files {
+		ret = append(ret, fn)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Tags returns the tags of a file of the snapshot, meta tags like the processing time are left out
+func (s *Snapshot) Tags(filename string) map[string]string {
+	ret := map[string]string{}
+	fh, ok := s.Files[filename]
+	if !ok {
+		return ret
+	}
+	for _, rr := range fh.RuleResults {
+		if rr == nil || rr.Tag == nil || rr.Value == nil || (rr.Meta != nil && *rr.Meta) {
+			continue
+		}
+		ret[*rr.Tag] = *rr.Value
+	}
+	return ret
+}
+
+// RunFetchScanAt returns the last scan completed at or before t. A scan that was still running at t
+// may already have written records, but not all of them, so it is not a state the files were in.
+func (gg *GamtracGql) RunFetchScanAt(t time.Time) (int, error) {
+	var respData struct {
+		Scans []Scans `json:"scans"`
+	}
+	query := `
+	query ($at: timestamptz!) {
+		scans (where: {completed_at: {_lte: $at}}, order_by: [{completed_at: desc}, {scan_id: desc}], limit: 1) {
+			scan_id
+			started_at
+			completed_at
+		}
+	}
+	`
+	vars := map[string]interface{}{
+		"at": t,
+	}
+	if err := gg.Run(query, &respData, vars); err != nil {
+		return 0, err
+	}
+	if len(respData.Scans) == 0 {
+		return 0, fmt.Errorf("no scan was completed before %v", t.Format(time.RFC3339))
+	}
+	return respData.Scans[0].ScanID, nil
+}
+
+// RunFetchSnapshot reconstructs the files below prefix as of the scan. The latest record of
+// every filename up to the scan is taken from file_history, deleted files are dropped and so are
+// files that were renamed, which is known from the rename records pointing at them via prev_id.
+// The tags are those of the last full record with the tag changes of the later modifications applied.
+func (gg *GamtracGql) RunFetchSnapshot(scan int, prefix string) (*Snapshot, error) {
+	pattern := likePattern(prefix)
+	where := JSON{
+		"scan_id":         JSON{"_lte": scan},
+		"file_history_id": JSON{"_neq": 0},
+		"filename":        JSON{"_like": pattern + "%"},
+	}
+	latest, err := gg.runFetchLatestRecords(where, false)
+	if err != nil {
+		return nil, err
+	}
+	bases, err := gg.runFetchLatestRecords(JSON{"_and": []JSON{where, {"delta": JSON{"_eq": false}}}}, true)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := gg.runFetchTagChanges(JSON{"file_history": where})
+	if err != nil {
+		return nil, err
+	}
+	ids := []int64{}
+	for _, fh := range latest {
+		if fh.Action != "D" {
+			ids = append(ids, fh.FileHistoryID)
+		}
+	}
+	renamed, err := gg.runFetchRenamedAway(scan, ids)
+	if err != nil {
+		return nil, err
+	}
+	baseByName := map[string]*FileHistory{}
+	for i := range bases {
+		baseByName[bases[i].Filename] = &bases[i]
+	}
+	changesByName := map[string][]*TagChanges{}
+	for _, tc := range changes {
+		fn := tc.FileHistory.Filename
+		changesByName[fn] = append(changesByName[fn], tc)
+	}
+	ret := &Snapshot{ScanID: scan, Files: map[string]*FileHistory{}}
+	for i := range latest {
+		fh := &latest[i]
+		if fh.Action == "D" || renamed[fh.FileHistoryID] {
+			continue
+		}
+		if base, ok := baseByName[fh.Filename]; ok {
+			fh.RuleResults = ApplyTagChanges(base.RuleResults, changesBetween(changesByName[fh.Filename], base.FileHistoryID, fh.FileHistoryID))
+		}
+		ret.Files[fh.Filename] = fh
+	}
+	return ret, nil
+}
+
+// runFetchLatestRecords returns the latest record of every filename matching where. The records are
+// fetched in pages of BatchSize filenames, a large share has more than a response should hold.
+func (gg *GamtracGql) runFetchLatestRecords(where JSON, withResults bool) ([]FileHistory, error) {
+	var respData struct {
+		FileHistory []FileHistory `json:"file_history"`
+	}
+	results := ""
+	if withResults {
+		results = `rule_results {
+				file_history_id
+				rule_result_id
+				rule_id
+				created_at
+				tag
+				value
+				meta
+			}`
+	}
+	query := `
+	query ($where: file_history_bool_exp!, $limit: Int) {
+		file_history(where: $where, distinct_on: filename, order_by: [{filename: asc}, {file_history_id: desc}], limit: $limit) {
+			file_history_id
+			action
+			action_tstamp
+			filename
+			prev_id
+			scan_id
+			delta
+			` + results + `
+		}
+	}
+	`
+	ret := []FileHistory{}
+	after := ""
+	for {
+		respData.FileHistory = nil
+		vars := map[string]interface{}{
+			"where": JSON{"_and": []JSON{where, {"filename": JSON{"_gt": after}}}},
+			"limit": gg.pageSize(),
+		}
+		if err := gg.RunWithRetry(query, &respData, vars); err != nil {
+			return nil, err
+		}
+		ret = append(ret, respData.FileHistory...)
+		page := len(respData.FileHistory)
+		if page == 0 || gg.pageSize() == nil || page < *gg.pageSize() {
+			return ret, nil
+		}
+		after = respData.FileHistory[page-1].Filename
+	}
+}
+
+// runFetchTagChanges returns the tag changes matching where in the order they were made, in pages of
+// BatchSize changes
+func (gg *GamtracGql) runFetchTagChanges(where JSON) ([]*TagChanges, error) {
+	var respData struct {
+		TagChanges []*TagChanges `json:"tag_changes"`
+	}
+	query := `
+	query ($where: tag_changes_bool_exp!, $limit: Int) {
+		tag_changes(where: $where, order_by: [{file_history_id: asc}, {tag_change_id: asc}], limit: $limit) {
+			tag_change_id
+			file_history_id
+			rule_id
+			tag
+			old_value
+			new_value
+			meta
+			file_history {
+				filename
+			}
+		}
+	}
+	`
+	ret := []*TagChanges{}
+	page := where
+	for {
+		respData.TagChanges = nil
+		vars := map[string]interface{}{
+			"where": page,
+			"limit": gg.pageSize(),
+		}
+		if err := gg.RunWithRetry(query, &respData, vars); err != nil {
+			return nil, err
+		}
+		ret = append(ret, respData.TagChanges...)
+		n := len(respData.TagChanges)
+		if n == 0 || gg.pageSize() == nil || n < *gg.pageSize() {
+			return ret, nil
+		}
+		last := respData.TagChanges[n-1]
+		if last.FileHistoryID == nil || last.TagChangeID == nil {
+			return nil, fmt.Errorf("tag change without ids in a page of %v", n)
+		}
+		page = JSON{"_and": []JSON{where, {"_or": []JSON{
+			{"file_history_id": JSON{"_gt": *last.FileHistoryID}},
+			{"file_history_id": JSON{"_eq": *last.FileHistoryID}, "tag_change_id": JSON{"_gt": *last.TagChangeID}},
+		}}}}
+	}
+}
+
+// pageSize is the limit of a paginated query, nil when the results are fetched at once
+func (gg *GamtracGql) pageSize() *int {
+	if gg.BatchSize <= 0 {
+		return nil
+	}
+	return &gg.BatchSize
+}
+
+// changesBetween keeps the changes made after the record from and up to the record to
+func changesBetween(changes []*TagChanges, from, to int64) []*TagChanges {
+	ret := []*TagChanges{}
+	for _, tc := range changes {
+		if tc.FileHistoryID != nil && *tc.FileHistoryID > from && *tc.FileHistoryID <= to {
+			ret = append(ret, tc)
+		}
+	}
+	return ret
+}
+
+// ApplyTagChanges replays the changes in order on the rule results of a full record
+func ApplyTagChanges(base []*RuleResults, changes []*TagChanges) []*RuleResults {
+	byTag := map[string]*RuleResults{}
+	tags := []string{}
+	for _, rr := range base {
+		if rr == nil || rr.Tag == nil {
+			continue
+		}
+		if _, ok := byTag[*rr.Tag]; !ok {
+			tags = append(tags, *rr.Tag)
+		}
+		byTag[*rr.Tag] = rr
+	}
+	for _, tc := range changes {
+		if tc.NewValue == nil {
+			delete(byTag, tc.Tag)
+			continue
+		}
+		if _, ok := byTag[tc.Tag]; !ok {
+			tags = append(tags, tc.Tag)
+		}
+		tag, meta := tc.Tag, tc.Meta
+		byTag[tc.Tag] = &RuleResults{Tag: &tag, Value: tc.NewValue, RuleID: tc.RuleID, Meta: &meta,
+			JSONValue: tc.JSONValue, NumValue: tc.NumValue, TimeValue: tc.TimeValue}
+	}
+	ret := []*RuleResults{}
+	for _, tag := range tags {
+		if rr, ok := byTag[tag]; ok {
+			ret = append(ret, rr)
+			delete(byTag, tag) // a tag removed and added again is listed twice
+		}
+	}
+	return ret
+}
+
+// runFetchRenamedAway finds which of the records were renamed to another filename up to the scan
+func (gg *GamtracGql) runFetchRenamedAway(scan int, ids []int64) (map[int64]bool, error) {
+	var respData struct {
+		FileHistory []FileHistory `json:"file_history"`
+	}
+	query := `
+	query ($scan: Int!, $ids: [Int!]!) {
+		file_history(where: {action: {_eq: "R"}, scan_id: {_lte: $scan}, prev_id: {_in: $ids}}) {
+			prev_id
+		}
+	}
+	`
+	ret := map[int64]bool{}
+	for _, b := range gg.batches(len(ids)) {
+		vars := map[string]interface{}{
+			"scan": scan,
+			"ids":  ids[b[0]:b[1]],
+		}
+		if err := gg.Run(query, &respData, vars); err != nil {
+			return nil, err
+		}
+		for _, fh := range respData.FileHistory {
+			ret[int64(fh.PrevID)] = true
+		}
+	}
+	return ret, nil
+}
+
+// TagChange is a tag that was added, removed or changed, Old or New is nil when the tag did not exist
+type TagChange struct {
+	Tag string
+	Old *string
+	New *string
+}
+
+type FileDiff struct {
+	Filename string
+	Changes  []TagChange
+}
+
+// SnapshotDiff lists what happened to the files between two snapshots
+type SnapshotDiff struct {
+	Created  []string
+	Deleted  []string
+	Modified []FileDiff
+}
+
+// DiffSnapshots compares the files and their tags of two snapshots, a renamed file shows up
+// as deleted under its old name and created under its new one
+func DiffSnapshots(from, to *Snapshot) SnapshotDiff {
+	ret := SnapshotDiff{Created: []string{}, Deleted: []string{}, Modified: []FileDiff{}}
+	for _, fn := range from.Filenames() {
+		if _, ok := to.Files[fn]; !ok {
+			ret.Deleted = append(ret.Deleted, fn)
+		}
+	}
+	for _, fn := range to.Filenames() {
+		old, ok := from.Files[fn]
+		if !ok {
+			ret.Created = append(ret.Created, fn)
+			continue
+		}
+		// the same record in both snapshots can't differ
+		if old.FileHistoryID == to.Files[fn].FileHistoryID {
+			continue
+		}
+		if changes := diffTags(from.Tags(fn), to.Tags(fn)); len(changes) > 0 {
+			ret.Modified = append(ret.Modified, FileDiff{Filename: fn, Changes: changes})
+		}
+	}
+	return ret
+}
+
+func diffTags(old, cur map[string]string) []TagChange {
+	tags := []string{}
+	for tag := range old {
+		tags = append(tags, tag)
+	}
+	for tag := range cur {
+		if _, ok := old[tag]; !ok {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	ret := []TagChange{}
+	for _, tag := range tags {
+		o, hadOld := old[tag]
+		n, hasNew := cur[tag]
+		if hadOld && hasNew && o == n {
+			continue
+		}
+		change := TagChange{Tag: tag}
+		if hadOld {
+			change.Old = &o
+		}
+		if hasNew {
+			change.New = &n
+		}
+		ret = append(ret, change)
+	}
+	return ret
+}
+
+// RunFetchTagHistory returns every value the tag of the file had, oldest first. The tag_history view
+// lists the tag of the full records and the tag changes of the modifications with the value before each.
+func (gg *GamtracGql) RunFetchTagHistory(filename string, tag string) ([]TagHistory, error) {
+	var respData struct {
+		TagHistory []TagHistory `json:"tag_history"`
+	}
+	query := `
+	query ($filename: String!, $tag: String!) {
+		tag_history(where: {filename: {_eq: $filename}, tag: {_eq: $tag}}, order_by: {file_history_id: asc}) {
+			file_history_id
+			filename
+			scan_id
+			action
+			action_tstamp
+			rule_id
+			tag
+			old_value
+			new_value
+			meta
+		}
+	}
+	`
+	vars := map[string]interface{}{
+		"filename": filename,
+		"tag":      tag,
+	}
+	if err := gg.Run(query, &respData, vars); err != nil {
+		return nil, err
+	}
+	return respData.TagHistory, nil
+}
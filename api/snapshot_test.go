@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func tagChange(id int64, tag string, value *string) *TagChanges {
+	return &TagChanges{FileHistoryID: &id, Tag: tag, NewValue: value}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func tagsOf(results []*RuleResults) []string {
+	ret := []string{}
+	for _, rr := range results {
+		ret = append(ret, *rr.Tag+"="+*rr.Value)
+	}
+	return ret
+}
+
+func TestApplyTagChanges(t *testing.T) {
+	cases := []struct {
+		name    string
+		changes []*TagChanges
+		want    []string
+	}{
+		{"no changes", []*TagChanges{}, []string{"Size=42", "проект=X1"}},
+		{"changed", []*TagChanges{tagChange(2, "Size", strPtr("43"))}, []string{"Size=43", "проект=X1"}},
+		{"added", []*TagChanges{tagChange(2, "образец", strPtr("S1"))}, []string{"Size=42", "проект=X1", "образец=S1"}},
+		{"removed", []*TagChanges{tagChange(2, "проект", nil)}, []string{"Size=42"}},
+		{"later changes win", []*TagChanges{tagChange(2, "Size", strPtr("43")), tagChange(3, "Size", strPtr("44"))}, []string{"Size=44", "проект=X1"}},
+		{"removed and added again", []*TagChanges{tagChange(2, "Size", nil), tagChange(3, "Size", strPtr("7"))}, []string{"Size=7", "проект=X1"}},
+	}
+	for _, c := range cases {
+		base := storedRecord(1, "Size", "42", "проект", "X1").RuleResults
+		got := tagsOf(ApplyTagChanges(base, c.changes))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: ApplyTagChanges = %v, want %v", c.name, got, c.want)
+		}
+		if *base[0].Value != "42" {
+			t.Errorf("%v: the base record was changed", c.name)
+		}
+	}
+
+	meta := tagChange(2, "ProcessedAt", strPtr(`"2019-08-12T14:30:00Z"`))
+	meta.Meta = true
+	got := ApplyTagChanges(nil, []*TagChanges{meta})
+	if len(got) != 1 || got[0].Meta == nil || !*got[0].Meta {
+		t.Errorf("a meta tag change lost its meta flag: %v", tagsOf(got))
+	}
+}
+
+func snapshotOf(scan int, files ...*FileHistory) *Snapshot {
+	s := &Snapshot{ScanID: scan, Files: map[string]*FileHistory{}}
+	for _, fh := range files {
+		s.Files[fh.Filename] = fh
+	}
+	return s
+}
+
+func record(id int64, fn string, tags ...string) *FileHistory {
+	fh := storedRecord(1, tags...)
+	fh.FileHistoryID, fh.Filename = id, fn
+	return fh
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	from := snapshotOf(1,
+		record(1, "/share/same.txt", "Size", "1"),
+		record(2, "/share/gone.txt", "Size", "2"),
+		record(3, "/share/changed.txt", "Size", "3", "проект", "X1", "метод", "ELISA"),
+		record(4, "/share/touched.txt", "Size", "4"),
+		record(5, "/share/old-name.txt", "Size", "5"),
+	)
+	processed := record(9, "/share/touched.txt", "Size", "4", "ProcessedAt", `"2019-08-12T14:30:00Z"`)
+	meta := true
+	processed.RuleResults[1].Meta = &meta
+	to := snapshotOf(2,
+		record(1, "/share/same.txt", "Size", "1"),
+		record(7, "/share/changed.txt", "Size", "30", "проект", "X1", "образец", "S1"),
+		processed,
+		record(8, "/share/new-name.txt", "Size", "5"),
+	)
+	got := DiffSnapshots(from, to)
+	if want := []string{"/share/new-name.txt"}; !reflect.DeepEqual(got.Created, want) {
+		t.Errorf("created %v, want %v", got.Created, want)
+	}
+	if want := []string{"/share/gone.txt", "/share/old-name.txt"}; !reflect.DeepEqual(got.Deleted, want) {
+		t.Errorf("deleted %v, want %v", got.Deleted, want)
+	}
+	// a new record with only meta tags changed is not a modification
+	if len(got.Modified) != 1 || got.Modified[0].Filename != "/share/changed.txt" {
+		t.Fatalf("modified %+v, want /share/changed.txt only", got.Modified)
+	}
+	changes := []string{}
+	for _, c := range got.Modified[0].Changes {
+		old, cur := "", ""
+		if c.Old != nil {
+			old = *c.Old
+		}
+		if c.New != nil {
+			cur = *c.New
+		}
+		changes = append(changes, c.Tag+":"+old+">"+cur)
+	}
+	if want := []string{"Size:3>30", "метод:ELISA>", "образец:>S1"}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("tag changes %v, want %v", changes, want)
+	}
+
+	if d := DiffSnapshots(from, from); len(d.Created)+len(d.Deleted)+len(d.Modified) != 0 {
+		t.Errorf("a snapshot differs from itself: %+v", d)
+	}
+}
+
+// pagedRecords serves the latest records of a sorted list of filenames a page at a time
+type pagedRecords struct {
+	filenames []string
+	pages     int
+}
+
+func (p *pagedRecords) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Variables struct {
+			Where struct {
+				And []struct {
+					Filename struct {
+						Gt string `json:"_gt"`
+					} `json:"filename"`
+				} `json:"_and"`
+			} `json:"where"`
+			Limit *int `json:"limit"`
+		} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.pages++
+	after := req.Variables.Where.And[1].Filename.Gt
+	records := []FileHistory{}
+	for i, fn := range p.filenames {
+		if fn > after && (req.Variables.Limit == nil || len(records) < *req.Variables.Limit) {
+			records = append(records, FileHistory{FileHistoryID: int64(i + 1), Filename: fn})
+		}
+	}
+	json.NewEncoder(w).Encode(JSON{"data": JSON{"file_history": records}})
+}
+
+func TestFetchLatestRecordsPages(t *testing.T) {
+	server := &pagedRecords{filenames: []string{"/share/a", "/share/b", "/share/c", "/share/d", "/share/e"}}
+	sort.Strings(server.filenames)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	gg := NewGamtracGql(ts.URL, 5000, false)
+	gg.BatchSize = 2
+	records, err := gg.runFetchLatestRecords(JSON{"scan_id": JSON{"_lte": 1}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, fh := range records {
+		got = append(got, fh.Filename)
+	}
+	if want := strings.Join(server.filenames, " "); strings.Join(got, " ") != want {
+		t.Errorf("fetched %v, want %v", got, want)
+	}
+	if server.pages != 3 {
+		t.Errorf("fetched in %v pages, want 3", server.pages)
+	}
+}
@@ -0,0 +1,38 @@
+package api
+
+// Store keeps what a scan reads and writes: the rules and endpoints, the scans and the file records.
+// GamtracGql stores them on the server, LocalStore in a local journal that is pushed to the server later.
+type Store interface {
+	RunFetchRules(ruleTypes []string) ([]Rules, error)
+	RunFetchEndpoints() ([]Endpoints, error)
+	RunFetchFiles() ([]FileHistory, error)
+	RunFetchFilesByName(filenames []string, dirs []string) ([]FileHistory, error)
+	RunFetchFilesIn(dir string) ([]FileHistory, error)
+	RunFetchKnownHashes(hashes []string) ([]string, error)
+	RunFetchLinkRefs(dirs []string, mentions []string, after string, limit int) ([]FileHistory, error)
+	RunFetchFilesByBaseName(names []string, parts []string) ([]string, error)
+	RunCreateScan(kind string) (*int, error)
+	RunFinishScan(scan int, status string) (*Scans, error)
+	RunFetchUnfinishedScans() ([]Scans, error)
+	RunCountScansSinceFull() (*int, error)
+	RunSaveScanCheckpoints(checkpoints []ScanCheckpoints) error
+	RunInsertFileHistory(files []FileHistory) ([]int64, error)
+	RunUpdateMeta(updates []MetaUpdate) error
+	RunInsertScanErrors(errs []ScanErrors) error
+	RunUpsertFileLinks(links []FileLinks) error
+	RunDeleteStaleFileLinks(scan int, sources []string, dirs []string) error
+	// WriteBatchSize is how many records a scan collects before writing them
+	WriteBatchSize() int
+}
+
+// The kinds of scans: a full scan reruns the handlers for every file, an incremental one only for
+// the files whose size or mtime changed and a watch scan holds the changes seen by the watcher
+const (
+	ScanFull        = "full"
+	ScanIncremental = "incremental"
+	ScanWatch       = "watch"
+)
+
+func (gg *GamtracGql) WriteBatchSize() int {
+	return gg.BatchSize
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"reflect"
+	"time"
+)
+
+// typedResult is implemented by the results that know the Go values of their props. Their numbers and
+// times are stored in the typed columns so that the database can compare them, e.g. to find files larger
+// than a size or modified after a date. The props of the other results are text and stay strings.
+type typedResult interface {
+	typedProps() map[string]interface{}
+}
+
+// storedValue is a prop replayed from a stored rule result, it keeps the typed columns it was stored with
+type storedValue struct {
+	rr *RuleResults
+}
+
+// typedValue returns the value to store as native json along with its number or time. Only numbers and
+// times get one, a string that looks like a number or a date is still a string.
+func typedValue(v interface{}) (value interface{}, num *float64, t *time.Time) {
+	if sv, ok := v.(storedValue); ok {
+		return sv.rr.JSONValue, sv.rr.NumValue, sv.rr.TimeValue
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, nil, nil
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil, nil, nil
+	}
+	if tv, ok := rv.Interface().(time.Time); ok {
+		return v, nil, &tv
+	}
+	var f float64
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f = float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f = float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		f = rv.Float()
+	default:
+		return v, nil, nil
+	}
+	return v, &f, nil
+}
+
+// SameValue compares two rule result values: numbers by value and times by instant, so that a time
+// written in another zone is not a change, everything else by its text
+func SameValue(a, b *RuleResults) bool {
+	switch {
+	case a.NumValue != nil && b.NumValue != nil:
+		return *a.NumValue == *b.NumValue
+	case a.TimeValue != nil && b.TimeValue != nil:
+		return a.TimeValue.Equal(*b.TimeValue)
+	}
+	return a.Value != nil && b.Value != nil && *a.Value == *b.Value
+}
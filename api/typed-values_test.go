@@ -0,0 +1,86 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func ruleResultsByTag(a AnnotResult) map[string]*RuleResults {
+	ret := map[string]*RuleResults{}
+	for _, rr := range ToRuleResult(a) {
+		ret[*rr.Tag] = rr
+	}
+	return ret
+}
+
+func TestToRuleResultTypes(t *testing.T) {
+	mod := time.Date(2019, 8, 12, 14, 30, 0, 0, time.FixedZone("", 3*3600))
+	props := ruleResultsByTag(&FilePropsResult{Size: 42, ModTime: mod, Hash: &HashDigest{Algorithm: "sha256", Value: []byte{1}}})
+	if rr := props["Size"]; rr.NumValue == nil || *rr.NumValue != 42 || rr.TimeValue != nil {
+		t.Errorf("Size: num %v, time %v, want the number 42", rr.NumValue, rr.TimeValue)
+	}
+	if rr := props["ModTime"]; rr.TimeValue == nil || !rr.TimeValue.Equal(mod) || rr.NumValue != nil {
+		t.Errorf("ModTime: num %v, time %v, want %v", rr.NumValue, rr.TimeValue, mod)
+	}
+	if rr := props["Hash"]; rr.NumValue != nil || rr.TimeValue != nil {
+		t.Errorf("Hash: num %v, time %v, want neither", rr.NumValue, rr.TimeValue)
+	}
+
+	// path tags are text even when they look like a number or a date
+	tags := ruleResultsByTag(&PathTagsResult{Values: map[string]string{"n": "007", "дата": "2019-08-12T14:30:00+03:00"}})
+	for tag, rr := range tags {
+		if rr.NumValue != nil || rr.TimeValue != nil || rr.JSONValue != *rr.Value {
+			t.Errorf("%v: json %v, num %v, time %v, want the text %q", tag, rr.JSONValue, rr.NumValue, rr.TimeValue, *rr.Value)
+		}
+	}
+
+	exec := ruleResultsByTag(&ExecResult{Fields: map[string]interface{}{"wells": float64(96), "plate": "12"}})
+	if rr := exec["wells"]; rr.NumValue == nil || *rr.NumValue != 96 || *rr.Value != "96" {
+		t.Errorf("wells: value %v, num %v, want the number 96", *rr.Value, rr.NumValue)
+	}
+	if rr := exec["plate"]; rr.NumValue != nil || *rr.Value != "12" {
+		t.Errorf("plate: value %v, num %v, want the text 12", *rr.Value, rr.NumValue)
+	}
+
+	// stored results keep the typed columns they were stored with
+	stored := storedRecord(1, "Size", "42")
+	stored.RuleResults[0].NumValue = props["Size"].NumValue
+	replayed := ruleResultsByTag(StoredResults("/a", stored)[0])
+	if rr := replayed["Size"]; rr.NumValue == nil || *rr.NumValue != 42 {
+		t.Errorf("stored Size: num %v, want 42", rr.NumValue)
+	}
+}
+
+func TestSameValue(t *testing.T) {
+	text := func(s string) *RuleResults { return &RuleResults{Value: &s} }
+	num := func(s string, f float64) *RuleResults { rr := text(s); rr.NumValue = &f; return rr }
+	at := func(s string) *RuleResults {
+		rr := text(s)
+		tv, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr.TimeValue = &tv
+		return rr
+	}
+	cases := []struct {
+		name string
+		a, b *RuleResults
+		want bool
+	}{
+		{"same text", text("X1"), text("X1"), true},
+		{"different text", text("X1"), text("x1"), false},
+		{"numbers written differently", num("42", 42), num("42.0", 42), true},
+		{"different numbers", num("42", 42), num("43", 43), false},
+		{"text that looks like a number", text("007"), text("7"), false},
+		{"time in another zone", at("2019-08-12T14:30:00+03:00"), at("2019-08-12T11:30:00Z"), true},
+		{"different times", at("2019-08-12T14:30:00+03:00"), at("2019-08-12T14:30:00Z"), false},
+		{"text that looks like a time", text("2019-08-12T14:30:00+03:00"), text("2019-08-12T11:30:00Z"), false},
+		{"objects are compared as text", text(`{"a":1,"b":2}`), text(`{"b":2,"a":1}`), false},
+	}
+	for _, c := range cases {
+		if got := SameValue(c.a, c.b); got != c.want {
+			t.Errorf("%v: SameValue = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gamtrac/api"
+	"gamtrac/rules"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// bundleDef is the rule text of a bundle rule, e.g.
+// {"folder": "R:/DAR/<проект>/", "members": ["<дата>_<проект>_raw.xlsx", "<дата>_<проект>_protocol.docx"]}
+// the member templates are relative to the folder, members are the files and folders directly in it
+type bundleDef struct {
+	Folder  string   `json:"folder"`
+	Members []string `json:"members"`
+}
+
+type bundleRule struct {
+	rule    api.Rules
+	folder  *rules.RuleMatcher
+	members []*rules.RuleMatcher
+	key     []string // placeholders shared by all members, they tell the instances apart
+}
+
+// BundleHandler checks that the folders matching a bundle rule contain all of its members. A folder is
+// checked once the scan has collected its contents, so a bundle is checked again by every scan and
+// whenever the watcher sees a change in its folder.
+type BundleHandler struct {
+	RuleResultGenerator
+	rules []*bundleRule
+}
+
+func newBundleRule(r api.Rules) (*bundleRule, error) {
+	def := bundleDef{}
+	if err := json.Unmarshal([]byte(r.Rule), &def); err != nil {
+		return nil, fmt.Errorf("invalid bundle definition: %v", err)
+	}
+	if def.Folder == "" || len(def.Members) == 0 {
+		return nil, fmt.Errorf("a bundle needs a folder and at least one member")
+	}
+	if !strings.HasSuffix(def.Folder, "/") {
+		def.Folder += "/"
+	}
+	folder, err := rules.NewMatcher(def.Folder)
+	if err != nil {
+		return nil, err
+	}
+	br := &bundleRule{rule: r, folder: folder}
+	shared := map[string]int{}
+	for _, m := range def.Members {
+		member, err := rules.NewMatcher(m)
+		if err != nil {
+			return nil, err
+		}
+		br.members = append(br.members, member)
+		seen := map[string]bool{}
+		for _, name := range member.Names() {
+			if !seen[name] {
+				seen[name] = true
+				shared[name]++
+			}
+		}
+	}
+	for name, n := range shared {
+		if n == len(br.members) {
+			br.key = append(br.key, name)
+		}
+	}
+	sort.Strings(br.key)
+	return br, nil
+}
+
+func (h *BundleHandler) Init(ruleDefs []api.Rules) error {
+	h.rules = []*bundleRule{}
+	for _, r := range ruleDefs {
+		br, err := newBundleRule(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot parse bundle rule %v `%v`: %v\n", r.RuleID, r.Rule, err)
+			continue
+		}
+		h.rules = append(h.rules, br)
+	}
+	return nil
+}
+
+// Generate leaves the bundles to Check, they are only known once the contents of their folder are
+func (h *BundleHandler) Generate(input AnnotItem) []api.AnnotResult {
+	return []api.AnnotResult{}
+}
+
+// bundleHandlerOf finds the bundle handler among the handlers of a scan, nil when there are no bundle rules
+func bundleHandlerOf(handlers []RuleResultGenerator) *BundleHandler {
+	for _, handler := range handlers {
+		if h, ok := handler.(*BundleHandler); ok && len(h.rules) > 0 {
+			return h
+		}
+	}
+	return nil
+}
+
+// IsFolder is true when the folder matches the folder template of a bundle, regardless of the owner
+func (h *BundleHandler) IsFolder(path string) bool {
+	for _, br := range h.rules {
+		if m := br.folder.MatchRule(path); m.Full && m.Err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies is true when a bundle rule applies to the folder
+func (h *BundleHandler) Applies(folder MountedPath) bool {
+	for _, br := range h.rules {
+		if m := br.folder.MatchRule(folder.Destination); m.Full && m.Err == nil && ruleApplies(br.rule, folder) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check replaces the bundle results of a folder, e.g. those stored by an earlier scan, by the results
+// of the bundles of its contents
+func (h *BundleHandler) Check(folder MountedPath, results []api.AnnotResult, contents []string) []api.AnnotResult {
+	path := folder.Destination
+	ret := []api.AnnotResult{}
+	for _, r := range results {
+		if _, ok := r.(*api.BundleResult); ok || h.isBundleRule(r) {
+			continue
+		}
+		ret = append(ret, r)
+	}
+	for _, br := range h.rules {
+		if !ruleApplies(br.rule, folder) {
+			continue
+		}
+		m := br.folder.MatchRule(path)
+		if !m.Full || m.Err != nil {
+			continue
+		}
+		ret = append(ret, br.check(path, m.AsMap(), contents))
+	}
+	return ret
+}
+
+func (h *BundleHandler) isBundleRule(r api.AnnotResult) bool {
+	stored, ok := r.(*api.StoredResult)
+	if !ok {
+		return false
+	}
+	for _, br := range h.rules {
+		if br.rule.RuleID == stored.RuleID {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPath returns the folder of a destination path and the name of the entry in it,
+// the names of folders keep their trailing slash
+func splitPath(path string) (string, string) {
+	i := strings.LastIndex(strings.TrimSuffix(path, "/"), "/")
+	return path[:i+1], path[i+1:]
+}
+
+// bundleFolders holds back the folders of the bundles until the scan has collected everything in them,
+// their contents are the entries the walk found there rather than a listing of their own
+type bundleFolders struct {
+	h        *BundleHandler
+	held     map[string]FileResults
+	contents map[string][]string
+}
+
+func newBundleFolders(handlers []RuleResultGenerator) *bundleFolders {
+	return &bundleFolders{h: bundleHandlerOf(handlers), held: map[string]FileResults{}, contents: map[string][]string{}}
+}
+
+// Hold notes the file in the contents of its folder and holds it back if it is the folder of a bundle itself
+func (bf *bundleFolders) Hold(f FileResults) bool {
+	if bf.h == nil {
+		return false
+	}
+	if folder, name := splitPath(f.Path); bf.h.IsFolder(folder) {
+		bf.contents[folder] = append(bf.contents[folder], name)
+	}
+	// the contents of a folder that can't be read are unknown
+	if !strings.HasSuffix(f.Path, "/") || api.OnlyErrors(f.Results) || !bf.h.Applies(f.mounted) {
+		return false
+	}
+	bf.held[f.Path] = f
+	return true
+}
+
+// Checked returns the held folders with the results of their bundles
+func (bf *bundleFolders) Checked() []FileResults {
+	paths := []string{}
+	for path := range bf.held {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	ret := []FileResults{}
+	for _, path := range paths {
+		f := bf.held[path]
+		f.Results = bf.h.Check(f.mounted, f.Results, bf.contents[path])
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+// folderContents lists the files and folders directly in the folder, folders with a trailing slash.
+// The ignored ones are left out like they are by the scans. The watcher has no walk to collect them from.
+func folderContents(input AnnotItem) ([]string, error) {
+	entries, err := ioutil.ReadDir(input.path.MountedAt)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, entry := range entries {
+		if input.ignore != nil {
+			mp, err := translatePath(input.path, filepath.Join(input.path.MountedAt, entry.Name()), entry.IsDir())
+			if err == nil && input.ignore.Ignored(withOwner(mp, entry)) {
+				continue
+			}
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		ret = append(ret, name)
+	}
+	return ret, nil
+}
+
+// agrees is true when the placeholders the member shares with the folder have the same values
+func agrees(values, folderValues map[string]string) bool {
+	for name, v := range values {
+		if fv, ok := folderValues[name]; ok && fv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// check groups the folder contents into instances of the bundle and finds their missing members
+func (br *bundleRule) check(folder string, folderValues map[string]string, contents []string) *api.BundleResult {
+	type instance struct {
+		values  map[string]string
+		present []bool
+	}
+	instances := map[string]*instance{}
+	keys := []string{}
+	extra := []string{}
+	for _, rel := range contents {
+		member := false
+		for i, m := range br.members {
+			match := m.MatchRule(rel)
+			if !match.Full || match.Err != nil {
+				continue
+			}
+			values := match.AsMap()
+			// a member of another project or date doesn't belong in this folder
+			if !agrees(values, folderValues) {
+				continue
+			}
+			member = true
+			parts := []string{}
+			for _, name := range br.key {
+				parts = append(parts, values[name])
+			}
+			key := strings.Join(parts, "\x00")
+			inst, ok := instances[key]
+			if !ok {
+				inst = &instance{values: map[string]string{}, present: make([]bool, len(br.members))}
+				for k, v := range folderValues {
+					inst.values[k] = v
+				}
+				for _, name := range br.key {
+					inst.values[name] = values[name]
+				}
+				instances[key] = inst
+				keys = append(keys, key)
+			}
+			inst.present[i] = true
+		}
+		// folders only hold members, they are not members themselves
+		if !member && !strings.HasSuffix(rel, "/") {
+			extra = append(extra, rel)
+		}
+	}
+	// a bundle folder without any members still misses all of them
+	if len(instances) == 0 {
+		instances[""] = &instance{values: folderValues, present: make([]bool, len(br.members))}
+		keys = append(keys, "")
+	}
+	sort.Strings(keys)
+	missing := []string{}
+	for _, key := range keys {
+		inst := instances[key]
+		for i, present := range inst.present {
+			if !present {
+				missing = append(missing, br.members[i].Render(inst.values))
+			}
+		}
+	}
+	return &api.BundleResult{
+		RuleID:          br.rule.RuleID,
+		Path:            folder,
+		Priority:        br.rule.Priority,
+		BundleRule:      br.rule.Rule,
+		BundleComplete:  len(missing) == 0,
+		BundleInstances: len(keys),
+		BundleMissing:   missing,
+		BundleExtra:     extra,
+	}
+}
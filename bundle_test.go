@@ -0,0 +1,94 @@
+package main
+
+import (
+	"gamtrac/api"
+	"reflect"
+	"testing"
+)
+
+func newTestBundles(t *testing.T) *BundleHandler {
+	h := &BundleHandler{}
+	err := h.Init([]api.Rules{{RuleID: 7, RuleType: "bundle",
+		Rule: `{"folder": "/share/<проект>/", "members": ["<дата>_<проект>_raw.xlsx", "<дата>_<проект>_protocol.docx"]}`}})
+	if err != nil || len(h.rules) != 1 {
+		t.Fatalf("the bundle rule wasn't parsed: %v", err)
+	}
+	return h
+}
+
+func bundleResultOf(t *testing.T, results []api.AnnotResult) *api.BundleResult {
+	var ret *api.BundleResult
+	for _, r := range results {
+		switch res := r.(type) {
+		case *api.BundleResult:
+			if ret != nil {
+				t.Fatalf("more than one bundle result in %v", results)
+			}
+			ret = res
+		case *api.StoredResult:
+			if res.RuleID == 7 {
+				t.Errorf("the stored bundle result was kept")
+			}
+		}
+	}
+	if ret == nil {
+		t.Fatalf("no bundle result in %v", results)
+	}
+	return ret
+}
+
+func TestBundleCheck(t *testing.T) {
+	h := newTestBundles(t)
+	cases := []struct {
+		name      string
+		contents  []string
+		complete  bool
+		instances int
+		missing   []string
+		extra     []string
+	}{
+		{"complete", []string{"2019-08-12_X1_raw.xlsx", "2019-08-12_X1_protocol.docx", "old/"},
+			true, 1, []string{}, []string{}},
+		{"missing member", []string{"2019-08-12_X1_raw.xlsx", "2019-08-13_X1_raw.xlsx", "2019-08-13_X1_protocol.docx"},
+			false, 2, []string{"2019-08-12_X1_protocol.docx"}, []string{}},
+		{"extra member", []string{"2019-08-12_X1_raw.xlsx", "2019-08-12_X1_protocol.docx", "notes.txt"},
+			true, 1, []string{}, []string{"notes.txt"}},
+		{"member of another project", []string{"2019-08-12_X1_raw.xlsx", "2019-08-12_X1_protocol.docx", "2019-08-12_X2_raw.xlsx"},
+			true, 1, []string{}, []string{"2019-08-12_X2_raw.xlsx"}},
+	}
+	for _, c := range cases {
+		stored := &api.StoredResult{RuleID: 7, Values: map[string]string{"BundleComplete": "false"}}
+		props := &api.FilePropsResult{RuleID: -1, Path: "/share/X1/", IsDir: true}
+		results := h.Check(MountedPath{Destination: "/share/X1/"}, []api.AnnotResult{stored, props}, c.contents)
+		if len(results) != 2 || results[0] != props {
+			t.Errorf("%v: the other results were not kept: %v", c.name, results)
+		}
+		got := bundleResultOf(t, results)
+		if got.BundleComplete != c.complete || got.BundleInstances != c.instances ||
+			!reflect.DeepEqual(got.BundleMissing, c.missing) || !reflect.DeepEqual(got.BundleExtra, c.extra) {
+			t.Errorf("%v: complete %v, %v instances, missing %v, extra %v, want %v, %v, %v, %v", c.name,
+				got.BundleComplete, got.BundleInstances, got.BundleMissing, got.BundleExtra, c.complete, c.instances, c.missing, c.extra)
+		}
+	}
+}
+
+func TestBundleFolders(t *testing.T) {
+	bf := newBundleFolders([]RuleResultGenerator{&FilePropsHandler{}, newTestBundles(t)})
+	file := func(path string) FileResults {
+		return FileResults{Path: path, Results: []api.AnnotResult{&api.FilePropsResult{RuleID: -1, Path: path}}, mounted: MountedPath{Destination: path}}
+	}
+	// workers finish out of order, the contents collected before the folder count as well
+	for _, path := range []string{"/share/X1/2019-08-12_X1_raw.xlsx", "/share/X1/", "/share/X1/old/", "/share/X1/old/a.txt", "/share/other.txt"} {
+		if held, want := bf.Hold(file(path)), path == "/share/X1/"; held != want {
+			t.Errorf("Hold(%v) = %v, want %v", path, held, want)
+		}
+	}
+	checked := bf.Checked()
+	if len(checked) != 1 || checked[0].Path != "/share/X1/" {
+		t.Fatalf("checked folders %v, want /share/X1/", checked)
+	}
+	got := bundleResultOf(t, checked[0].Results)
+	if want := []string{"2019-08-12_X1_protocol.docx"}; !reflect.DeepEqual(got.BundleMissing, want) || len(got.BundleExtra) != 0 {
+		t.Errorf("missing %v, extra %v, want missing %v", got.BundleMissing, got.BundleExtra, want)
+	}
+}
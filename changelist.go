@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gamtrac/api"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fullHash returns the stored form of the digest in props, it is empty when the hash is unknown or only
+// a quick hash, which leaves the middle of the file out and can't tell a rename from a new file
+func fullHash(props map[string]string) string {
+	digest := api.ParseHash(props["Hash"])
+	if digest == nil || digest.Quick() || props["IsDir"] == "true" {
+		return ""
+	}
+	js, err := json.Marshal(digest)
+	if err != nil {
+		return ""
+	}
+	return string(js)
+}
+
+// contentKey identifies the contents of a file by its full hash and size, it is empty when either is unknown
+func contentKey(props map[string]string) string {
+	hash, size := fullHash(props), props["Size"]
+	if hash == "" || size == "" {
+		return ""
+	}
+	return hash + "|" + size
+}
+
+func oldProps(fh *api.FileHistory) map[string]string {
+	props := map[string]string{}
+	for _, rr := range fh.RuleResults {
+		if rr.Tag != nil && rr.Value != nil {
+			props[*rr.Tag] = *rr.Value
+		}
+	}
+	return props
+}
+
+// PairRenames matches created files to deleted ones with the same contents, returns a [created]deleted mapping.
+// Files that keep their basename are paired first, the rest in filename order.
+func PairRenames(deleted, created []string, oldKey, curKey func(string) string) map[string]string {
+	candidates := map[string][]string{}
+	sort.Strings(deleted)
+	for _, fn := range deleted {
+		if key := oldKey(fn); key != "" {
+			candidates[key] = append(candidates[key], fn)
+		}
+	}
+	sort.Strings(created)
+	ret := map[string]string{}
+	taken := map[string]bool{}
+	for _, sameBase := range []bool{true, false} {
+		for _, fn := range created {
+			if _, ok := ret[fn]; ok {
+				continue
+			}
+			key := curKey(fn)
+			if key == "" {
+				continue
+			}
+			for _, d := range candidates[key] {
+				if taken[d] || (sameBase && path.Base(d) != path.Base(fn)) {
+					continue
+				}
+				ret[fn] = d
+				taken[d] = true
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// isBelowFailed checks whether the file or one of its parent directories could not be read
+func isBelowFailed(fn string, failed []string) bool {
+	for _, f := range failed {
+		if fn == f || (strings.HasSuffix(f, "/") && strings.HasPrefix(fn, f)) {
+			return true
+		}
+	}
+	return false
+}
+
+// createdFile is a file without an old record whose contents are known, it may have been moved there
+type createdFile struct {
+	results []api.AnnotResult
+	hash    string
+}
+
+// goneFile is what is left of the old record of a file that no longer exists
+type goneFile struct {
+	id  int64
+	key string
+}
+
+// ChangelistBuilder compares files to their old records one at a time so that the records can be
+// written while the scan is still running. Renames are only known once all files were seen, until then
+// the builder keeps the created files that have the contents of a stored file and the files that are gone.
+type ChangelistBuilder struct {
+	scan int
+	// knownHashes tells which of the hashes the stored files have
+	knownHashes func(hashes []string) (map[string]bool, error)
+	undecided   map[string]createdFile // created files whose hash was not looked up yet
+	held        map[string][]api.AnnotResult
+	meta        []api.MetaUpdate
+	// the walk notes the gone files while the results of the files are added
+	goneMu sync.Mutex
+	gone   map[string]goneFile
+}
+
+func NewChangelistBuilder(scan int, knownHashes func(hashes []string) (map[string]bool, error)) *ChangelistBuilder {
+	return &ChangelistBuilder{
+		scan:        scan,
+		knownHashes: knownHashes,
+		undecided:   map[string]createdFile{},
+		held:        map[string][]api.AnnotResult{},
+		gone:        map[string]goneFile{},
+		meta:        []api.MetaUpdate{},
+	}
+}
+
+func curContentKey(results []api.AnnotResult) (key string, hash string) {
+	props, err := CombineResultChangesets(results)
+	if err != nil {
+		return "", ""
+	}
+	if key = contentKey(props); key == "" {
+		return "", ""
+	}
+	return key, fullHash(props)
+}
+
+// isModified compares the significant props of the current results to the old record
+func isModified(old *api.FileHistory, results []api.AnnotResult) (bool, error) {
+	curResults, err := CombineResultChangesets(results)
+	if err != nil {
+		return false, err
+	}
+	leaveSignificant := FilterSignificantProps(results)
+	// TODO: respect RuleID and Priority when overwriting values
+	oldResults := map[string]string{}
+	for _, rr := range old.RuleResults {
+		oldResults[*rr.Tag] = *rr.Value
+	}
+	changedProps, to, err := GetChangedProps(oldResults, curResults)
+	if err != nil {
+		println(err)
+		print(to)
+		return false, nil // don't mark errors as modified as that will flood the database with bogus modifications (TODO: allow for error type)
+	}
+	// numbers and times written differently but meaning the same, like a time in another zone, are not a change
+	changedProps = leaveDifferent(changedProps, old.RuleResults, CombineResults(results))
+	signProps := leaveSignificant(changedProps)
+	return len(changedProps) > 0 && len(signProps) > 0, nil
+}
+
+func isMeta(rr *api.RuleResults) bool {
+	return rr.Meta != nil && *rr.Meta
+}
+
+// splitMeta separates the meta rule results from the significant ones
+func splitMeta(results []*api.RuleResults) (sign []*api.RuleResults, meta []*api.RuleResults) {
+	sign, meta = []*api.RuleResults{}, []*api.RuleResults{}
+	for _, rr := range results {
+		if rr == nil || rr.Tag == nil || rr.Value == nil {
+			continue
+		}
+		if isMeta(rr) {
+			meta = append(meta, rr)
+		} else {
+			sign = append(sign, rr)
+		}
+	}
+	return sign, meta
+}
+
+// leaveDifferent drops the props whose old and current values only differ in how they are written
+func leaveDifferent(props []string, old, cur []*api.RuleResults) []string {
+	byTag := func(results []*api.RuleResults) map[string]*api.RuleResults {
+		ret := map[string]*api.RuleResults{}
+		for _, rr := range results {
+			if rr != nil && rr.Tag != nil {
+				ret[*rr.Tag] = rr
+			}
+		}
+		return ret
+	}
+	oldByTag, curByTag := byTag(old), byTag(cur)
+	ret := []string{}
+	for _, p := range props {
+		o, hadOld := oldByTag[p]
+		c, hasCur := curByTag[p]
+		if hadOld && hasCur && api.SameValue(o, c) {
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+// tagChanges lists the tags that were added, removed or changed, along with the rule of the new value.
+// Meta tags are not part of the history, they are stored with the record and updated in place.
+func tagChanges(old []*api.RuleResults, cur []*api.RuleResults) []*api.TagChanges {
+	oldSign, _ := splitMeta(old)
+	curSign, _ := splitMeta(cur)
+	oldByTag := map[string]*api.RuleResults{}
+	for _, rr := range oldSign {
+		oldByTag[*rr.Tag] = rr
+	}
+	ret := []*api.TagChanges{}
+	for _, rr := range curSign {
+		prev, existed := oldByTag[*rr.Tag]
+		delete(oldByTag, *rr.Tag)
+		if existed && api.SameValue(prev, rr) {
+			continue
+		}
+		change := &api.TagChanges{
+			RuleID:    rr.RuleID,
+			Tag:       *rr.Tag,
+			NewValue:  rr.Value,
+			JSONValue: rr.JSONValue,
+			NumValue:  rr.NumValue,
+			TimeValue: rr.TimeValue,
+		}
+		if existed {
+			change.OldValue = prev.Value
+		}
+		ret = append(ret, change)
+	}
+	for tag, prev := range oldByTag {
+		ret = append(ret, &api.TagChanges{RuleID: prev.RuleID, Tag: tag, OldValue: prev.Value})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Tag < ret[j].Tag })
+	return ret
+}
+
+// metaUpdate compares the meta tags of an unchanged file to those of its record, nil when they are the same
+func metaUpdate(old *api.FileHistory, cur []*api.RuleResults) *api.MetaUpdate {
+	_, oldMeta := splitMeta(old.RuleResults)
+	_, curMeta := splitMeta(cur)
+	oldByTag := map[string]*api.RuleResults{}
+	for _, rr := range oldMeta {
+		oldByTag[*rr.Tag] = rr
+	}
+	u := &api.MetaUpdate{FileHistoryID: old.FileHistoryID, Set: []*api.RuleResults{}, Add: []*api.RuleResults{}, Remove: []string{}}
+	for _, rr := range curMeta {
+		prev, existed := oldByTag[*rr.Tag]
+		delete(oldByTag, *rr.Tag)
+		switch {
+		case !existed:
+			u.Add = append(u.Add, rr)
+		case !api.SameValue(prev, rr):
+			u.Set = append(u.Set, rr)
+		}
+	}
+	for tag := range oldByTag {
+		u.Remove = append(u.Remove, tag)
+	}
+	if len(u.Set) == 0 && len(u.Add) == 0 && len(u.Remove) == 0 {
+		return nil
+	}
+	sort.Strings(u.Remove)
+	return u
+}
+
+// Add returns the record for a created or modified file, or nil when the file is unchanged
+// or when it can only be decided in Finish
+func (b *ChangelistBuilder) Add(fn string, old *api.FileHistory, results []api.AnnotResult) (*api.FileHistory, error) {
+	// the state of files that failed completely is unknown, keep their old records as they are
+	if api.OnlyErrors(results) {
+		return nil, nil
+	}
+	item := &api.FileHistory{
+		Filename:    fn,
+		ScanID:      b.scan,
+		RuleResults: nil,
+	}
+	if old == nil {
+		// might have been moved there, Settle finds out whether a stored file has the same contents
+		if key, hash := curContentKey(results); key != "" {
+			b.undecided[fn] = createdFile{results: results, hash: hash}
+			return nil, nil
+		}
+		item.Action = "C"
+		fmt.Printf("Created: %v\n", fn)
+		item.RuleResults = CombineResults(results)
+		return item, nil
+	}
+	modified, err := isModified(old, results)
+	if err != nil {
+		return nil, err
+	}
+	cur := CombineResults(results)
+	if !modified {
+		// only the meta tags may have changed, they are updated without a new version
+		if u := metaUpdate(old, cur); u != nil {
+			b.meta = append(b.meta, *u)
+		}
+		return nil, nil
+	}
+	item.Action = "M"
+	fmt.Printf("Modified: %v\n", fn)
+	item.PrevID = int(old.FileHistoryID)
+	// only the tags that changed are stored, the others are still those of the old record,
+	// the meta tags are stored with the new record so that they can be updated in place
+	item.Delta = true
+	item.TagChanges = tagChanges(old.RuleResults, cur)
+	_, item.RuleResults = splitMeta(cur)
+	return item, nil
+}
+
+// TakeMetaUpdates returns the meta updates of the unchanged files added since the last call
+func (b *ChangelistBuilder) TakeMetaUpdates() []api.MetaUpdate {
+	ret := b.meta
+	b.meta = []api.MetaUpdate{}
+	return ret
+}
+
+// Undecided is the number of created files that wait for Settle
+func (b *ChangelistBuilder) Undecided() int {
+	return len(b.undecided)
+}
+
+// Settle looks up the hashes of the created files added since the last call. The files with the
+// contents of a stored file are held back until Finish, the others are returned as created.
+func (b *ChangelistBuilder) Settle() ([]api.FileHistory, error) {
+	ret := []api.FileHistory{}
+	if len(b.undecided) == 0 {
+		return ret, nil
+	}
+	filenames, hashes := []string{}, []string{}
+	for fn, f := range b.undecided {
+		filenames = append(filenames, fn)
+		hashes = append(hashes, f.hash)
+	}
+	sort.Strings(filenames)
+	known, err := b.knownHashes(hashes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot look up the hashes of created files: %v", err)
+	}
+	for _, fn := range filenames {
+		f := b.undecided[fn]
+		if known[f.hash] {
+			b.held[fn] = f.results
+			continue
+		}
+		fmt.Printf("Created: %v\n", fn)
+		ret = append(ret, api.FileHistory{Filename: fn, ScanID: b.scan, Action: "C", RuleResults: CombineResults(f.results)})
+	}
+	b.undecided = map[string]createdFile{}
+	return ret, nil
+}
+
+// Gone notes that the file of an old record no longer exists, it was either deleted or renamed
+func (b *ChangelistBuilder) Gone(old *api.FileHistory) {
+	b.goneMu.Lock()
+	defer b.goneMu.Unlock()
+	b.gone[old.Filename] = goneFile{id: old.FileHistoryID, key: contentKey(oldProps(old))}
+}
+
+// GoneFiles returns the files noted as gone so far
+func (b *ChangelistBuilder) GoneFiles() []string {
+	b.goneMu.Lock()
+	defer b.goneMu.Unlock()
+	ret := []string{}
+	for fn := range b.gone {
+		ret = append(ret, fn)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Finish returns the records of the deleted and renamed files and of the created ones that were not written yet
+func (b *ChangelistBuilder) Finish() ([]api.FileHistory, error) {
+	ret, err := b.Settle()
+	if err != nil {
+		return nil, err
+	}
+	deleted := b.GoneFiles()
+	created := []string{}
+	for fn := range b.held {
+		created = append(created, fn)
+	}
+	sort.Strings(created)
+
+	// a created file with the same contents as a deleted one was moved, keep the lineage via prev_id
+	renamed := PairRenames(deleted, created, func(fn string) string {
+		return b.gone[fn].key
+	}, func(fn string) string {
+		key, _ := curContentKey(b.held[fn])
+		return key
+	})
+	renamedFrom := map[string]bool{}
+	for _, from := range renamed {
+		renamedFrom[from] = true
+	}
+
+	for _, fn := range created {
+		item := api.FileHistory{
+			Filename:    fn,
+			ScanID:      b.scan,
+			RuleResults: CombineResults(b.held[fn]),
+		}
+		if from, isRenamed := renamed[fn]; isRenamed {
+			item.Action = "R"
+			fmt.Printf("Renamed: %v -> %v\n", from, fn)
+			item.PrevID = int(b.gone[from].id)
+		} else {
+			item.Action = "C"
+			fmt.Printf("Created: %v\n", fn)
+		}
+		ret = append(ret, item)
+	}
+	for _, fn := range deleted {
+		if renamedFrom[fn] {
+			continue
+		}
+		fmt.Printf("Deleted: %v\n", fn)
+		ret = append(ret, api.FileHistory{
+			Filename: fn,
+			ScanID:   b.scan,
+			Action:   "D",
+			PrevID:   int(b.gone[fn].id), // TODO: remove PrevID altogether
+		})
+	}
+	b.held = map[string][]api.AnnotResult{}
+	return ret, nil
+}
+
+// GenerateChangelist returns the records to write for the files and the meta updates of the unchanged ones.
+// The old files that are not among the current ones are gone, unless a folder above them could not be read.
+func GenerateChangelist(scan int, oldFiles []api.FileHistory, curFiles map[string][]api.AnnotResult) ([]api.FileHistory, []api.MetaUpdate, error) {
+	oldmap := map[string]*api.FileHistory{}
+	oldHashes := map[string]bool{}
+	for i, r := range oldFiles {
+		if _, exists := oldmap[r.Filename]; exists {
+			println("Duplicate filename found in old files, using first record: ", r.Filename)
+			continue
+		}
+		oldmap[r.Filename] = &oldFiles[i]
+		if props := oldProps(&oldFiles[i]); contentKey(props) != "" {
+			oldHashes[fullHash(props)] = true
+		}
+	}
+	b := NewChangelistBuilder(scan, func(hashes []string) (map[string]bool, error) {
+		return oldHashes, nil
+	})
+	filenames, failed := []string{}, []string{}
+	for fn := range curFiles {
+		filenames = append(filenames, fn)
+	}
+	sort.Strings(filenames)
+	ret := []api.FileHistory{}
+	for _, fn := range filenames {
+		if api.OnlyErrors(curFiles[fn]) {
+			failed = append(failed, fn)
+		}
+		item, err := b.Add(fn, oldmap[fn], curFiles[fn])
+		if err != nil {
+			return nil, nil, err
+		}
+		if item != nil {
+			ret = append(ret, *item)
+		}
+	}
+	for fn, old := range oldmap {
+		if _, ok := curFiles[fn]; !ok && !isBelowFailed(fn, failed) {
+			b.Gone(old)
+		}
+	}
+	rest, err := b.Finish()
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(ret, rest...), b.TakeMetaUpdates(), nil
+}
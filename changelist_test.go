@@ -0,0 +1,204 @@
+package main
+
+import (
+	"gamtrac/api"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestContentKey(t *testing.T) {
+	cases := []struct {
+		name  string
+		props map[string]string
+		want  string
+	}{
+		{"full hash", map[string]string{"Hash": `"sha256:00ff"`, "Size": "2", "IsDir": "false"}, `"sha256:00ff"|2`},
+		{"object stored by earlier versions", map[string]string{"Hash": `{"Algorithm":"sha256","Value":"AP8="}`, "Size": "2"}, `"sha256:00ff"|2`},
+		{"quick hash", map[string]string{"Hash": `"quick4m-xxhash:00ff"`, "Size": "2"}, ""},
+		{"quick hash stored by earlier versions", map[string]string{"Hash": `{"Algorithm":"quick4m-xxhash","Value":"AP8="}`, "Size": "2"}, ""},
+		{"not hashed", map[string]string{"Hash": "null", "Size": "2"}, ""},
+		{"no size", map[string]string{"Hash": `"sha256:00ff"`}, ""},
+		{"folder", map[string]string{"Hash": `"sha256:00ff"`, "Size": "2", "IsDir": "true"}, ""},
+	}
+	for _, c := range cases {
+		if got := contentKey(c.props); got != c.want {
+			t.Errorf("%v: contentKey = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+// tagged returns the rule results of the tag and value pairs, meta makes them meta tags
+func tagged(meta bool, tags ...string) []*api.RuleResults {
+	ret := []*api.RuleResults{}
+	for i := 0; i+1 < len(tags); i += 2 {
+		tag, value, m := tags[i], tags[i+1], meta
+		ret = append(ret, &api.RuleResults{RuleID: intPtr(1), Tag: &tag, Value: &value, Meta: &m})
+	}
+	return ret
+}
+
+func valueOf(s *string) string {
+	if s == nil {
+		return "-"
+	}
+	return *s
+}
+
+func sortedTags(results []*api.RuleResults) []string {
+	ret := []string{}
+	for _, rr := range results {
+		ret = append(ret, *rr.Tag+"="+*rr.Value)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// sameTags tells whether the results have the same tags with the same values, however they are written
+func sameTags(a, b []*api.RuleResults) bool {
+	byTag := map[string]*api.RuleResults{}
+	for _, rr := range a {
+		byTag[*rr.Tag] = rr
+	}
+	if len(byTag) != len(b) {
+		return false
+	}
+	for _, rr := range b {
+		if prev, ok := byTag[*rr.Tag]; !ok || !api.SameValue(prev, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTagChanges(t *testing.T) {
+	num := func(results []*api.RuleResults, n float64) []*api.RuleResults {
+		results[0].NumValue = &n
+		return results
+	}
+	cases := []struct {
+		name string
+		old  []*api.RuleResults
+		cur  []*api.RuleResults
+		want []string
+	}{
+		{"unchanged", tagged(false, "Size", "42", "проект", "X1"), tagged(false, "проект", "X1", "Size", "42"), []string{}},
+		{"added", tagged(false, "Size", "42"), tagged(false, "Size", "42", "проект", "X1"), []string{"проект:->X1"}},
+		{"removed", tagged(false, "Size", "42", "проект", "X1"), tagged(false, "Size", "42"), []string{"проект:X1>-"}},
+		{"changed", tagged(false, "Size", "42", "проект", "X1"), tagged(false, "Size", "43", "проект", "X1"), []string{"Size:42>43"}},
+		{"added, removed and changed", tagged(false, "Size", "42", "метод", "ELISA"), tagged(false, "Size", "43", "образец", "S1"),
+			[]string{"Size:42>43", "метод:ELISA>-", "образец:->S1"}},
+		{"same number written differently", num(tagged(false, "Size", "42.0"), 42), num(tagged(false, "Size", "42"), 42), []string{}},
+		{"meta only", append(tagged(false, "Size", "42"), tagged(true, "ProcessedAt", `"2019-08-12T14:30:00Z"`)...),
+			append(tagged(false, "Size", "42"), tagged(true, "ProcessedAt", `"2019-08-13T09:00:00Z"`, "ProcessedBy", "ivanov")...), []string{}},
+		{"meta next to a change", append(tagged(false, "Size", "42"), tagged(true, "ProcessedAt", `"2019-08-12T14:30:00Z"`)...),
+			tagged(false, "Size", "43"), []string{"Size:42>43"}},
+	}
+	for _, c := range cases {
+		changes := tagChanges(c.old, c.cur)
+		got := []string{}
+		for _, tc := range changes {
+			got = append(got, tc.Tag+":"+valueOf(tc.OldValue)+">"+valueOf(tc.NewValue))
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: tagChanges = %v, want %v", c.name, got, c.want)
+		}
+
+		// the changes applied to the old record give the significant tags of the new one
+		oldSign, _ := splitMeta(c.old)
+		curSign, _ := splitMeta(c.cur)
+		if applied := api.ApplyTagChanges(oldSign, changes); !sameTags(applied, curSign) {
+			t.Errorf("%v: ApplyTagChanges of the changes = %v, want %v", c.name, sortedTags(applied), sortedTags(curSign))
+		}
+	}
+}
+
+func TestMetaUpdate(t *testing.T) {
+	processed := tagged(true, "ProcessedAt", `"2019-08-12T14:30:00Z"`)
+	cases := []struct {
+		name             string
+		old              []*api.RuleResults
+		cur              []*api.RuleResults
+		set, add, remove []string
+	}{
+		{"unchanged", append(tagged(false, "Size", "42"), processed...), append(tagged(false, "Size", "42"), processed...), nil, nil, nil},
+		{"significant tags are left out", append(tagged(false, "Size", "42"), processed...), append(tagged(false, "Size", "43"), processed...), nil, nil, nil},
+		{"added", tagged(false, "Size", "42"), append(tagged(false, "Size", "42"), processed...),
+			[]string{}, []string{`ProcessedAt="2019-08-12T14:30:00Z"`}, []string{}},
+		{"removed", append(tagged(false, "Size", "42"), processed...), tagged(false, "Size", "42"),
+			[]string{}, []string{}, []string{"ProcessedAt"}},
+		{"changed", processed, tagged(true, "ProcessedAt", `"2019-08-13T09:00:00Z"`),
+			[]string{`ProcessedAt="2019-08-13T09:00:00Z"`}, []string{}, []string{}},
+		{"all at once", tagged(true, "ProcessedAt", `"2019-08-12T14:30:00Z"`, "ProcessedBy", "ivanov", "Comment", "ok"),
+			tagged(true, "ProcessedAt", `"2019-08-13T09:00:00Z"`, "Comment", "ok", "CheckedBy", "petrova"),
+			[]string{`ProcessedAt="2019-08-13T09:00:00Z"`}, []string{"CheckedBy=petrova"}, []string{"ProcessedBy"}},
+	}
+	for _, c := range cases {
+		u := metaUpdate(&api.FileHistory{FileHistoryID: 9, RuleResults: c.old}, c.cur)
+		if c.set == nil {
+			if u != nil {
+				t.Errorf("%v: metaUpdate = %+v, want none", c.name, u)
+			}
+			continue
+		}
+		if u == nil {
+			t.Errorf("%v: no meta update", c.name)
+			continue
+		}
+		if u.FileHistoryID != 9 || !reflect.DeepEqual(sortedTags(u.Set), c.set) || !reflect.DeepEqual(sortedTags(u.Add), c.add) ||
+			!reflect.DeepEqual(u.Remove, c.remove) {
+			t.Errorf("%v: metaUpdate of record %v sets %v, adds %v, removes %v, want %v, %v, %v", c.name,
+				u.FileHistoryID, sortedTags(u.Set), sortedTags(u.Add), u.Remove, c.set, c.add, c.remove)
+		}
+	}
+}
+
+func TestPairRenames(t *testing.T) {
+	file := map[string]string{"Hash": `"sha256:00ff"`, "Size": "2", "IsDir": "false"}
+	other := map[string]string{"Hash": `"sha256:00fe"`, "Size": "2", "IsDir": "false"}
+	dir := map[string]string{"Hash": `"sha256:00ff"`, "Size": "2", "IsDir": "true"}
+	cases := []struct {
+		name    string
+		deleted map[string]map[string]string
+		created map[string]map[string]string
+		want    map[string]string
+	}{
+		{"moved", map[string]map[string]string{"/a/x.txt": file}, map[string]map[string]string{"/b/x.txt": file},
+			map[string]string{"/b/x.txt": "/a/x.txt"}},
+		{"different contents", map[string]map[string]string{"/a/x.txt": file}, map[string]map[string]string{"/b/x.txt": other},
+			map[string]string{}},
+		{"same contents in several candidates",
+			map[string]map[string]string{"/a/x.txt": file, "/b/y.txt": file, "/c/x.txt": file},
+			map[string]map[string]string{"/d/x.txt": file, "/e/z.txt": file},
+			map[string]string{"/d/x.txt": "/a/x.txt", "/e/z.txt": "/b/y.txt"}},
+		{"the same basename comes first",
+			map[string]map[string]string{"/a/y.txt": file, "/b/x.txt": file},
+			map[string]map[string]string{"/c/x.txt": file},
+			map[string]string{"/c/x.txt": "/b/x.txt"}},
+		{"more copies created than deleted",
+			map[string]map[string]string{"/a/x.txt": file},
+			map[string]map[string]string{"/b/x.txt": file, "/c/x.txt": file},
+			map[string]string{"/b/x.txt": "/a/x.txt"}},
+		{"a directory is not a deleted file", map[string]map[string]string{"/a/x/": dir}, map[string]map[string]string{"/b/x.txt": file},
+			map[string]string{}},
+		{"a file is not a deleted directory", map[string]map[string]string{"/a/x.txt": file}, map[string]map[string]string{"/b/x/": dir},
+			map[string]string{}},
+	}
+	for _, c := range cases {
+		deleted, created := []string{}, []string{}
+		for fn := range c.deleted {
+			deleted = append(deleted, fn)
+		}
+		for fn := range c.created {
+			created = append(created, fn)
+		}
+		got := PairRenames(deleted, created, func(fn string) string {
+			return contentKey(c.deleted[fn])
+		}, func(fn string) string {
+			return contentKey(c.created[fn])
+		})
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: PairRenames = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"gamtrac/api"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// walkCompare orders paths the way filepath.Walk visits them: component by component,
+// so that `a/b` comes before `a-c` even though '/' sorts after '-'
+func walkCompare(a, b string) int {
+	ac := strings.Split(strings.TrimSuffix(a, "/"), "/")
+	bc := strings.Split(strings.TrimSuffix(b, "/"), "/")
+	for i := 0; i < len(ac) && i < len(bc); i++ {
+		if ac[i] != bc[i] {
+			if ac[i] < bc[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(ac) - len(bc)
+}
+
+// isInside is true when path is below the directory dir
+func isInside(path, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	return strings.HasPrefix(path, dir) && len(path) > len(dir)
+}
+
+// walkPos is a queued file of the walk
+type walkPos struct {
+	endpoint string
+	path     string
+}
+
+// walkProgress tracks which part of the walk is done. Workers finish files out of order,
+// so only the longest prefix of the walk in which every file is done can be checkpointed.
+type walkProgress struct {
+	m       sync.Mutex
+	queued  map[int]walkPos
+	done    map[int]bool
+	next    int // sequence number of the next queued file
+	reached int // every file before this sequence number is done
+	last    map[string]string
+}
+
+func newWalkProgress() *walkProgress {
+	return &walkProgress{
+		queued: map[int]walkPos{},
+		done:   map[int]bool{},
+		last:   map[string]string{},
+	}
+}
+
+// Queue registers the next file of the walk and returns its sequence number
+func (w *walkProgress) Queue(endpoint, path string) int {
+	w.m.Lock()
+	defer w.m.Unlock()
+	seq := w.next
+	w.queued[seq] = walkPos{endpoint, path}
+	w.next++
+	return seq
+}
+
+// Done marks the file as processed and advances the completed prefix
+func (w *walkProgress) Done(seq int) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.done[seq] = true
+	for w.done[w.reached] {
+		pos := w.queued[w.reached]
+		w.last[pos.endpoint] = pos.path
+		delete(w.done, w.reached)
+		delete(w.queued, w.reached)
+		w.reached++
+	}
+}
+
+// Checkpoints returns the last path of the completed prefix of every endpoint
+func (w *walkProgress) Checkpoints(scan int) []api.ScanCheckpoints {
+	w.m.Lock()
+	defer w.m.Unlock()
+	ret := []api.ScanCheckpoints{}
+	for ep, path := range w.last {
+		ret = append(ret, api.ScanCheckpoints{ScanID: scan, Endpoint: ep, LastPath: path})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Endpoint < ret[j].Endpoint })
+	return ret
+}
+
+// resumePoints are the checkpoints of an interrupted scan, the files up to a checkpoint
+// were already written by the interrupted run and are skipped when the scan is resumed
+type resumePoints map[string]string
+
+func newResumePoints(scan *api.Scans) resumePoints {
+	ret := resumePoints{}
+	if scan == nil {
+		return ret
+	}
+	for _, cp := range scan.ScanCheckpoints {
+		ret[cp.Endpoint] = cp.LastPath
+	}
+	return ret
+}
+
+// Done is true when the path of the endpoint was already handled by the interrupted run
+func (r resumePoints) Done(endpoint, path string) bool {
+	cp, ok := r[endpoint]
+	return ok && walkCompare(path, cp) <= 0
+}
+
+// Skip tells the walk what to do with the path: skip only the entry itself, skip the whole
+// directory because the checkpoint is past it, or process it
+func (r resumePoints) Skip(endpoint, path string, isDir bool) (skip bool, skipDir bool) {
+	if !r.Done(endpoint, path) {
+		return false, false
+	}
+	// the walk stopped somewhere below this directory, descend to find the spot
+	if isDir && isInside(r[endpoint], path) {
+		return true, false
+	}
+	return true, isDir
+}
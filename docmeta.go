@@ -0,0 +1,666 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"fmt"
+	"gamtrac/api"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// DocMetaHandler reads the document properties stored in office documents and pdfs
+type DocMetaHandler struct {
+	RuleResultGenerator
+	rule api.Rules
+}
+
+func (h *DocMetaHandler) Init(rules []api.Rules) error {
+	var err error
+	h.rule, err = singleRule("docmeta", rules)
+	return err
+}
+
+func (h *DocMetaHandler) Generate(input AnnotItem) []api.AnnotResult {
+	if input.fileInfo.IsDir() {
+		return []api.AnnotResult{}
+	}
+	fn := input.path.MountedAt
+	destination := input.path.Destination
+	meta := &api.DocMetaResult{RuleID: h.rule.RuleID, Path: destination}
+	var err error
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".docx", ".docm", ".xlsx", ".xlsm", ".pptx", ".pptm":
+		err = readOOXMLMeta(fn, meta)
+	case ".pdf":
+		err = readPdfMeta(fn, meta)
+	default:
+		return []api.AnnotResult{}
+	}
+	if err != nil {
+		return []api.AnnotResult{api.NewErrorResult(h.rule.RuleID, destination, err)}
+	}
+	return []api.AnnotResult{meta}
+}
+
+// ooxmlCore are the core properties of an office document, docProps/core.xml
+type ooxmlCore struct {
+	Title          string `xml:"title"`
+	Creator        string `xml:"creator"`
+	LastModifiedBy string `xml:"lastModifiedBy"`
+	Created        string `xml:"created"`
+	Modified       string `xml:"modified"`
+}
+
+// ooxmlApp are the application properties, docProps/app.xml; word stores the page count here
+type ooxmlApp struct {
+	Pages  int `xml:"Pages"`
+	Slides int `xml:"Slides"`
+}
+
+type ooxmlWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+func readOOXMLMeta(fn string, meta *api.DocMetaResult) error {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		return fmt.Errorf("cannot open %v as an office document: %v", fn, err)
+	}
+	defer zr.Close()
+	parts := map[string]*zip.File{}
+	for _, f := range zr.File {
+		parts[f.Name] = f
+	}
+	core := ooxmlCore{}
+	if err := readZipXML(parts["docProps/core.xml"], &core); err != nil {
+		return err
+	}
+	app := ooxmlApp{}
+	if err := readZipXML(parts["docProps/app.xml"], &app); err != nil {
+		return err
+	}
+	meta.DocTitle = strings.TrimSpace(core.Title)
+	meta.DocAuthor = strings.TrimSpace(core.Creator)
+	meta.DocLastModifiedBy = strings.TrimSpace(core.LastModifiedBy)
+	meta.DocCreated = strings.TrimSpace(core.Created)
+	meta.DocModified = strings.TrimSpace(core.Modified)
+	meta.DocPages = app.Pages
+	if app.Slides > 0 {
+		meta.DocPages = app.Slides
+	}
+	if wb := parts["xl/workbook.xml"]; wb != nil {
+		workbook := ooxmlWorkbook{}
+		if err := readZipXML(wb, &workbook); err != nil {
+			return err
+		}
+		meta.DocSheets = len(workbook.Sheets)
+	}
+	return nil
+}
+
+// readZipXML decodes a part of the document, missing parts are left empty
+func readZipXML(f *zip.File, v interface{}) error {
+	if f == nil {
+		return nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := xml.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("cannot parse %v: %v", f.Name, err)
+	}
+	return nil
+}
+
+const (
+	pdfTailSize     = 1024             // startxref has to be within the last 1024 bytes of the file
+	pdfChunkSize    = 64 * 1024        // dictionaries and cross-reference headers are read in chunks of this size
+	maxPdfSections  = 64               // cross-reference sections followed through /Prev
+	maxPdfXrefBytes = 16 * 1024 * 1024 // decoded size of a cross-reference stream
+)
+
+var (
+	pdfStartXrefRe = regexp.MustCompile(`startxref\s+(\d+)`)
+	pdfInfoRefRe   = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	pdfRootRefRe   = regexp.MustCompile(`/Root\s+(\d+)\s+(\d+)\s+R`)
+	pdfPagesRefRe  = regexp.MustCompile(`/Pages\s+(\d+)\s+(\d+)\s+R`)
+	pdfPrevRe      = regexp.MustCompile(`/Prev\s+(\d+)`)
+	pdfCountRe     = regexp.MustCompile(`/Count\s+(\d+)`)
+	pdfSubsectRe   = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\s*`)
+	pdfEntryRe     = regexp.MustCompile(`^(\d{10}) (\d{5}) ([nf])`)
+	pdfObjHeadRe   = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\s+obj\b`)
+	pdfLengthRe    = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+	pdfWidthsRe    = regexp.MustCompile(`/W\s*\[\s*(\d+)\s+(\d+)\s+(\d+)\s*\]`)
+	pdfIndexRe     = regexp.MustCompile(`/Index\s*\[([\d\s]*)\]`)
+	pdfSizeRe      = regexp.MustCompile(`/Size\s+(\d+)`)
+	pdfPredictorRe = regexp.MustCompile(`/Predictor\s+(\d+)`)
+	pdfColumnsRe   = regexp.MustCompile(`/Columns\s+(\d+)`)
+	pdfDateRe      = regexp.MustCompile(`^D:(\d{4})(\d{2})?(\d{2})?(\d{2})?(\d{2})?(\d{2})?([Zz+-])?(\d{2})?'?(\d{2})?`)
+)
+
+// readPdfMeta reads the info dictionary the trailer refers to and the page count of the page tree.
+// Only the trailer, the cross-reference sections and the objects needed are read, so the size of
+// the file doesn't matter. Objects inside compressed object streams are not looked into, their
+// values stay empty.
+func readPdfMeta(fn string, meta *api.DocMetaResult) error {
+	p, err := openPdf(fn)
+	if err != nil {
+		return err
+	}
+	defer p.f.Close()
+	if info := p.object(p.trailerRef(pdfInfoRefRe)); info != nil {
+		dict := pdfDict(info)
+		meta.DocTitle = dict["Title"]
+		meta.DocAuthor = dict["Author"]
+		meta.DocCreated = pdfDate(dict["CreationDate"])
+		meta.DocModified = pdfDate(dict["ModDate"])
+	}
+	// the root of the page tree counts every page
+	if catalog := p.object(p.trailerRef(pdfRootRefRe)); catalog != nil {
+		if pages := p.object(pdfRef(pdfPagesRefRe.FindSubmatch(catalog))); pages != nil {
+			if m := pdfCountRe.FindSubmatch(pages); m != nil {
+				meta.DocPages, _ = strconv.Atoi(string(m[1]))
+			}
+		}
+	}
+	return nil
+}
+
+// pdfFile finds objects through the cross-reference sections of a pdf
+type pdfFile struct {
+	f        *os.File
+	size     int64
+	sections []pdfXref // the newest first, incremental updates append a new section
+	trailers [][]byte  // the trailer dictionary of every section
+}
+
+// pdfXref is a cross-reference section: a table, whose entries are only read when they are
+// looked up, or a decoded cross-reference stream
+type pdfXref struct {
+	table  []pdfSubsection
+	stream map[int]int64 // object number => offset, -1 for free and compressed objects
+}
+
+type pdfSubsection struct {
+	first, count int
+	at           int64 // offset of the entry of the first object
+}
+
+func openPdf(fn string) (*pdfFile, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p := &pdfFile{f: f, size: fi.Size()}
+	if !bytes.HasPrefix(p.readAt(0, 5), []byte("%PDF-")) {
+		f.Close()
+		return nil, fmt.Errorf("%v is not a pdf", fn)
+	}
+	starts := pdfStartXrefRe.FindAllSubmatch(p.readAt(p.size-pdfTailSize, pdfTailSize), -1)
+	if len(starts) == 0 {
+		f.Close()
+		return nil, fmt.Errorf("cannot find the cross-reference table of %v", fn)
+	}
+	off, _ := strconv.ParseInt(string(starts[len(starts)-1][1]), 10, 64)
+	seen := map[int64]bool{}
+	for len(p.sections) < maxPdfSections && !seen[off] {
+		seen[off] = true
+		section, trailer, err := p.readXref(off)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("cannot read the cross-reference table of %v: %v", fn, err)
+		}
+		p.sections = append(p.sections, section)
+		p.trailers = append(p.trailers, trailer)
+		prev := pdfPrevRe.FindSubmatch(trailer)
+		if prev == nil {
+			break
+		}
+		off, _ = strconv.ParseInt(string(prev[1]), 10, 64)
+	}
+	return p, nil
+}
+
+// readAt reads up to n bytes at off, less at the end of the file
+func (p *pdfFile) readAt(off int64, n int) []byte {
+	if off < 0 {
+		n += int(off)
+		off = 0
+	}
+	if off >= p.size || n <= 0 {
+		return []byte{}
+	}
+	if rest := p.size - off; int64(n) > rest {
+		n = int(rest)
+	}
+	buf := make([]byte, n)
+	read, _ := p.f.ReadAt(buf, off)
+	return buf[:read]
+}
+
+// readXref reads the cross-reference section at off along with its trailer dictionary
+func (p *pdfFile) readXref(off int64) (pdfXref, []byte, error) {
+	chunk := p.readAt(off, pdfChunkSize)
+	trimmed := bytes.TrimLeft(chunk, " \t\r\n\f")
+	if !bytes.HasPrefix(trimmed, []byte("xref")) {
+		if pdfObjHeadRe.Match(chunk) {
+			return p.readXrefStream(off, chunk)
+		}
+		return pdfXref{}, nil, fmt.Errorf("no cross-reference section at %v", off)
+	}
+	off += int64(len(chunk) - len(trimmed) + len("xref"))
+	section := pdfXref{}
+	for {
+		chunk = p.readAt(off, pdfChunkSize)
+		if rest := bytes.TrimLeft(chunk, " \t\r\n\f"); bytes.HasPrefix(rest, []byte("trailer")) {
+			trailer := rest[len("trailer"):]
+			if end := bytes.Index(trailer, []byte("startxref")); end != -1 {
+				trailer = trailer[:end]
+			}
+			return section, trailer, nil
+		}
+		m := pdfSubsectRe.FindSubmatch(chunk)
+		if m == nil {
+			return pdfXref{}, nil, fmt.Errorf("malformed cross-reference table at %v", off)
+		}
+		first, _ := strconv.Atoi(string(m[1]))
+		count, _ := strconv.Atoi(string(m[2]))
+		at := off + int64(len(m[0]))
+		// every entry is exactly 20 bytes long
+		off = at + int64(count)*20
+		if count < 0 || off > p.size {
+			return pdfXref{}, nil, fmt.Errorf("malformed cross-reference table at %v", at)
+		}
+		section.table = append(section.table, pdfSubsection{first: first, count: count, at: at})
+	}
+}
+
+// readXrefStream decodes the cross-reference stream of pdf 1.5, chunk holds the start of the stream object
+func (p *pdfFile) readXrefStream(off int64, chunk []byte) (pdfXref, []byte, error) {
+	start := bytes.Index(chunk, []byte("stream"))
+	if start == -1 {
+		return pdfXref{}, nil, fmt.Errorf("malformed cross-reference stream at %v", off)
+	}
+	dict := chunk[:start]
+	length, widths := pdfLengthRe.FindSubmatch(dict), pdfWidthsRe.FindSubmatch(dict)
+	if length == nil || len(length[2]) > 0 || widths == nil {
+		return pdfXref{}, nil, fmt.Errorf("unsupported cross-reference stream at %v", off)
+	}
+	start += len("stream")
+	if start < len(chunk) && chunk[start] == '\r' {
+		start++
+	}
+	if start < len(chunk) && chunk[start] == '\n' {
+		start++
+	}
+	n, _ := strconv.Atoi(string(length[1]))
+	zr, err := zlib.NewReader(bytes.NewReader(p.readAt(off+int64(start), n)))
+	if err != nil {
+		return pdfXref{}, nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(zr, maxPdfXrefBytes))
+	if err != nil {
+		return pdfXref{}, nil, err
+	}
+	w := make([]int, 3)
+	for k := range w {
+		w[k], _ = strconv.Atoi(string(widths[k+1]))
+	}
+	row := w[0] + w[1] + w[2]
+	if row == 0 {
+		return pdfXref{}, nil, fmt.Errorf("malformed cross-reference stream at %v", off)
+	}
+	if m := pdfPredictorRe.FindSubmatch(dict); m != nil && string(m[1]) != "1" {
+		columns := 1
+		if c := pdfColumnsRe.FindSubmatch(dict); c != nil {
+			columns, _ = strconv.Atoi(string(c[1]))
+		}
+		if data, err = pngUnfilter(data, columns); err != nil {
+			return pdfXref{}, nil, err
+		}
+	}
+	// the stream lists the objects of the subsections in /Index, all objects up to /Size by default
+	index := []int{}
+	if m := pdfIndexRe.FindSubmatch(dict); m != nil {
+		for _, f := range strings.Fields(string(m[1])) {
+			n, _ := strconv.Atoi(f)
+			index = append(index, n)
+		}
+	} else if m := pdfSizeRe.FindSubmatch(dict); m != nil {
+		size, _ := strconv.Atoi(string(m[1]))
+		index = []int{0, size}
+	}
+	field := func(b []byte) int64 {
+		var v int64
+		for _, c := range b {
+			v = v<<8 | int64(c)
+		}
+		return v
+	}
+	section := pdfXref{stream: map[int]int64{}}
+	pos := 0
+	for k := 0; k+1 < len(index); k += 2 {
+		for num := index[k]; num < index[k]+index[k+1] && pos+row <= len(data); num++ {
+			entry := data[pos : pos+row]
+			pos += row
+			kind := int64(1)
+			if w[0] > 0 {
+				kind = field(entry[:w[0]])
+			}
+			section.stream[num] = -1
+			if kind == 1 {
+				section.stream[num] = field(entry[w[0] : w[0]+w[1]])
+			}
+		}
+	}
+	return section, dict, nil
+}
+
+// pngUnfilter reverses the png predictors of a flate stream, every row starts with the filter type
+func pngUnfilter(data []byte, columns int) ([]byte, error) {
+	if columns <= 0 {
+		return nil, fmt.Errorf("invalid predictor columns %v", columns)
+	}
+	out := make([]byte, 0, len(data))
+	prev := make([]byte, columns)
+	for pos := 0; pos+columns+1 <= len(data); pos += columns + 1 {
+		filter, cur := data[pos], append([]byte{}, data[pos+1:pos+1+columns]...)
+		for i := range cur {
+			var left, upLeft byte
+			if i > 0 {
+				left, upLeft = cur[i-1], prev[i-1]
+			}
+			switch filter {
+			case 0:
+			case 1:
+				cur[i] += left
+			case 2:
+				cur[i] += prev[i]
+			case 3:
+				cur[i] += byte((int(left) + int(prev[i])) / 2)
+			case 4:
+				cur[i] += paeth(left, prev[i], upLeft)
+			default:
+				return nil, fmt.Errorf("unknown png filter %v", filter)
+			}
+		}
+		out = append(out, cur...)
+		prev = cur
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	abs := func(n int) int {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+// trailerRef returns the object the newest trailer having the key refers to
+func (p *pdfFile) trailerRef(re *regexp.Regexp) (int, int, bool) {
+	for _, trailer := range p.trailers {
+		if m := re.FindSubmatch(trailer); m != nil {
+			return pdfRef(m)
+		}
+	}
+	return 0, 0, false
+}
+
+// pdfRef converts the number and generation matched by one of the reference patterns
+func pdfRef(m [][]byte) (int, int, bool) {
+	if m == nil {
+		return 0, 0, false
+	}
+	num, _ := strconv.Atoi(string(m[1]))
+	gen, _ := strconv.Atoi(string(m[2]))
+	return num, gen, true
+}
+
+// offset looks the object up in the sections from the newest to the oldest
+func (p *pdfFile) offset(num int) (int64, bool) {
+	for _, section := range p.sections {
+		if section.stream != nil {
+			if off, ok := section.stream[num]; ok {
+				return off, off >= 0
+			}
+			continue
+		}
+		for _, sub := range section.table {
+			if num < sub.first || num >= sub.first+sub.count {
+				continue
+			}
+			m := pdfEntryRe.FindSubmatch(p.readAt(sub.at+int64(num-sub.first)*20, 20))
+			if m == nil || string(m[3]) != "n" {
+				return 0, false
+			}
+			off, _ := strconv.ParseInt(string(m[1]), 10, 64)
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// object returns the dictionary of an uncompressed object, nil if it can't be found
+func (p *pdfFile) object(num, gen int, ok bool) []byte {
+	if !ok {
+		return nil
+	}
+	off, ok := p.offset(num)
+	if !ok {
+		return nil
+	}
+	chunk := p.readAt(off, pdfChunkSize)
+	m := pdfObjHeadRe.FindSubmatch(chunk)
+	if m == nil || string(m[1]) != strconv.Itoa(num) || string(m[2]) != strconv.Itoa(gen) {
+		return nil
+	}
+	body := chunk[len(m[0]):]
+	for _, end := range []string{"endobj", "stream"} {
+		if i := bytes.Index(body, []byte(end)); i != -1 {
+			body = body[:i]
+		}
+	}
+	return body
+}
+
+// pdfDict reads the string values of a dictionary, other values are skipped
+func pdfDict(body []byte) map[string]string {
+	ret := map[string]string{}
+	for i := 0; i < len(body); i++ {
+		if body[i] != '/' {
+			continue
+		}
+		j := i + 1
+		for j < len(body) && !isPdfDelimiter(body[j]) {
+			j++
+		}
+		key := string(body[i+1 : j])
+		for j < len(body) && isPdfSpace(body[j]) {
+			j++
+		}
+		if j >= len(body) {
+			break
+		}
+		var value string
+		var end int
+		switch body[j] {
+		case '(':
+			value, end = pdfLiteral(body, j)
+		case '<':
+			if j+1 < len(body) && body[j+1] == '<' {
+				i = j + 1
+				continue
+			}
+			value, end = pdfHex(body, j)
+		default:
+			i = j - 1
+			continue
+		}
+		ret[key] = strings.TrimSpace(value)
+		i = end
+	}
+	return ret
+}
+
+func isPdfSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPdfDelimiter(c byte) bool {
+	return isPdfSpace(c) || strings.IndexByte("()<>[]{}/%", c) != -1
+}
+
+// pdfLiteral decodes the string literal starting at the opening parenthesis at start
+func pdfLiteral(body []byte, start int) (string, int) {
+	var out []byte
+	depth := 0
+	i := start
+	for ; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '\\' && i+1 < len(body):
+			i++
+			switch e := body[i]; e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b':
+				out = append(out, '\b')
+			case 'f':
+				out = append(out, '\f')
+			case '\r', '\n':
+				// line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					n := 0
+					k := i
+					for ; k < len(body) && k < i+3 && body[k] >= '0' && body[k] <= '7'; k++ {
+						n = n*8 + int(body[k]-'0')
+					}
+					out = append(out, byte(n))
+					i = k - 1
+				} else {
+					out = append(out, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				out = append(out, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return pdfText(out), i
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return pdfText(out), i
+}
+
+func pdfHex(body []byte, start int) (string, int) {
+	end := bytes.IndexByte(body[start:], '>')
+	if end == -1 {
+		return "", len(body)
+	}
+	digits := []byte{}
+	for _, c := range body[start+1 : start+end] {
+		if !isPdfSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	for k := range out {
+		n, err := strconv.ParseUint(string(digits[2*k:2*k+2]), 16, 8)
+		if err != nil {
+			return "", start + end
+		}
+		out[k] = byte(n)
+	}
+	return pdfText(out), start + end
+}
+
+// pdfText decodes a pdf text string: utf-16 with a byte order mark, otherwise pdfdoc encoding
+// which is treated as latin-1
+func pdfText(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+		units := make([]uint16, 0, len(b)/2)
+		for k := 2; k+1 < len(b); k += 2 {
+			units = append(units, uint16(b[k])<<8|uint16(b[k+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	if len(b) >= 3 && b[0] == 0xef && b[1] == 0xbb && b[2] == 0xbf {
+		return string(b[3:])
+	}
+	runes := make([]rune, len(b))
+	for k, c := range b {
+		runes[k] = rune(c)
+	}
+	return string(runes)
+}
+
+// pdfDate converts a date like D:20190812143000+03'00' to RFC 3339, unparseable dates are kept as they are
+func pdfDate(s string) string {
+	m := pdfDateRe.FindStringSubmatch(s)
+	if m == nil {
+		return s
+	}
+	part := func(i int, def int) int {
+		if m[i] == "" {
+			return def
+		}
+		n, _ := strconv.Atoi(m[i])
+		return n
+	}
+	loc := time.UTC
+	if m[7] == "+" || m[7] == "-" {
+		offset := (part(8, 0)*60 + part(9, 0)) * 60
+		if m[7] == "-" {
+			offset = -offset
+		}
+		loc = time.FixedZone("", offset)
+	}
+	t := time.Date(part(1, 0), time.Month(part(2, 1)), part(3, 1), part(4, 0), part(5, 0), part(6, 0), 0, loc)
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"gamtrac/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pdfBuilder writes the objects of a test pdf and remembers where they start
+type pdfBuilder struct {
+	bytes.Buffer
+	offsets map[int]int
+}
+
+func newPdfBuilder() *pdfBuilder {
+	b := &pdfBuilder{offsets: map[int]int{}}
+	b.WriteString("%PDF-1.4\n")
+	return b
+}
+
+func (b *pdfBuilder) obj(num int, body string) {
+	b.offsets[num] = b.Len()
+	fmt.Fprintf(b, "%d 0 obj\n%s\nendobj\n", num, body)
+}
+
+// xref writes a cross-reference table of the objects followed by the trailer and returns its offset
+func (b *pdfBuilder) xref(nums []int, trailer string) int {
+	at := b.Len()
+	b.WriteString("xref\n0 1\n0000000000 65535 f\r\n")
+	for _, n := range nums {
+		fmt.Fprintf(b, "%d 1\n%010d 00000 n\r\n", n, b.offsets[n])
+	}
+	fmt.Fprintf(b, "trailer\n%s\nstartxref\n%d\n%%%%EOF\n", trailer, at)
+	return at
+}
+
+// xrefStream writes the objects into a compressed cross-reference stream object num using the png up predictor
+func (b *pdfBuilder) xrefStream(num int, nums []int, trailer string) {
+	at := b.Len()
+	b.offsets[num] = at
+	nums = append(nums, num)
+	var raw bytes.Buffer
+	zw := zlib.NewWriter(&raw)
+	prev := make([]byte, 5)
+	index := []string{}
+	for _, n := range nums {
+		off := b.offsets[n]
+		row := []byte{1, byte(off >> 16), byte(off >> 8), byte(off), 0}
+		filtered := []byte{2}
+		for i := range row {
+			filtered = append(filtered, row[i]-prev[i])
+		}
+		zw.Write(filtered)
+		prev = row
+		index = append(index, fmt.Sprintf("%d 1", n))
+	}
+	zw.Close()
+	fmt.Fprintf(b, "%d 0 obj\n<< /Type /XRef /W [1 3 1] /Index [%v] /Size %d /Filter /FlateDecode /DecodeParms << /Columns 5 /Predictor 12 >> /Length %d %v >>\nstream\n",
+		num, strings.Join(index, " "), num+1, raw.Len(), trailer)
+	b.Write(raw.Bytes())
+	fmt.Fprintf(b, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", at)
+}
+
+func TestReadPdfMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gamtrac-docmeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// an incremental update replaces the info dictionary, the objects in between are larger
+	// than a chunk and a page tree that isn't the root must not be counted
+	updated := newPdfBuilder()
+	updated.obj(1, "<< /Type /Catalog /Pages 2 0 R >>")
+	updated.obj(2, "<< /Type /Pages /Kids [5 0 R] /Count 3 >>")
+	updated.obj(3, "<< /Title (Draft) /Author (Ivanov) /CreationDate (D:20190812143000+03'00') >>")
+	updated.obj(5, "<< /Type /Pages /Parent 2 0 R /Count 99 >>")
+	updated.obj(6, "<< /Length 100000 >>\nstream\n"+strings.Repeat("x", 100000)+"\nendstream")
+	first := updated.xref([]int{1, 2, 3, 5, 6}, "<< /Size 7 /Root 1 0 R /Info 3 0 R >>")
+	updated.obj(3, "<< /Title <FEFF04300442> /Author (Ivanov) /CreationDate (D:20190812143000+03'00') >>")
+	updated.xref([]int{3}, fmt.Sprintf("<< /Size 7 /Root 1 0 R /Info 3 0 R /Prev %d >>", first))
+
+	streamed := newPdfBuilder()
+	streamed.obj(1, "<< /Type /Catalog /Pages 2 0 R >>")
+	streamed.obj(2, "<< /Type /Pages /Kids [] /Count 5 >>")
+	streamed.obj(3, "<< /Title (Report) /ModDate (D:20190901) >>")
+	streamed.xrefStream(4, []int{1, 2, 3}, "/Root 1 0 R /Info 3 0 R")
+
+	noInfo := newPdfBuilder()
+	noInfo.obj(1, "<< /Type /Catalog /Pages 2 0 R >>")
+	noInfo.obj(2, "<< /Type /Pages /Kids [] /Count 1 >>")
+	noInfo.xref([]int{1, 2}, "<< /Size 3 /Root 1 0 R >>")
+
+	cases := []struct {
+		name    string
+		data    []byte
+		want    api.DocMetaResult
+		wantErr bool
+	}{
+		{"incremental update", updated.Bytes(), api.DocMetaResult{DocTitle: "ат", DocAuthor: "Ivanov", DocCreated: "2019-08-12T14:30:00+03:00", DocPages: 3}, false},
+		{"cross-reference stream", streamed.Bytes(), api.DocMetaResult{DocTitle: "Report", DocModified: "2019-09-01T00:00:00Z", DocPages: 5}, false},
+		{"no info dictionary", noInfo.Bytes(), api.DocMetaResult{DocPages: 1}, false},
+		{"no cross-reference table", []byte("%PDF-1.4\n1 0 obj\n<< >>\nendobj\n"), api.DocMetaResult{}, true},
+		{"not a pdf", []byte("PK\x03\x04"), api.DocMetaResult{}, true},
+	}
+	for i, c := range cases {
+		fn := filepath.Join(dir, fmt.Sprintf("%d.pdf", i))
+		if err := ioutil.WriteFile(fn, c.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got := api.DocMetaResult{}
+		err := readPdfMeta(fn, &got)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%v: readPdfMeta error = %v, want error %v", c.name, err, c.wantErr)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%v: readPdfMeta = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"gamtrac/api"
+	"os"
+	"sort"
+	"sync"
+)
+
+// EndpointRegistry keeps the endpoints mounted between scans and follows the endpoints table
+type EndpointRegistry struct {
+	allowLocal bool
+	ac         AppCredentials
+	static     []string
+	m          sync.Mutex
+	mounts     map[string]MountedPath
+}
+
+func NewEndpointRegistry(static []string, allowLocal bool, ac AppCredentials) *EndpointRegistry {
+	return &EndpointRegistry{
+		allowLocal: allowLocal,
+		ac:         ac,
+		static:     static,
+		mounts:     map[string]MountedPath{},
+	}
+}
+
+// Sync mounts the endpoints that are new, unmounts the ones that were removed or ignored
+// and returns the currently mounted set; endpoints that fail to mount are skipped until the next sync
+func (r *EndpointRegistry) Sync(endpoints []api.Endpoints) map[string]MountedPath {
+	r.m.Lock()
+	defer r.m.Unlock()
+	wanted := map[string]bool{}
+	principals := map[string]*int{}
+	for _, p := range r.static {
+		wanted[p] = true
+	}
+	for _, ep := range endpoints {
+		if !ep.Ignore {
+			wanted[ep.Path] = true
+			principals[ep.Path] = ep.Principal
+		}
+	}
+	for p, mp := range r.mounts {
+		if !wanted[p] {
+			fmt.Printf("Endpoint `%v` was removed\n", p)
+			mp.Unmount()
+			delete(r.mounts, p)
+		}
+	}
+	for p := range wanted {
+		if _, ok := r.mounts[p]; ok {
+			continue
+		}
+		mounted, _, err := mountPaths([]string{p}, r.allowLocal, r.ac)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot mount endpoint `%v`: %v\n", p, err)
+			continue
+		}
+		for k, mp := range *mounted {
+			r.mounts[k] = mp
+		}
+	}
+	// the principal of an endpoint may change without remounting it
+	for p, mp := range r.mounts {
+		mp.Principal = principals[p]
+		r.mounts[p] = mp
+	}
+	return r.mounted()
+}
+
+// mounted returns a copy of the currently mounted endpoints, the caller must hold the lock
+func (r *EndpointRegistry) mounted() map[string]MountedPath {
+	ret := map[string]MountedPath{}
+	for k, v := range r.mounts {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Current returns the currently mounted endpoints
+func (r *EndpointRegistry) Current() map[string]MountedPath {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.mounted()
+}
+
+func (r *EndpointRegistry) UnmountAll() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for p, mp := range r.mounts {
+		mp.Unmount()
+		delete(r.mounts, p)
+	}
+}
+
+// endpointKeys returns the sorted endpoint paths, used to notice when the set of endpoints changes
+func endpointKeys(mounts map[string]MountedPath) []string {
+	keys := []string{}
+	for k := range mounts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
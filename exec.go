@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gamtrac/api"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const maxExecStderr = 1024 // stderr kept for the error message
+
+// execDef is the rule text of an exec rule, e.g.
+// {"extensions": [".d"], "command": ["./agilent2json", "{file}"], "timeout": 120, "concurrency": 2}
+// {file} is replaced by the path of the mounted file and {path} by its destination.
+// The command prints a JSON object on stdout, its fields become the tags of the file.
+type execDef struct {
+	Extensions  []string `json:"extensions"`
+	Command     []string `json:"command"`
+	Format      string   `json:"format"`      // only "json" for now
+	Timeout     int      `json:"timeout"`     // seconds, 60 by default
+	Concurrency int      `json:"concurrency"` // commands of the rule running at once, the number of CPUs by default
+}
+
+type execRule struct {
+	rule    api.Rules
+	def     execDef
+	timeout time.Duration
+	slots   chan struct{} // limits the running commands
+}
+
+// ExecHandler runs an external converter on the files an exec rule is interested in,
+// so that instrument formats can be supported without changing gamtrac
+type ExecHandler struct {
+	RuleResultGenerator
+	rules []*execRule
+}
+
+func newExecRule(r api.Rules) (*execRule, error) {
+	def := execDef{}
+	if err := json.Unmarshal([]byte(r.Rule), &def); err != nil {
+		return nil, fmt.Errorf("invalid exec definition: %v", err)
+	}
+	if len(def.Command) == 0 {
+		return nil, fmt.Errorf("an exec rule needs a command")
+	}
+	if def.Format == "" {
+		def.Format = "json"
+	}
+	if def.Format != "json" {
+		return nil, fmt.Errorf("unsupported output format %v", def.Format)
+	}
+	if def.Timeout <= 0 {
+		def.Timeout = 60
+	}
+	if def.Concurrency <= 0 {
+		def.Concurrency = runtime.NumCPU()
+	}
+	for i, ext := range def.Extensions {
+		def.Extensions[i] = strings.ToLower(ext)
+	}
+	return &execRule{
+		rule:    r,
+		def:     def,
+		timeout: time.Duration(def.Timeout) * time.Second,
+		slots:   make(chan struct{}, def.Concurrency),
+	}, nil
+}
+
+func (h *ExecHandler) Init(ruleDefs []api.Rules) error {
+	h.rules = []*execRule{}
+	for _, r := range ruleDefs {
+		er, err := newExecRule(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot parse exec rule %v `%v`: %v\n", r.RuleID, r.Rule, err)
+			continue
+		}
+		h.rules = append(h.rules, er)
+	}
+	return nil
+}
+
+// accepts is true for the files with one of the extensions of the rule, a rule without extensions gets every file
+func (er *execRule) accepts(fn string) bool {
+	if len(er.def.Extensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(fn))
+	for _, e := range er.def.Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (er *execRule) run(path MountedPath) (map[string]interface{}, error) {
+	args := make([]string, len(er.def.Command))
+	for i, arg := range er.def.Command {
+		args[i] = strings.NewReplacer("{file}", path.MountedAt, "{path}", path.Destination).Replace(arg)
+	}
+	er.slots <- struct{}{}
+	defer func() { <-er.slots }()
+	ctx, cancel := context.WithTimeout(context.Background(), er.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%v timed out after %v on %v", args[0], er.timeout, path.MountedAt)
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxExecStderr {
+			msg = msg[:maxExecStderr] + "..."
+		}
+		return nil, fmt.Errorf("%v failed on %v: %v: %v", args[0], path.MountedAt, err, msg)
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(stdout.Bytes(), &fields); err != nil {
+		return nil, fmt.Errorf("%v printed invalid JSON for %v: %v", args[0], path.MountedAt, err)
+	}
+	return fields, nil
+}
+
+func (h *ExecHandler) Generate(input AnnotItem) []api.AnnotResult {
+	ret := []api.AnnotResult{}
+	if input.fileInfo.IsDir() {
+		return ret
+	}
+	for _, er := range h.rules {
+		if !ruleApplies(er.rule, input.path) || !er.accepts(input.path.MountedAt) {
+			continue
+		}
+		fields, err := er.run(input.path)
+		if err != nil {
+			ret = append(ret, api.NewErrorResult(er.rule.RuleID, input.path.Destination, err))
+			continue
+		}
+		ret = append(ret, &api.ExecResult{
+			RuleID:   er.rule.RuleID,
+			Path:     input.path.Destination,
+			Fields:   fields,
+			Priority: er.rule.Priority,
+		})
+	}
+	return ret
+}
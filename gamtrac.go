@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bufio"
-	"crypto/sha256"
 	"fmt"
 	"gamtrac/api"
 	"gamtrac/rules"
 	"gamtrac/scanner"
-	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -28,6 +25,25 @@ type MountedPath struct {
 	Destination string
 	MountedAt   string
 	Mounted     bool
+	Principal   *int // principal of the endpoint the path belongs to, nil for endpoints given on the command line
+	Owner       string // account name of the owner of the file, empty when unknown
+}
+
+// withOwner is the path along with the account owning the file, rules can be scoped to it. The files
+// of a share mounted on linux all seem to belong to the mounting user, they get the principal of
+// their endpoint instead.
+func withOwner(p MountedPath, info os.FileInfo) MountedPath {
+	if p.Mounted && !scanner.MountedOwners {
+		if p.Principal != nil {
+			p.Owner = principalName(*p.Principal)
+		}
+		return p
+	}
+	// the fileprops handler reports the files whose owner can't be read
+	if owner, err := scanner.GetFileOwnerName(p.MountedAt, info); err == nil {
+		p.Owner = owner
+	}
+	return p
 }
 
 func (p MountedPath) Unmount() error {
@@ -44,81 +60,56 @@ func (p MountedPath) Unmount() error {
 type AnnotItem struct {
 	path     MountedPath
 	fileInfo os.FileInfo
-	ruleDefs []api.Rules
-	handlers map[string]RuleResultGenerator
+	handlers []RuleResultGenerator // initialised with the rules of the current scan
 	queuedAt time.Time
+	prev     *api.FileHistory // latest known record
+	ignore   *IgnoreRules     // the ignored entries of a folder are not part of its contents
+	reuse    bool             // reuse the stored results of unchanged files, set for incremental scans
+	err      error            // the file could not be read, fileInfo may be nil
+	seq      int              // position in the walk, used for checkpoints
 }
 
 var test_rules = []string{
 	"<дата>_<проект>_<методика>_<вид данных>_<наименование образца>_<комментарий>",
 	"R:\\DAR\\LAM\\Screening group\\<Заказчик>\\1_Результаты, протоколы, отчеты\\<Измеряемый параметр>_<Метод анализа>\\<Проект>\\"}
 
-func computeHash(path string) (*HashDigest, error) {
-	if !(os.Getenv("GAMTRAC_HASH_FILE_CONTENTS") > "0") {
-		return nil, nil
-	}
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	reader := bufio.NewReaderSize(f, 4*1024*1024) // larger transfers are faster
-	h := sha256.New()
-	_, err = io.Copy(h, reader)
-	if err != nil {
-		return nil, err
-	}
-	digest := &HashDigest{Value: h.Sum(nil), Algorithm: "sha256"}
-	return digest, nil
+// FileResults are all results produced for a single file
+type FileResults struct {
+	Path    string
+	Results []api.AnnotResult
+	prev    *api.FileHistory
+	seq     int
+	mounted MountedPath // along with its owner, bundle rules can be scoped to it
 }
 
-
-func processFile(inputs <-chan AnnotItem, output chan<- api.AnnotResult, wg *sync.WaitGroup) {
+func processFile(inputs <-chan AnnotItem, output chan<- FileResults, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for input := range inputs {
-		// TODO: this interface is backwards
-		for _, rd := range input.ruleDefs {
-			handler, ok := input.handlers[rd.RuleType]
-			if !ok {
-				// TODO: return api.ErrorResult
-				fmt.Printf("Unknown rule type %v for ruleID %v", rd.RuleType, rd.RuleID)
-				continue
+		out := FileResults{Path: input.path.Destination, prev: input.prev, seq: input.seq, mounted: input.path}
+		switch {
+		case input.err != nil:
+			out.Results = append(out.Results, api.NewErrorResult(0, input.path.Destination, input.err))
+		// size and mtime did not change since the last scan, reuse the stored results; the results of
+		// folders only depend on their direct contents, which change their mtime
+		case input.reuse && input.prev != nil && api.StoredPropsMatch(input.prev, input.fileInfo):
+			out.Results = api.StoredResults(input.path.Destination, input.prev)
+		default:
+			for _, handler := range input.handlers {
+				// fmt.Println("Finished processing file: ", mountedAt)
+				out.Results = append(out.Results, handler.Generate(input)...)
 			}
-			rslt := handler.Generate(rd, input) // TODO: dont pass the whole rule but a closure
-			// fmt.Println("Finished processing file: ", mountedAt)
-			output <- rslt
 		}
+		output <- out
 	}
 }
 
-func collectResults(annots <-chan api.AnnotResult, out chan<- map[string][]api.AnnotResult) {
-	// TODO: make this less ugly
-	ret := map[string][]api.AnnotResult{}
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	m := &sync.Mutex{}
-	set := func(filename string, rslt api.AnnotResult) {
-		m.Lock()
-		defer m.Unlock()
-		_, exists := ret[filename]
-		if !exists {
-			ret[filename] = []api.AnnotResult{rslt}
-		} else {
-			// if rslt.QueuedAt.After(old.QueuedAt) {
-			ret[filename] = append(ret[filename], rslt)
-			// }
-		}
+// collectResults hands the results of every file to collect as soon as the file is done
+func collectResults(files <-chan FileResults, collect func(FileResults), done chan<- bool) {
+	for f := range files {
+		// fmt.Printf("Collecting %v\n", f.Path)
+		collect(f)
 	}
-	go func() { // this is unnecessary
-		defer wg.Done()
-		for an := range annots {
-			// fmt.Printf("Collecting %v\n", an.Path)
-			config := an.GetConfig()
-			set(config.Path, an)
-		}
-	}()
-	wg.Wait()
-	out <- ret
+	done <- true
 }
 
 func GetChangedProps(a, b interface{}) ([]string, []diff.Change, error) {
@@ -134,22 +125,35 @@ func GetChangedProps(a, b interface{}) ([]string, []diff.Change, error) {
 	return ret, ret2, nil
 }
 
+// byPriority orders the results so that the ones of higher priority rules come first, ties keep their order
+func byPriority(results []api.AnnotResult) []api.AnnotResult {
+	sorted := append([]api.AnnotResult{}, results...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetConfig().Priority > sorted[j].GetConfig().Priority
+	})
+	return sorted
+}
+
 // TODO: this is ugly and it loses metadata
 func CombineResultChangesets(results []api.AnnotResult) (map[string]string, error) {
 	valmap := map[string]string{}
-	for i, res := range results {
+	priorities := map[string]int{}
+	for i, res := range byPriority(results) {
 		cur, err := api.ToChangeset(res)
 		if err != nil {
 			return nil, err
 		}
+		priority := res.GetConfig().Priority
 		for key, val := range cur {
-			_, exists := valmap[key]
-			if exists {
-				fmt.Printf("Error: cannot flatten duplicate property %v in result #%d: %+v\n", key, i, cur)
-				// return nil, err
+			// the value of the higher priority rule wins
+			if p, exists := priorities[key]; exists {
+				if p == priority {
+					fmt.Printf("Error: cannot flatten duplicate property %v in result #%d: %+v\n", key, i, cur)
+				}
 				continue
 			}
 			valmap[key] = val
+			priorities[key] = priority
 		}
 	}
 	return valmap, nil
@@ -174,93 +178,21 @@ func FilterSignificantProps(results []api.AnnotResult) func([]string) []string {
 	}
 }
 
+// CombineResults converts the results into rule results, a tag is only stored for the highest priority
+// result that has it so that the stored tags agree with CombineResultChangesets
 func CombineResults(results []api.AnnotResult) []*api.RuleResults {
 	ret := []*api.RuleResults{}
-	for _, res := range results {
-		ret = append(ret, api.ToRuleResult(res)...)
-	}
-	return ret
-}
-
-func GenerateChangelist(scan int, oldFiles []api.FileHistory, curFiles map[string][]api.AnnotResult) ([]api.FileHistory, error) {
-	old := mapset.NewSet()
-	cur := mapset.NewSet()
-	oldmap := map[string]*api.FileHistory{}
-	for i, r := range oldFiles {
-		if !old.Add(r.Filename) {
-			println("Duplicate filename found in old files, using first record: ", r.Filename)
-		}
-		oldmap[r.Filename] = &oldFiles[i]
-	}
-	for fn := range curFiles {
-		cur.Add(fn)
-	}
-
-	deleted := old.Difference(cur)
-	created := cur.Difference(old)
-	modified := mapset.NewSet()
-	// unchanged := mapset.NewSet()
-	for fni := range old.Intersect(cur).Iter() {
-		fn := fni.(string)
-		curResults, err := CombineResultChangesets(curFiles[fn])
-		if err != nil {
-			return nil, err
-		}
-		leaveSignificant := FilterSignificantProps(curFiles[fn])
-		// TODO: respect RuleID and Priority when overwriting values
-		oldResults := map[string]string{}
-		for _, rr := range oldmap[fn].RuleResults {
-			oldResults[*rr.Tag] = *rr.Value
-		}
-		changedProps, to, err := GetChangedProps(oldResults, curResults)
-		if err != nil {
-			println(err)
-			print(to)
-			continue // don't mark errors as modified as that will flood the database with bogus modifications (TODO: allow for error type)
-		}
-		signProps := leaveSignificant(changedProps)
-		if len(changedProps) > 0 && len(signProps) > 0 {
-			modified.Add(fn)
-		} else {
-			// unchanged.Add(fn)
-		}
-	}
-
-		// TODO: only write meta when file is modified
-
-	ret := []api.FileHistory{}
-	allI := append(append(modified.ToSlice(), created.ToSlice()...), deleted.ToSlice()...)
-	// all := mapset.NewSet().Union(created).Union(deleted).Union(modified)
-	for _, fni := range allI {
-		fn := fni.(string)
-		item := api.FileHistory{
-			Filename:    fn,
-			ScanID:      scan,
-			RuleResults: nil,
-		}
-		// don't reuse old RuleResults
-		switch {
-		case created.Contains(fn):
-			item.Action = "C"
-			fmt.Printf("Created: %v\n", fn)
-			item.RuleResults = CombineResults(curFiles[fn])
-		case deleted.Contains(fn):
-			item.Action = "D"
-			fmt.Printf("Deleted: %v\n", fn)
-			item.PrevID = int(oldmap[fn].FileHistoryID) // TODO: remove PrevID altogether
-		case modified.Contains(fn):
-			item.Action = "M"
-			fmt.Printf("Modified: %v\n", fn)
-			item.PrevID = int(oldmap[fn].FileHistoryID)
-			item.RuleResults = CombineResults(curFiles[fn])
-		default:
-			// unchanged
-			continue
+	seen := map[string]bool{}
+	for _, res := range byPriority(results) {
+		for _, rr := range api.ToRuleResult(res) {
+			if seen[*rr.Tag] {
+				continue
+			}
+			seen[*rr.Tag] = true
+			ret = append(ret, rr)
 		}
-		ret = append(ret, item)
 	}
-	// TODO: return diff results
-	return ret, nil
+	return ret
 }
 
 type AppCredentials struct {
@@ -314,18 +246,18 @@ func mountPaths(paths []string, allowLocal bool, ac AppCredentials) (*map[string
 }
 
 
+// rule types that are defined in the rules table, the others only exist as local pseudo-rules
+var remoteRuleTypes = []string{"pathtags", "regex", "glob", "bundle", "exec"}
+
 // returns rules and corresponding rule_id
-func rulesGetRemote(gg *api.GamtracGql) []api.Rules {
+func rulesGetRemote(gg api.Store) []api.Rules {
 	// fetch rules from the database
-	remoteRules, err := gg.RunFetchRules()
+	remoteRules, err := gg.RunFetchRules(remoteRuleTypes)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Cannot read remote rules: %e\n", err)
 		return []api.Rules{}
 	}
-	// place ignored rules first so that they take precedence
-	sort.Slice(remoteRules, func(i, j int) bool {
-		return (remoteRules[i].Ignore == true) && (remoteRules[j].Ignore == false)
-	})
+	// ignore rules are split off by initRuleHandlers, the order of the others is decided by their priority
 	rrs := []api.Rules{}
 	for _, rule := range remoteRules {
 		// rm, err := rules.NewMatcher(rule.Rule)
@@ -374,40 +306,87 @@ func GetLocalPathTags() ([]api.Rules) {
 }
 
 
-func triggerScan(remotePaths []string, ac AppCredentials) (int, error) {
+func newGamtracGql(ac AppCredentials) *api.GamtracGql {
 	timeout, err := strconv.ParseUint(os.Getenv("GAMTRAC_GQL_TIMEOUT"), 10, 32)
 	if err != nil || timeout < 0 {
 		timeout = 10000
 	}
 	gg := api.NewGamtracGql(ac.gqlEndpoint, uint32(timeout), os.Getenv("GAMTRAC_DEBUG_GQL") > "0")
-	// import (prisma "gamtrac/prisma/generated/prisma-client")
-	// import "context"
-	// ctx := context.Background()
-	// db := prisma.New(&prisma.Options{
-	// 	Endpoint: ac.gqlEndpoint,
-	// })
-	// rev1, err := db.CreateScan(prisma.ScanCreateInput{}).Exec(ctx)
-	// println(rev1)
-
-	paths, unmountAll, err := mountPaths(remotePaths, os.Getenv("GAMTRAC_ALLOW_LOCAL") > "0", ac)
-	defer unmountAll()
-	if err != nil {
-		return -1, err
+	if batchSize, err := strconv.Atoi(os.Getenv("GAMTRAC_GQL_BATCH_SIZE")); err == nil && batchSize > 0 {
+		gg.BatchSize = batchSize
 	}
+	if retries, err := strconv.Atoi(os.Getenv("GAMTRAC_GQL_RETRIES")); err == nil && retries >= 0 {
+		gg.Retries = retries
+	}
+	return gg
+}
 
-	rev, err := gg.RunCreateScan()
+// newStore returns the local store in GAMTRAC_LOCAL_STORE when it is set, so that scans can run
+// without the server and be pushed to it later, and the server otherwise
+func newStore(ac AppCredentials) (api.Store, error) {
+	dir := os.Getenv("GAMTRAC_LOCAL_STORE")
+	if dir == "" {
+		return newGamtracGql(ac), nil
+	}
+	ls, err := api.OpenLocalStore(dir)
 	if err != nil {
-		return -1, err
+		return nil, fmt.Errorf("cannot open the local store %v:\n%v", dir, err)
+	}
+	if batchSize, err := strconv.Atoi(os.Getenv("GAMTRAC_GQL_BATCH_SIZE")); err == nil && batchSize > 0 {
+		ls.BatchSize = batchSize
 	}
-	fmt.Printf("Scan %v\n\n", *rev)
-	oldFiles, err := gg.RunFetchFiles()
+	fmt.Printf("Writing scans to the local store %v\n", dir)
+	return ls, nil
+}
 
-	ruleHandlers := map[string]RuleResultGenerator{
+func newRuleHandlers() map[string]RuleResultGenerator {
+	// template, regex and glob rules compete for the best match, so they share a handler
+	pathTags := &PathTagsHandler{}
+	return map[string]RuleResultGenerator{
 		"wsp":       &MagellanWspHandler{},
 		"fileprops": &FilePropsHandler{},
-		"pathtags":  &PathTagsHandler{}, // TODO: this is broken and will fail
+		"docmeta":   &DocMetaHandler{},
+		"pathtags":  pathTags,
+		"regex":     pathTags,
+		"glob":      pathTags,
+		"bundle":    &BundleHandler{},
+		"links":     &LinksHandler{},
+		"exec":      &ExecHandler{},
+	}
+}
+
+// initRuleHandlers creates the handlers for a scan and initialises each of them once with all of its rules,
+// ignore rules don't produce results and are returned separately
+func initRuleHandlers(allRules []api.Rules) ([]RuleResultGenerator, *IgnoreRules, error) {
+	ignore, ruleDefs := splitIgnoreRules(allRules)
+	byType := newRuleHandlers()
+	handlers := []RuleResultGenerator{}
+	grouped := map[RuleResultGenerator][]api.Rules{}
+	for _, rd := range ruleDefs {
+		handler, ok := byType[rd.RuleType]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown rule type %v for ruleID %v\n", rd.RuleType, rd.RuleID)
+			continue
+		}
+		if _, exists := grouped[handler]; !exists {
+			handlers = append(handlers, handler)
+		}
+		grouped[handler] = append(grouped[handler], rd)
 	}
+	for _, handler := range handlers {
+		if err := handler.Init(grouped[handler]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return handlers, ignore, nil
+}
+
+func loadRuleDefs(gg api.Store) []api.Rules {
+	return append(localRuleDefs(), rulesGetRemote(gg)...)
+}
 
+// localRuleDefs are the path rules of testdata.csv along with the pseudo-rules of the local handlers
+func localRuleDefs() []api.Rules {
 	localRules := GetLocalPathTags()
 	localRules = append(localRules, api.Rules{
 		RuleID:      -1,
@@ -417,18 +396,43 @@ func triggerScan(remotePaths []string, ac AppCredentials) (int, error) {
 		RuleID:      -1,
 		Ignore:      false,
 		RuleType:    "wsp",
+	}, api.Rules{
+		RuleID:      -1,
+		Ignore:      false,
+		RuleType:    "links",
+	}, api.Rules{
+		RuleID:      -1,
+		Ignore:      false,
+		RuleType:    "docmeta",
 	})
-	remoteRules := rulesGetRemote(gg)
-	ruleDefs := append(localRules, remoteRules...)
-	// TODO: initialize RuleResultGenerators
-	// if len(ruleMatchers) == 0 {
-	// 	err = fmt.Errorf("failed to load at least one rule")
-	// 	return *rev, (err)
-	// }
+	return localRules
+}
 
+// translatePath maps a path below the mounted dir of root back to its destination
+func translatePath(root MountedPath, path string, isDir bool) (MountedPath, error) {
+	relpath, err := filepath.Rel(root.MountedAt, path)
+	if err != nil {
+		return MountedPath{}, err
+	}
+	destpath := filepath.Join(root.Destination, relpath)
+	// slashes look hella weird with this but this is needed to normalize rules
+	destpath = filepath.ToSlash(destpath)
+	// append a slash at the end of directories
+	if isDir && !strings.HasSuffix(destpath, "/") {
+		destpath = destpath + "/"
+	}
+	return MountedPath{
+		Destination: destpath,
+		MountedAt:   path,
+		Mounted:     false,
+		Principal:   root.Principal,
+	}, nil
+}
+
+// annotateFiles runs every item produced by feed through the worker pool, collect is called from a single goroutine
+func annotateFiles(feed func(inputs chan<- AnnotItem), collect func(FileResults)) {
 	inputs := make(chan AnnotItem)
-	output := make(chan api.AnnotResult)
-	// errorsChan := make(chan FileError)
+	output := make(chan FileResults)
 
 	wg := &sync.WaitGroup{}
 	numWorkers := runtime.NumCPU()
@@ -438,67 +442,431 @@ func triggerScan(remotePaths []string, ac AppCredentials) (int, error) {
 		go processFile(inputs, output, wg)
 	}
 
-	done := make(chan map[string][]api.AnnotResult)
-	// launch final map collector
-	go collectResults(output, done)
+	done := make(chan bool)
+	// launch final collector
+	go collectResults(output, collect, done)
+
+	feed(inputs)
+
+	close(inputs)
+	wg.Wait()
+	close(output)
+	<-done
+}
+
+// annotateAll is annotateFiles for small batches, it keeps all results in memory
+func annotateAll(feed func(inputs chan<- AnnotItem)) map[string][]api.AnnotResult {
+	ret := map[string][]api.AnnotResult{}
+	annotateFiles(feed, func(f FileResults) {
+		ret[f.Path] = append(ret[f.Path], f.Results...)
+	})
+	return ret
+}
+
+// dbWriteLock keeps the periodic scans and the watcher from writing file history at the same time
+var dbWriteLock sync.Mutex
+
+// scanErrorsOf collects the errors of the results of a single file
+func scanErrorsOf(scan int, results []api.AnnotResult) []api.ScanErrors {
+	errs := []api.ScanErrors{}
+	for _, r := range results {
+		errs = append(errs, api.ToScanErrors(scan, r)...)
+	}
+	return errs
+}
+
+// writeScanErrors stores the errors so that failing files show up in the UI
+func writeScanErrors(gg api.Store, errs []api.ScanErrors) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	if err := gg.RunInsertScanErrors(errs); err != nil {
+		return fmt.Errorf("cannot write scan errors to server:\n%v", err)
+	}
+	return nil
+}
+
+func writeChangelist(gg api.Store, changes []api.FileHistory) error {
+	newFileIds, err := gg.RunInsertFileHistory(changes)
+	if err != nil {
+		return fmt.Errorf("cannot update files on server:\n%v", err)
+	}
+	if len(newFileIds) != len(changes) {
+		return fmt.Errorf("invalid number of file records inserted: expected %v, got %v", len(changes), len(newFileIds))
+	}
+	return nil
+}
+
+func writeMetaUpdates(gg api.Store, updates []api.MetaUpdate) error {
+	if err := gg.RunUpdateMeta(updates); err != nil {
+		return fmt.Errorf("cannot update meta tags on server:\n%v", err)
+	}
+	return nil
+}
+
+// findResumableScan returns the latest interrupted scan that got far enough to leave checkpoints,
+// the other interrupted scans are marked abandoned
+func findResumableScan(gg api.Store) *api.Scans {
+	scans, err := gg.RunFetchUnfinishedScans()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot fetch unfinished scans: %v\n", err)
+		return nil
+	}
+	var resume *api.Scans
+	for i := range scans {
+		if resume == nil && len(scans[i].ScanCheckpoints) > 0 {
+			resume = &scans[i]
+			continue
+		}
+		fmt.Printf("Abandoning interrupted scan %v\n", scans[i].ScanID)
+		if _, err := gg.RunFinishScan(scans[i].ScanID, "abandoned"); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot abandon scan %v: %v\n", scans[i].ScanID, err)
+		}
+	}
+	return resume
+}
+
+// nextScanKind decides from the stored scans whether the next scan is a full or an incremental one,
+// so that restarting the scanner doesn't start the count of incremental scans over
+func nextScanKind(gg api.Store, incremental bool, fullEvery int) string {
+	if !incremental {
+		return api.ScanFull
+	}
+	since, err := gg.RunCountScansSinceFull()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot fetch the scans since the last full scan, running a full one: %v\n", err)
+		return api.ScanFull
+	}
+	if since == nil || (fullEvery > 0 && *since+1 >= fullEvery) {
+		return api.ScanFull
+	}
+	return api.ScanIncremental
+}
+
+// triggerScan runs a new scan of the given kind, or continues the interrupted scan resume from its
+// checkpoints as the kind it was started as
+func triggerScan(reg *EndpointRegistry, gg api.Store, kind string, resume *api.Scans) (int, error) {
+	// import (prisma "gamtrac/prisma/generated/prisma-client")
+	// import "context"
+	// ctx := context.Background()
+	// db := prisma.New(&prisma.Options{
+	// 	Endpoint: ac.gqlEndpoint,
+	// })
+	// rev1, err := db.CreateScan(prisma.ScanCreateInput{}).Exec(ctx)
+	// println(rev1)
+
+	// endpoints are reloaded on every scan so that shares can be added without a restart
+	endpoints, err := gg.RunFetchEndpoints()
+	if err != nil {
+		return -1, fmt.Errorf("cannot fetch endpoints from server:\n%v", err)
+	}
+	paths := reg.Sync(endpoints)
+	if len(paths) == 0 {
+		return -1, fmt.Errorf("no endpoints to scan")
+	}
+
+	var rev int
+	if resume != nil {
+		rev, kind = resume.ScanID, resume.Kind
+		fmt.Printf("Resuming scan %v\n\n", rev)
+	} else {
+		newRev, err := gg.RunCreateScan(kind)
+		if err != nil {
+			return -1, err
+		}
+		rev = *newRev
+		fmt.Printf("Scan %v\n\n", rev)
+	}
+	if err := scanPaths(gg, rev, paths, kind == api.ScanIncremental, newResumePoints(resume)); err != nil {
+		// a scan that failed is not resumed, the next one starts over
+		if _, ferr := gg.RunFinishScan(rev, "failed"); ferr != nil {
+			fmt.Fprintf(os.Stderr, "Cannot mark scan %v as failed: %v\n", rev, ferr)
+		}
+		return rev, err
+	}
+	scanInfo, err := gg.RunFinishScan(rev, "completed")
+	if err != nil {
+		return rev, err
+	}
+	fmt.Printf("Finished scan #%v; inserted records: %v\n", rev, *scanInfo.FileHistoriesAggregate.Aggregate.Count)
+
+	return rev, nil
+}
+
+// scanPaths walks the endpoints and writes the changed files as part of the scan rev
+func scanPaths(gg api.Store, rev int, paths map[string]MountedPath, incremental bool, resume resumePoints) error {
+	ruleHandlers, ignore, err := initRuleHandlers(loadRuleDefs(gg))
+	if err != nil {
+		return err
+	}
 
-	// feed the worker queue with files
-	for _, p := range *paths {
-		filepath.Walk(p.MountedAt, func(path string, f os.FileInfo, err error) error {
-			// path translation from destination to mounted dir
-			// TODO: propagate errors throught to the DB
+	// records are written in batches while the walk is still running, so a large share
+	// doesn't have to be kept in memory and a crash loses at most one batch.
+	// The old records are fetched one directory at a time, the files of a directory that are
+	// not in its listing are gone and kept by the builder until the renames are known.
+	b := NewChangelistBuilder(rev, func(hashes []string) (map[string]bool, error) {
+		found, err := gg.RunFetchKnownHashes(hashes)
+		if err != nil {
+			return nil, err
+		}
+		known := map[string]bool{}
+		for _, h := range found {
+			known[h] = true
+		}
+		return known, nil
+	})
+	// gone folders take everything below them along
+	markGone := func(old *api.FileHistory) error {
+		b.Gone(old)
+		if !strings.HasSuffix(old.Filename, "/") {
+			return nil
+		}
+		below, err := gg.RunFetchFilesByName(nil, []string{old.Filename})
+		if err != nil {
+			return fmt.Errorf("cannot fetch files of %v from server:\n%v", old.Filename, err)
+		}
+		for i := range below {
+			b.Gone(&below[i])
+		}
+		return nil
+	}
+	// bundle folders are only written at the end, if the scan is interrupted before that they are
+	// picked up by the next scan like the renames
+	bundles := newBundleFolders(ruleHandlers)
+	progress := newWalkProgress()
+	pending, pendingErrs := []api.FileHistory{}, []api.ScanErrors{}
+	pendingMeta := []api.MetaUpdate{}
+	// a resumed scan doesn't know what it wrote before it was interrupted, it refreshes all links
+	var changed *linkChanges
+	if len(resume) == 0 {
+		changed = newLinkChanges()
+	}
+	var writeErr error
+	aborted := make(chan struct{})
+	flush := func() {
+		if writeErr != nil {
+			return
+		}
+		// the created files whose contents are not stored yet can't be renames
+		created, err := b.Settle()
+		if err != nil {
+			writeErr = err
+			close(aborted)
+			return
+		}
+		pending = append(pending, created...)
+		if changed != nil {
+			changed.add(pending)
+		}
+		dbWriteLock.Lock()
+		defer dbWriteLock.Unlock()
+		if err := writeChangelist(gg, pending); err != nil {
+			writeErr = err
+		} else if err := writeMetaUpdates(gg, pendingMeta); err != nil {
+			writeErr = err
+		} else if err := writeScanErrors(gg, pendingErrs); err != nil {
+			writeErr = err
+		} else if err := gg.RunSaveScanCheckpoints(progress.Checkpoints(rev)); err != nil {
+			// the records are written, losing a checkpoint only means more work after a restart
+			fmt.Fprintf(os.Stderr, "Cannot save checkpoints of scan %v: %v\n", rev, err)
+		}
+		if writeErr != nil {
+			close(aborted)
+		}
+		pending, pendingErrs = []api.FileHistory{}, []api.ScanErrors{}
+		pendingMeta = []api.MetaUpdate{}
+	}
+	isAborted := func() bool {
+		select {
+		case <-aborted:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var listErr error
+	annotateFiles(func(inputs chan<- AnnotItem) {
+		// feed the worker queue with files
+		// endpoints are walked in a fixed order so that the checkpoints of a resumed scan line up
+		for _, k := range endpointKeys(paths) {
+			p := paths[k]
+			if isAborted() {
+				return
+			}
+			root, err := translatePath(p, p.MountedAt, true)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: %e\n", err)
-				return err
+				listErr = err
+				return
 			}
-			relpath, err := filepath.Rel(p.MountedAt, path)
+			rootPrev, err := gg.RunFetchFilesByName([]string{root.Destination}, nil)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: %e\n", err)
-				return err
+				listErr = fmt.Errorf("cannot fetch files from server:\n%v", err)
+				return
 			}
-			destpath := filepath.Join(p.Destination, relpath)
-			// slashes look hella weird with this but this is needed to normalize rules
-			destpath = filepath.ToSlash(destpath)
-			// append a slash at the end of directories
-			if f.IsDir() && !strings.HasSuffix(destpath, "/") {
-				destpath = destpath + "/"
+			// the old records of the directories being walked, by mounted dir and destination
+			open := map[string]map[string]*api.FileHistory{}
+			prevOf := func(path, dest string) *api.FileHistory {
+				if path == p.MountedAt {
+					if len(rootPrev) > 0 {
+						return &rootPrev[0]
+					}
+					return nil
+				}
+				return open[filepath.Dir(path)][dest]
 			}
-			mp := MountedPath{
-				Destination: destpath,
-				MountedAt:   path,
-				Mounted:     false,
+			list := func(dir string, entries []os.FileInfo) error {
+				mp, err := translatePath(p, dir, true)
+				if err != nil {
+					return err
+				}
+				stored, err := gg.RunFetchFilesIn(mp.Destination)
+				if err != nil {
+					return fmt.Errorf("cannot fetch files of %v from server:\n%v", mp.Destination, err)
+				}
+				present := map[string]bool{}
+				for _, entry := range entries {
+					emp, err := translatePath(p, filepath.Join(dir, entry.Name()), entry.IsDir())
+					if err == nil && !ignore.Ignored(withOwner(emp, entry)) {
+						present[emp.Destination] = true
+					}
+				}
+				old := map[string]*api.FileHistory{}
+				for i := range stored {
+					if present[stored[i].Filename] {
+						old[stored[i].Filename] = &stored[i]
+					} else if err := markGone(&stored[i]); err != nil {
+						return err
+					}
+				}
+				open[dir] = old
+				return nil
 			}
-			inputs <- AnnotItem{path: mp, fileInfo: f, queuedAt: time.Now(), handlers: ruleHandlers, ruleDefs: ruleDefs}
-			return nil
-		})
+			leave := func(dir string) {
+				delete(open, dir)
+			}
+			err = walkTree(p.MountedAt, func(path string, f os.FileInfo, walkErr error) error {
+				if isAborted() {
+					return fmt.Errorf("scan aborted")
+				}
+				// path translation from destination to mounted dir
+				// unreadable entries are reported and skipped, the walk won't descend into unreadable dirs
+				isDir := f == nil || f.IsDir()
+				mp, err := translatePath(p, path, isDir)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %e\n", err)
+					return nil
+				}
+				if f != nil {
+					mp = withOwner(mp, f)
+				}
+				if skip, skipDir := resume.Skip(k, mp.Destination, isDir); skipDir && walkErr == nil {
+					return filepath.SkipDir
+				} else if skip {
+					return nil
+				}
+				// ignored files are not tracked at all, an ignored folder hides everything below it
+				if ignore.Ignored(mp) {
+					if isDir && walkErr == nil {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				seq := progress.Queue(k, mp.Destination)
+				if walkErr != nil {
+					inputs <- AnnotItem{path: mp, fileInfo: f, queuedAt: time.Now(), err: walkErr, seq: seq}
+					return nil
+				}
+				inputs <- AnnotItem{path: mp, fileInfo: f, queuedAt: time.Now(), handlers: ruleHandlers, prev: prevOf(path, mp.Destination), ignore: ignore, reuse: incremental, seq: seq}
+				return nil
+			}, list, leave)
+			if err != nil && !isAborted() {
+				listErr = err
+				return
+			}
+		}
+	}, func(f FileResults) {
+		if writeErr != nil {
+			return
+		}
+		pendingErrs = append(pendingErrs, scanErrorsOf(rev, f.Results)...)
+		if bundles.Hold(f) {
+			progress.Done(f.seq)
+			return
+		}
+		change, err := b.Add(f.Path, f.prev, f.Results)
+		if err != nil {
+			writeErr = err
+			close(aborted)
+			return
+		}
+		if change != nil {
+			pending = append(pending, *change)
+		}
+		pendingMeta = append(pendingMeta, b.TakeMetaUpdates()...)
+		// files held back for rename detection are only written at the end, if the scan is
+		// interrupted before that they are picked up by the next scan
+		progress.Done(f.seq)
+		if len(pending) >= gg.WriteBatchSize() || len(pendingErrs) >= gg.WriteBatchSize() || len(pendingMeta) >= gg.WriteBatchSize() || b.Undecided() >= gg.WriteBatchSize() {
+			flush()
+		}
+	})
+	if writeErr != nil {
+		return writeErr
 	}
-
-	close(inputs)
-	wg.Wait()
-	close(output)
-	rslt := <-done
-	changes, err := GenerateChangelist(int(*rev), oldFiles, rslt)
+	if listErr != nil {
+		return listErr
+	}
+	for _, f := range bundles.Checked() {
+		change, err := b.Add(f.Path, f.prev, f.Results)
+		if err != nil {
+			return err
+		}
+		if change != nil {
+			pending = append(pending, *change)
+		}
+	}
+	pendingMeta = append(pendingMeta, b.TakeMetaUpdates()...)
+	// renames and deletions are only known once every file has been seen
+	rest, err := b.Finish()
 	if err != nil {
-		return *rev, err
+		return err
 	}
-
-	newFileIds, err := gg.RunInsertFileHistory(changes)
+	pending = append(pending, rest...)
+	flush()
+	if writeErr != nil {
+		return writeErr
+	}
+	// the renamed files are gone from their old names as well
+	if changed != nil {
+		for _, fn := range b.GoneFiles() {
+			changed.gone[fn] = true
+		}
+	}
+	// links can point anywhere in the scanned endpoints, so they are resolved against the stored files
+	// once everything is written
+	sampleID, err := sampleIDPattern()
 	if err != nil {
-		return *rev, fmt.Errorf("cannot update files on server:\n%v", err)
+		return err
 	}
-	if len(newFileIds) != len(changes) {
-		return *rev, fmt.Errorf("invalid number of file records inserted: expected %v, got %v", len(changes), len(newFileIds))
+	roots := []string{}
+	for _, k := range endpointKeys(paths) {
+		p := paths[k]
+		root, err := translatePath(p, p.MountedAt, true)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, root.Destination)
 	}
+	links, err := refreshLinks(gg, rev, roots, changed, sampleID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Found %v file links\n", links)
 	// for _, nf := range fileIds {
 	// 	fmt.Printf("%6d| %v\n\n", nf.FileHistoryID, nf.Filename)
 	// }
-	scanInfo, err := gg.RunFinishScan(*rev)
-	if err != nil {
-		return *rev, err
-	}
-	fmt.Printf("Finished scan #%v; inserted records: %v\n", *rev, *scanInfo.FileHistoriesAggregate.Aggregate.Count)
-
-	return *rev, nil
+	return writeErr
 }
 
 func fetchDomainUsers(ac AppCredentials) ([]api.DomainUsers, error) {
@@ -555,21 +923,78 @@ func updateDomainUsers(gg *api.GamtracGql, ac AppCredentials) {
 func main() {
 	ac := AppCredentials{}.FromEnv()
 	// fetchDomainUsers(ac)
+	if handled, err := runSnapshotCommand(os.Args[1:], ac); handled {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if handled, err := runSyncCommand(os.Args[1:], ac); handled {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	revDelay := os.Getenv("GAMTRAC_SCAN_DELAY")
 	delay, err := strconv.Atoi(revDelay)
 	if err != nil || delay < 0 {
 		delay = 10
 	}
 
-	argPaths := os.Args[1:]
+	// incremental scans only rerun the handlers for files whose size or mtime changed,
+	// every n-th scan is still a full one so that rule changes reach the unchanged files
+	incremental := os.Getenv("GAMTRAC_INCREMENTAL_SCAN") > "0"
+	fullEvery, err := strconv.Atoi(os.Getenv("GAMTRAC_FULL_SCAN_EVERY"))
+	if err != nil || fullEvery < 0 {
+		fullEvery = 0
+	}
+
+	// paths given on the command line are always scanned in addition to the endpoints table
+	reg := NewEndpointRegistry(os.Args[1:], os.Getenv("GAMTRAC_ALLOW_LOCAL") > "0", ac)
+	defer reg.UnmountAll()
+
+	// in watch mode the periodic scans only reconcile what the watcher missed, so they can be rare
+	watch := os.Getenv("GAMTRAC_WATCH") > "0"
+	if watch {
+		reconcileDelay, err := strconv.Atoi(os.Getenv("GAMTRAC_RECONCILE_DELAY"))
+		if err != nil || reconcileDelay < 0 {
+			reconcileDelay = 3600
+		}
+		delay = reconcileDelay
+	}
+	var stopWatch chan struct{}
+	watched := ""
+
+	store, err := newStore(ac)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// a scan left running by a previous run of the scanner is continued where it stopped
+	resume := findResumableScan(store)
 
 	for {
-		rev, err := triggerScan(argPaths, ac)
+		rev, err := triggerScan(reg, store, nextScanKind(store, incremental, fullEvery), resume)
+		resume = nil
 		if err != nil {
 			fmt.Printf("Could not finish scan %v: %v\n", rev, err)
 		} else {
 			fmt.Printf("Scan %v created successfully\n", rev)
 		}
+		// restart the watcher whenever the set of endpoints changes
+		if cur := reg.Current(); watch && strings.Join(endpointKeys(cur), "\n") != watched {
+			if stopWatch != nil {
+				close(stopWatch)
+			}
+			stopWatch = make(chan struct{})
+			watched = strings.Join(endpointKeys(cur), "\n")
+			go func(roots map[string]MountedPath, stop chan struct{}) {
+				err := watchPaths(roots, store, stop)
+				fmt.Printf("Stopped watching for changes: %v\n", err)
+			}(cur, stopWatch)
+		}
 		time.Sleep(time.Second * time.Duration(delay))
 	}
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"gamtrac/api"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// hashAlgorithms are the full-content digests a policy can choose from. There is no blake3: no Go
+// module for it is available to the offline build and the module still targets go 1.12, so xxhash
+// covers the fast case instead.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"xxhash": func() hash.Hash { return xxhash.New() },
+}
+
+// hasher computes the digest of a file with one of the hashAlgorithms. A quick hasher only reads
+// the first and the last quick bytes along with the size, which is enough to tell instrument files apart
+// without reading gigabytes over the network.
+type hasher struct {
+	name    string // recorded in HashDigest.Algorithm, includes the quick size since it changes the value
+	newHash func() hash.Hash
+	quick   int64
+}
+
+// newHasher parses an algorithm like `sha256`, `xxhash` or `quick-xxhash`, `none` disables hashing
+func newHasher(spec string, quickMiB int) (*hasher, error) {
+	if spec == "none" {
+		return nil, nil
+	}
+	name := strings.TrimPrefix(spec, "quick-")
+	newHash, ok := hashAlgorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %v", spec)
+	}
+	if name == spec {
+		return &hasher{name: name, newHash: newHash}, nil
+	}
+	return &hasher{
+		name:    fmt.Sprintf("quick%dm-%s", quickMiB, name),
+		newHash: newHash,
+		quick:   int64(quickMiB) * 1024 * 1024,
+	}, nil
+}
+
+func (hs *hasher) Hash(path string) (*HashDigest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := hs.newHash()
+	if hs.quick == 0 {
+		reader := bufio.NewReaderSize(f, 4*1024*1024) // larger transfers are faster
+		if _, err := io.Copy(h, reader); err != nil {
+			return nil, err
+		}
+		return &HashDigest{Value: h.Sum(nil), Algorithm: hs.name}, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if _, err := io.CopyN(h, f, min64(size, hs.quick)); err != nil {
+		return nil, err
+	}
+	// the tail doesn't overlap the head, small files are read once
+	if tail := size - hs.quick; tail > 0 {
+		if _, err := f.Seek(-min64(tail, hs.quick), io.SeekEnd); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(h, f, min64(tail, hs.quick)); err != nil {
+			return nil, err
+		}
+	}
+	binary.Write(h, binary.LittleEndian, size)
+	return &HashDigest{Value: h.Sum(nil), Algorithm: hs.name}, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// hashPolicy decides how a file is hashed: by its extension, then by the longest destination prefix
+// of an endpoint, then the default. GAMTRAC_HASH_POLICY lists the exceptions, e.g.
+// `.raw=quick-xxhash,.tmp=none,R:/DAR/=xxhash`
+type hashPolicy struct {
+	def      *hasher
+	byExt    map[string]*hasher
+	prefixes []string // longest first
+	byPrefix map[string]*hasher
+}
+
+func hashPolicyFromEnv() (*hashPolicy, error) {
+	quickMiB, err := strconv.Atoi(os.Getenv("GAMTRAC_QUICK_HASH_MIB"))
+	if err != nil || quickMiB <= 0 {
+		quickMiB = 4
+	}
+	p := &hashPolicy{byExt: map[string]*hasher{}, byPrefix: map[string]*hasher{}}
+	// hashing stays off unless it is switched on, the algorithm defaults to sha256
+	if os.Getenv("GAMTRAC_HASH_FILE_CONTENTS") > "0" {
+		def := os.Getenv("GAMTRAC_HASH_ALGORITHM")
+		if def == "" {
+			def = "sha256"
+		}
+		if p.def, err = newHasher(def, quickMiB); err != nil {
+			return nil, fmt.Errorf("invalid GAMTRAC_HASH_ALGORITHM: %v", err)
+		}
+	}
+	for _, entry := range strings.Split(os.Getenv("GAMTRAC_HASH_POLICY"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid GAMTRAC_HASH_POLICY entry `%v`", entry)
+		}
+		key := strings.TrimSpace(kv[0])
+		hs, err := newHasher(strings.TrimSpace(kv[1]), quickMiB)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GAMTRAC_HASH_POLICY entry `%v`: %v", entry, err)
+		}
+		if strings.HasPrefix(key, ".") {
+			p.byExt[strings.ToLower(key)] = hs
+		} else {
+			p.byPrefix[key] = hs
+			p.prefixes = append(p.prefixes, key)
+		}
+	}
+	sort.Slice(p.prefixes, func(i, j int) bool { return len(p.prefixes[i]) > len(p.prefixes[j]) })
+	return p, nil
+}
+
+// For returns the hasher of the file at the destination path, nil if it is not hashed
+func (p *hashPolicy) For(path string) *hasher {
+	if hs, ok := p.byExt[strings.ToLower(filepath.Ext(path))]; ok {
+		return hs
+	}
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return p.byPrefix[prefix]
+		}
+	}
+	return p.def
+}
+
+// computeHash hashes the file unless the last record of an unchanged file already has a digest of the same
+// algorithm, so only new and modified files are read in full
+func computeHash(hs *hasher, input AnnotItem) (*HashDigest, error) {
+	if hs == nil {
+		return nil, nil
+	}
+	if input.prev != nil && api.StoredPropsMatch(input.prev, input.fileInfo) {
+		if stored := api.StoredHash(input.prev); stored != nil && stored.Algorithm == hs.name {
+			return stored, nil
+		}
+	}
+	return hs.Hash(input.path.MountedAt)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gamtrac/api"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tealeg/xlsx"
+)
+
+const (
+	maxLinkFileSize = 64 * 1024 * 1024 // larger files are not searched for references
+	maxLinkRefs     = 1000             // references kept per file
+	maxLinkTargets  = 20               // a reference matching more files than this is too vague to link
+)
+
+var (
+	// absolute windows paths, either with a drive letter or a share, up to the end of the line or a quote
+	windowsPathRe = regexp.MustCompile(`(?:[A-Za-z]:|\\\\[^\\/\s"]+)[\\/][^\t\r\n"<>|*?]*`)
+	// filenames with an extension mentioned anywhere in the text
+	fileNameRe = regexp.MustCompile(`[^\s"'<>|*?\\/:;,]+\.[A-Za-z][A-Za-z0-9]{1,4}\b`)
+)
+
+// LinksHandler finds the paths and sample IDs referenced by reports and tables,
+// the references are resolved against the scanned files once the scan is done
+type LinksHandler struct {
+	RuleResultGenerator
+	rule     api.Rules
+	sampleID *regexp.Regexp // nil when sample IDs are not looked for
+}
+
+func (h *LinksHandler) Init(rules []api.Rules) error {
+	var err error
+	h.rule, err = singleRule("links", rules)
+	if err != nil {
+		return err
+	}
+	h.sampleID, err = sampleIDPattern()
+	return err
+}
+
+// sampleIDPattern is the format of the sample IDs, e.g. `[A-Z]{2}-[0-9]{5}`, set by GAMTRAC_SAMPLE_ID_PATTERN
+func sampleIDPattern() (*regexp.Regexp, error) {
+	pattern := os.Getenv("GAMTRAC_SAMPLE_ID_PATTERN")
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GAMTRAC_SAMPLE_ID_PATTERN: %v", err)
+	}
+	return re, nil
+}
+
+func (h *LinksHandler) Generate(input AnnotItem) []api.AnnotResult {
+	if input.fileInfo.IsDir() || input.fileInfo.Size() > maxLinkFileSize {
+		return []api.AnnotResult{}
+	}
+	fn := input.path.MountedAt
+	destination := input.path.Destination
+	var refs []string
+	var err error
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".xlsx":
+		refs, err = xlsxRefs(fn, h.sampleID)
+	case ".csv":
+		refs, err = csvRefs(fn, h.sampleID)
+	case ".txt", ".asc":
+		// .asc are the plain text exports of Magellan
+		refs, err = textRefs(fn, h.sampleID)
+	default:
+		return []api.AnnotResult{}
+	}
+	if err != nil {
+		return []api.AnnotResult{api.NewErrorResult(h.rule.RuleID, destination, err)}
+	}
+	return newLinksResult(h.rule.RuleID, destination, refs)
+}
+
+// newLinksResult only creates a result for files that reference anything
+func newLinksResult(ruleID int, path string, refs []string) []api.AnnotResult {
+	if len(refs) == 0 {
+		return []api.AnnotResult{}
+	}
+	return []api.AnnotResult{&api.LinksResult{RuleID: ruleID, Path: path, LinkRefs: refs}}
+}
+
+// linkRefCollector gathers the distinct references in the order they are found
+type linkRefCollector struct {
+	sampleID *regexp.Regexp
+	seen     map[string]bool
+	refs     []string
+}
+
+func newLinkRefCollector(sampleID *regexp.Regexp) *linkRefCollector {
+	return &linkRefCollector{sampleID: sampleID, seen: map[string]bool{}, refs: []string{}}
+}
+
+func (c *linkRefCollector) add(ref string) {
+	ref = strings.Trim(ref, " \t'\"")
+	if ref == "" || c.seen[ref] || len(c.refs) >= maxLinkRefs {
+		return
+	}
+	c.seen[ref] = true
+	c.refs = append(c.refs, ref)
+}
+
+// cell takes a whole table cell, a cell holding a path usually holds nothing else
+func (c *linkRefCollector) cell(value string) {
+	value = strings.TrimSpace(value)
+	if strings.ContainsAny(value, "/\\") && !strings.ContainsAny(value, "\r\n") {
+		c.add(value)
+	} else {
+		c.text(value)
+	}
+}
+
+// text looks for paths, filenames and sample IDs in free text
+func (c *linkRefCollector) text(line string) {
+	for _, p := range windowsPathRe.FindAllString(line, -1) {
+		c.add(strings.TrimRight(p, " .,;"))
+	}
+	// the name at the end of a path is not another reference
+	rest := windowsPathRe.ReplaceAllString(line, " ")
+	for _, name := range fileNameRe.FindAllString(rest, -1) {
+		c.add(name)
+	}
+	if c.sampleID != nil {
+		for _, id := range c.sampleID.FindAllString(line, -1) {
+			c.add(id)
+		}
+	}
+}
+
+func xlsxRefs(fn string, sampleID *regexp.Regexp) ([]string, error) {
+	xf, err := xlsx.OpenFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	sheets, err := xf.ToSlice()
+	if err != nil {
+		return nil, err
+	}
+	c := newLinkRefCollector(sampleID)
+	for _, rows := range sheets {
+		for _, row := range rows {
+			for _, value := range row {
+				c.cell(value)
+			}
+		}
+	}
+	return c.refs, nil
+}
+
+func csvRefs(fn string, sampleID *regexp.Regexp) ([]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	r := csv.NewReader(reader)
+	// excel with a russian locale separates the columns with semicolons
+	if head, err := reader.Peek(4096); err == nil || err == io.EOF {
+		firstLine := strings.SplitN(string(head), "\n", 2)[0]
+		if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+			r.Comma = ';'
+		}
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	c := newLinkRefCollector(sampleID)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range record {
+			c.cell(value)
+		}
+	}
+	return c.refs, nil
+}
+
+func textRefs(fn string, sampleID *regexp.Regexp) ([]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	c := newLinkRefCollector(sampleID)
+	for scanner.Scan() {
+		c.text(scanner.Text())
+	}
+	return c.refs, scanner.Err()
+}
+
+// valueRefs finds references in values parsed by another handler, e.g. the sheets of a Magellan workspace
+func valueRefs(values map[string]string, sampleID *regexp.Regexp) []string {
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	c := newLinkRefCollector(sampleID)
+	for _, k := range keys {
+		c.cell(values[k])
+	}
+	return c.refs
+}
+
+// linkResolver finds the scanned files a reference points to
+type linkResolver struct {
+	byName   map[string][]string // lowercase basename => paths
+	bySample map[string][]string // sample ID => paths that have it in their name
+}
+
+func linkBaseName(path string) string {
+	return strings.ToLower(filepath.Base(filepath.FromSlash(strings.TrimSuffix(path, "/"))))
+}
+
+func newLinkResolver(paths []string, sampleID *regexp.Regexp) *linkResolver {
+	lr := &linkResolver{byName: map[string][]string{}, bySample: map[string][]string{}}
+	for _, p := range paths {
+		base := linkBaseName(p)
+		lr.byName[base] = append(lr.byName[base], p)
+		if sampleID != nil {
+			for _, id := range sampleID.FindAllString(filepath.Base(strings.TrimSuffix(p, "/")), -1) {
+				lr.bySample[id] = append(lr.bySample[id], p)
+			}
+		}
+	}
+	return lr
+}
+
+// resolve matches a path reference by its name and as many of its parent folders as possible,
+// so that both absolute paths of other mounts and relative paths find their file, and a sample ID
+// by the files named after it
+func (lr *linkResolver) resolve(ref string) []string {
+	norm := strings.ToLower(strings.TrimSuffix(strings.Replace(ref, "\\", "/", -1), "/"))
+	candidates := lr.byName[linkBaseName(norm)]
+	if samples, ok := lr.bySample[ref]; ok {
+		candidates = append(candidates, samples...)
+	}
+	if len(candidates) == 0 {
+		return []string{}
+	}
+	refParts := strings.Split(norm, "/")
+	best, ret := 0, []string{}
+	for _, c := range candidates {
+		n := commonSuffix(refParts, strings.Split(strings.ToLower(strings.TrimSuffix(c, "/")), "/"))
+		if n > best {
+			best, ret = n, []string{}
+		}
+		if n == best {
+			ret = append(ret, c)
+		}
+	}
+	if len(ret) > maxLinkTargets {
+		return []string{}
+	}
+	return ret
+}
+
+// commonSuffix counts the trailing path components a and b have in common
+func commonSuffix(a, b []string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	return n
+}
+
+// storedLinkRefs returns the references stored with a file in its LinkRefs tag
+func storedLinkRefs(fh *api.FileHistory) []string {
+	for _, rr := range fh.RuleResults {
+		if rr == nil || rr.Tag == nil || *rr.Tag != "LinkRefs" || rr.Value == nil {
+			continue
+		}
+		refs := []string{}
+		if err := json.Unmarshal([]byte(*rr.Value), &refs); err == nil {
+			return refs
+		}
+	}
+	return []string{}
+}
+
+// resolveLinks turns the references of the files into links to the stored files, the files a reference
+// may point to are looked up by their names
+func resolveLinks(gg api.Store, scan int, refs map[string][]string, sampleID *regexp.Regexp) ([]api.FileLinks, error) {
+	names, parts := []string{}, []string{}
+	seen := map[string]bool{}
+	sources := []string{}
+	for source, sourceRefs := range refs {
+		sources = append(sources, source)
+		for _, ref := range sourceRefs {
+			norm := strings.ToLower(strings.TrimSuffix(strings.Replace(ref, "\\", "/", -1), "/"))
+			if base := linkBaseName(norm); base != "" && base != "." && !seen["n"+base] {
+				seen["n"+base] = true
+				names = append(names, base)
+			}
+			if sampleID != nil && sampleID.FindString(ref) == ref && !seen["s"+ref] {
+				seen["s"+ref] = true
+				parts = append(parts, ref)
+			}
+		}
+	}
+	if len(names) == 0 && len(parts) == 0 {
+		return []api.FileLinks{}, nil
+	}
+	candidates, err := gg.RunFetchFilesByBaseName(names, parts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch link targets from server:\n%v", err)
+	}
+	lr := newLinkResolver(candidates, sampleID)
+	sort.Strings(sources)
+	ret := []api.FileLinks{}
+	for _, source := range sources {
+		linked := map[string]bool{}
+		for _, ref := range refs[source] {
+			for _, target := range lr.resolve(ref) {
+				if target == source || linked[target] {
+					continue
+				}
+				linked[target] = true
+				ret = append(ret, api.FileLinks{Source: source, Target: target, Reference: ref, ScanID: scan})
+			}
+		}
+	}
+	return ret, nil
+}
+
+// maxLinkMentions is how many changed names a scan looks up the referring files by, a scan that changed
+// more files than that, like the first one, refreshes all links instead
+const maxLinkMentions = 10000
+
+// linkChanges are the files a scan wrote and the ones that are gone, either deleted or renamed away.
+// Their own links are replaced, and the links of the files whose references mention their names.
+type linkChanges struct {
+	written map[string]bool
+	gone    map[string]bool
+}
+
+func newLinkChanges() *linkChanges {
+	return &linkChanges{written: map[string]bool{}, gone: map[string]bool{}}
+}
+
+// add notes the files of the records written by the scan
+func (lc *linkChanges) add(records []api.FileHistory) {
+	for _, fh := range records {
+		if fh.Action == "D" {
+			lc.gone[fh.Filename] = true
+		} else {
+			lc.written[fh.Filename] = true
+		}
+	}
+}
+
+// mentions are what the LinkRefs of a file that may refer to one of the changed files contain: their
+// names as they are written in the JSON of the tag, and the sample IDs in them
+func (lc *linkChanges) mentions(sampleID *regexp.Regexp) []string {
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, files := range []map[string]bool{lc.written, lc.gone} {
+		for fn := range files {
+			names := []string{linkBaseName(fn)}
+			if sampleID != nil {
+				names = append(names, sampleID.FindAllString(filepath.Base(strings.TrimSuffix(fn, "/")), -1)...)
+			}
+			for _, name := range names {
+				js, err := json.Marshal(name)
+				if err != nil || name == "" || name == "." {
+					continue
+				}
+				if m := string(js[1 : len(js)-1]); !seen[m] {
+					seen[m] = true
+					ret = append(ret, m)
+				}
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// refreshLinks replaces the links of the files the scan changed and of the files below the dirs that
+// may refer to them. Without changes, i.e. for a resumed scan that doesn't know what it changed before
+// it was interrupted, the links of every file below the dirs are refreshed.
+func refreshLinks(gg api.Store, scan int, dirs []string, changed *linkChanges, sampleID *regexp.Regexp) (int, error) {
+	if changed == nil {
+		return refreshAllLinks(gg, scan, dirs, sampleID)
+	}
+	mentions := changed.mentions(sampleID)
+	if len(mentions) > maxLinkMentions {
+		return refreshAllLinks(gg, scan, dirs, sampleID)
+	}
+	refs := map[string][]string{}
+	batch := gg.WriteBatchSize()
+	for _, b := range batchesOf(len(mentions), batch) {
+		from, to := b[0], b[1]
+		after := ""
+		for {
+			page, err := gg.RunFetchLinkRefs(dirs, mentions[from:to], after, batch)
+			if err != nil {
+				return 0, fmt.Errorf("cannot fetch file references from server:\n%v", err)
+			}
+			if len(page) == 0 {
+				break
+			}
+			for i := range page {
+				refs[page[i].Filename] = storedLinkRefs(&page[i])
+			}
+			after = page[len(page)-1].Filename
+		}
+	}
+	// the written files that refer to nothing any more still lose their old links
+	written := []string{}
+	for fn := range changed.written {
+		if _, ok := refs[fn]; !ok {
+			written = append(written, fn)
+		}
+	}
+	sort.Strings(written)
+	for _, b := range batchesOf(len(written), batch) {
+		from, to := b[0], b[1]
+		stored, err := gg.RunFetchFilesByName(written[from:to], nil)
+		if err != nil {
+			return 0, fmt.Errorf("cannot fetch files from server:\n%v", err)
+		}
+		for _, fn := range written[from:to] {
+			refs[fn] = []string{}
+		}
+		for i := range stored {
+			refs[stored[i].Filename] = storedLinkRefs(&stored[i])
+		}
+	}
+
+	sources := []string{}
+	for fn := range refs {
+		sources = append(sources, fn)
+	}
+	sort.Strings(sources)
+	count := 0
+	for _, b := range batchesOf(len(sources), batch) {
+		from, to := b[0], b[1]
+		page := map[string][]string{}
+		for _, fn := range sources[from:to] {
+			page[fn] = refs[fn]
+		}
+		links, err := resolveLinks(gg, scan, page, sampleID)
+		if err != nil {
+			return count, err
+		}
+		if err := writeLinks(gg, scan, links, sources[from:to], nil); err != nil {
+			return count, err
+		}
+		count += len(links)
+	}
+	gone := []string{}
+	for fn := range changed.gone {
+		gone = append(gone, fn)
+	}
+	sort.Strings(gone)
+	return count, writeLinks(gg, scan, nil, gone, nil)
+}
+
+// batchesOf splits n items into batches of size, all in one batch if size isn't positive
+func batchesOf(n int, size int) [][2]int {
+	if size <= 0 {
+		size = n
+	}
+	ret := [][2]int{}
+	for from := 0; from < n; from += size {
+		to := from + size
+		if to > n {
+			to = n
+		}
+		ret = append(ret, [2]int{from, to})
+	}
+	return ret
+}
+
+// refreshAllLinks resolves the references stored for the files below the dirs, a page of files at a time,
+// and replaces the links of those files. It works on the stored files rather than on the files seen by
+// the scan, so a resumed scan also keeps the links of the files done before it was interrupted.
+func refreshAllLinks(gg api.Store, scan int, dirs []string, sampleID *regexp.Regexp) (int, error) {
+	count, after := 0, ""
+	for {
+		page, err := gg.RunFetchLinkRefs(dirs, nil, after, gg.WriteBatchSize())
+		if err != nil {
+			return count, fmt.Errorf("cannot fetch file references from server:\n%v", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		refs := map[string][]string{}
+		for i := range page {
+			refs[page[i].Filename] = storedLinkRefs(&page[i])
+		}
+		links, err := resolveLinks(gg, scan, refs, sampleID)
+		if err != nil {
+			return count, err
+		}
+		if err := writeLinks(gg, scan, links, nil, nil); err != nil {
+			return count, err
+		}
+		count += len(links)
+		after = page[len(page)-1].Filename
+	}
+	// the links of the files that are gone or no longer refer to anything are left from earlier scans
+	return count, writeLinks(gg, scan, nil, nil, dirs)
+}
+
+// writeLinks stores the links found by the scan and deletes the other links of the sources and
+// of the sources below the dirs
+func writeLinks(gg api.Store, scan int, links []api.FileLinks, sources []string, dirs []string) error {
+	if err := gg.RunUpsertFileLinks(links); err != nil {
+		return fmt.Errorf("cannot write file links to server:\n%v", err)
+	}
+	if err := gg.RunDeleteStaleFileLinks(scan, sources, dirs); err != nil {
+		return fmt.Errorf("cannot delete stale file links:\n%v", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"gamtrac/api"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// linkStore records the links a refresh writes and the sources whose other links it deletes
+type linkStore struct {
+	*api.LocalStore
+	links   []string
+	sources []string
+}
+
+func (s *linkStore) RunUpsertFileLinks(links []api.FileLinks) error {
+	for _, l := range links {
+		s.links = append(s.links, l.Source+" > "+l.Target)
+	}
+	return s.LocalStore.RunUpsertFileLinks(links)
+}
+
+func (s *linkStore) RunDeleteStaleFileLinks(scan int, sources []string, dirs []string) error {
+	s.sources = append(s.sources, sources...)
+	return s.LocalStore.RunDeleteStaleFileLinks(scan, sources, dirs)
+}
+
+func TestRefreshLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gamtrac-links")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, err := api.OpenLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	scan, err := local.RunCreateScan(api.ScanFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := func(fn string, refs string) api.FileHistory {
+		fh := api.FileHistory{Filename: fn, Action: "C", ScanID: *scan}
+		if refs != "" {
+			tag := "LinkRefs"
+			fh.RuleResults = []*api.RuleResults{{Tag: &tag, Value: &refs}}
+		}
+		return fh
+	}
+	_, err = local.RunInsertFileHistory([]api.FileHistory{
+		file("/share/a/report.txt", `["X.txt"]`),
+		file("/share/b/other.txt", `["y.txt"]`),
+		file("/share/c/new.csv", `["y.txt"]`),
+		file("/share/x.txt", ""),
+		file("/share/y.txt", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		changed *linkChanges
+		links   []string
+		sources []string
+	}{
+		{"changed files", &linkChanges{
+			written: map[string]bool{"/share/x.txt": true, "/share/c/new.csv": true},
+			gone:    map[string]bool{"/share/old.txt": true},
+		}, []string{"/share/a/report.txt > /share/x.txt", "/share/c/new.csv > /share/y.txt"},
+			// the unchanged file that refers to nothing that changed is left alone
+			[]string{"/share/a/report.txt", "/share/c/new.csv", "/share/old.txt", "/share/x.txt"}},
+		{"resumed scan", nil,
+			[]string{"/share/a/report.txt > /share/x.txt", "/share/b/other.txt > /share/y.txt", "/share/c/new.csv > /share/y.txt"}, []string{}},
+	}
+	for _, c := range cases {
+		store := &linkStore{LocalStore: local, links: []string{}, sources: []string{}}
+		count, err := refreshLinks(store, *scan, []string{"/share/"}, c.changed, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(store.links)
+		sort.Strings(store.sources)
+		if count != len(c.links) || !reflect.DeepEqual(store.links, c.links) {
+			t.Errorf("%v: %v links %v, want %v", c.name, count, store.links, c.links)
+		}
+		if !reflect.DeepEqual(store.sources, c.sources) {
+			t.Errorf("%v: refreshed the links of %v, want %v", c.name, store.sources, c.sources)
+		}
+	}
+}
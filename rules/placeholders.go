@@ -0,0 +1,67 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	placeholderTypeRe = regexp.MustCompile(`^([a-z]+)(?:\((.*)\))?$`)
+	intRe             = regexp.MustCompile(`^-?[0-9]+$`)
+)
+
+// date format elements and their go layout counterparts, longest first
+var dateLayout = strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "DD", "02", "hh", "15", "mm", "04", "ss", "05")
+
+// parsePlaceholder splits a placeholder like `<дата:date(YYYYMMDD)>`, `<n:int>` or
+// `<проект:enum(A,B,C)>` into the tag name and a validator for the matched value.
+// Untyped placeholders accept any value and have no validator.
+func parsePlaceholder(descr string) (string, func(string) error, error) {
+	inner := strings.TrimSuffix(strings.TrimPrefix(descr, "<"), ">")
+	i := strings.Index(inner, ":")
+	if i == -1 {
+		return inner, nil, nil
+	}
+	name, typ := inner[:i], inner[i+1:]
+	m := placeholderTypeRe.FindStringSubmatch(typ)
+	if m == nil {
+		return "", nil, fmt.Errorf("Invalid placeholder type `%s` in `%s`", typ, descr)
+	}
+	kind, arg := m[1], m[2]
+	switch kind {
+	case "int":
+		return name, func(v string) error {
+			if !intRe.MatchString(v) {
+				return fmt.Errorf("`%s` is not an integer", v)
+			}
+			return nil
+		}, nil
+	case "date":
+		if arg == "" {
+			arg = "YYYYMMDD"
+		}
+		layout := dateLayout.Replace(arg)
+		return name, func(v string) error {
+			if _, err := time.Parse(layout, v); err != nil {
+				return fmt.Errorf("`%s` is not a date in format %s", v, arg)
+			}
+			return nil
+		}, nil
+	case "enum":
+		if arg == "" {
+			return "", nil, fmt.Errorf("Empty enum in `%s`", descr)
+		}
+		values := strings.Split(arg, ",")
+		return name, func(v string) error {
+			for _, allowed := range values {
+				if v == allowed {
+					return nil
+				}
+			}
+			return fmt.Errorf("`%s` is not one of %s", v, arg)
+		}, nil
+	}
+	return "", nil, fmt.Errorf("Unknown placeholder type `%s` in `%s`", kind, descr)
+}
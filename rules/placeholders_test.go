@@ -0,0 +1,53 @@
+package rules
+
+import "testing"
+
+func TestParsePlaceholder(t *testing.T) {
+	cases := []struct {
+		descr string
+		name  string
+		valid []string
+		wrong []string
+	}{
+		{"<проект>", "проект", []string{"X1", "", "20191341"}, nil},
+		{"<n:int>", "n", []string{"42", "-7", "007"}, []string{"", "4.2", "+7", "42a", "-", "сорок"}},
+		{"<дата:date>", "дата", []string{"20190812", "20200229"}, []string{"2019-08-12", "20191341", "20190229", "190812", ""}},
+		{"<дата:date(YYYYMMDD)>", "дата", []string{"20190812"}, []string{"2019081", "201908120"}},
+		{"<дата:date(YY.MM.DD)>", "дата", []string{"19.08.12"}, []string{"2019.08.12", "19.13.01", "19-08-12"}},
+		{"<время:date(YYYY-MM-DD_hh-mm-ss)>", "время", []string{"2019-08-12_14-30-00"}, []string{"2019-08-12_25-30-00", "2019-08-12"}},
+		{"<вид:enum(A,B,C)>", "вид", []string{"A", "B", "C"}, []string{"D", "", "a", "A,B"}},
+		{"<метод:enum(ELISA)>", "метод", []string{"ELISA"}, []string{"ELIS", "ELISA "}},
+	}
+	for _, c := range cases {
+		name, validate, err := parsePlaceholder(c.descr)
+		if err != nil {
+			t.Errorf("%v: %v", c.descr, err)
+			continue
+		}
+		if name != c.name {
+			t.Errorf("%v: name %q, want %q", c.descr, name, c.name)
+		}
+		if validate == nil {
+			if len(c.wrong) > 0 {
+				t.Errorf("%v: no validator", c.descr)
+			}
+			continue
+		}
+		for _, v := range c.valid {
+			if err := validate(v); err != nil {
+				t.Errorf("%v rejected %q: %v", c.descr, v, err)
+			}
+		}
+		for _, v := range c.wrong {
+			if validate(v) == nil {
+				t.Errorf("%v accepted %q", c.descr, v)
+			}
+		}
+	}
+
+	for _, descr := range []string{"<n:integer>", "<n:Int>", "<вид:enum>", "<вид:enum()>", "<n:int(>", "<n:>"} {
+		if _, _, err := parsePlaceholder(descr); err == nil {
+			t.Errorf("%v was parsed, want an error", descr)
+		}
+	}
+}
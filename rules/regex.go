@@ -0,0 +1,156 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// named groups in go regexps may only use ascii names, tags are mostly cyrillic,
+// so the groups are renamed to g0, g1, ... and mapped back to the tag names
+var groupNameRe = regexp.MustCompile(`\(\?P?<([^>]+)>`)
+
+// NewRegexMatcher creates a matcher for a regular expression rule, every named group
+// `(?P<tag>...)` or `(?<tag>...)` becomes a tag. The whole path has to match for a full match.
+func NewRegexMatcher(rule string) (*RuleMatcher, error) {
+	names := []string{}
+	expr := ""
+	offset := 0
+	for _, loc := range groupNameRe.FindAllStringSubmatchIndex(rule, -1) {
+		if loc[0] > 0 && rule[loc[0]-1] == '\\' {
+			continue // escaped paren
+		}
+		expr += rule[offset:loc[0]] + fmt.Sprintf("(?P<g%d>", len(names))
+		names = append(names, rule[loc[2]:loc[3]])
+		offset = loc[1]
+	}
+	expr += rule[offset:]
+	return newRegexpMatcher(rule, expr, names)
+}
+
+// NewGlobMatcher creates a matcher for a glob rule: `*` matches within a folder, `**` matches any
+// number of folders, `?` a single character, `{a,b}` one of the alternatives, `[...]` a character class
+// and `<tag>` captures a part of a single folder or filename as a tag
+func NewGlobMatcher(rule string) (*RuleMatcher, error) {
+	expr, names, err := globToRegex(rule)
+	if err != nil {
+		return nil, err
+	}
+	return newRegexpMatcher(rule, expr, names)
+}
+
+func globToRegex(glob string) (string, []string, error) {
+	var sb strings.Builder
+	names := []string{}
+	braces := 0
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '{':
+			sb.WriteString("(?:")
+			braces++
+		case c == '}' && braces > 0:
+			sb.WriteString(")")
+			braces--
+		case c == ',' && braces > 0:
+			sb.WriteString("|")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				return "", nil, fmt.Errorf("Invalid glob: unterminated `[` at location %d: %s", i, glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '<':
+			end := strings.IndexByte(glob[i+1:], '>')
+			if end == -1 {
+				return "", nil, fmt.Errorf("Invalid glob: unterminated `<` at location %d: %s", i, glob)
+			}
+			sb.WriteString(fmt.Sprintf("(?P<g%d>[^/]*?)", len(names)))
+			names = append(names, glob[i+1:i+1+end])
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if braces > 0 {
+		return "", nil, fmt.Errorf("Invalid glob: unterminated `{`: %s", glob)
+	}
+	return sb.String(), names, nil
+}
+
+func newRegexpMatcher(rule, expr string, names []string) (*RuleMatcher, error) {
+	full, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rule: %v: %s", err, rule)
+	}
+	prefix := regexp.MustCompile("^(?:" + expr + ")")
+	prefix.Longest()
+	tokens := []ruleToken{}
+	groups := []int{}
+	for i, gn := range full.SubexpNames() {
+		if gn == "" {
+			continue
+		}
+		idx := 0
+		fmt.Sscanf(gn, "g%d", &idx)
+		descr := "<" + names[idx] + ">"
+		name, validate, err := parsePlaceholder(descr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rule: %v: %s", err, rule)
+		}
+		tokens = append(tokens, ruleToken{isConst: false, descr: descr, name: name, validate: validate})
+		groups = append(groups, i)
+	}
+	return &RuleMatcher{Rule: rule, tokens: tokens, re: full, prefix: prefix, groups: groups}, nil
+}
+
+// matchRegex matches the whole filename, if the rule only matches the beginning of the filename
+// LastPos is where that match ends so that the rule can still be ranked against the others
+func (r *RuleMatcher) matchRegex(filename string) RuleMatch {
+	ret := RuleMatch{Rule: r, Matches: []tokenMatch{}}
+	loc := r.re.FindStringSubmatchIndex(filename)
+	if loc == nil {
+		if p := r.prefix.FindStringIndex(filename); p != nil {
+			ret.LastPos = p[1]
+		}
+		ret.Err = fmt.Errorf("Failed to match rule `%s` after position %d", r.Rule, ret.LastPos)
+		ret.Expected = r.Rule
+		ret.Found = filename[ret.LastPos:]
+		return ret
+	}
+	for i, g := range r.groups {
+		start, stop := loc[2*g], loc[2*g+1]
+		if start < 0 {
+			continue // optional group that did not participate
+		}
+		if validate := r.tokens[i].validate; validate != nil {
+			if err := validate(filename[start:stop]); err != nil {
+				// the groups are checked in order, everything before the invalid one matched
+				ret.LastPos = start
+				ret.Err = fmt.Errorf("Failed to match token `%s`: Invalid value at position %d: %v", r.tokens[i].descr, start, err)
+				ret.Expected = r.tokens[i].descr
+				ret.Found = filename[start:stop]
+				return ret
+			}
+		}
+		ret.Matches = append(ret.Matches, tokenMatch{token: &r.tokens[i], match: filename[start:stop], matchPos: [2]int{start, stop}})
+	}
+	ret.Full = true
+	ret.LastPos = len(filename)
+	return ret
+}
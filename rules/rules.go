@@ -14,11 +14,17 @@ type ruleToken struct {
 	rulePos    [2]int
 	descr      string
 	terminator string
+	name       string             // tag name of a placeholder without the type
+	validate   func(string) error // only set for typed placeholders
 }
 
 type RuleMatcher struct {
 	Rule   string
 	tokens []ruleToken
+	// only set for regex and glob rules, the tokens are their named groups
+	re     *regexp.Regexp
+	prefix *regexp.Regexp
+	groups []int
 }
 
 type tokenMatch struct {
@@ -33,18 +39,35 @@ type RuleMatch struct {
 	LastPos int
 	Err     error
 	Rule    *RuleMatcher
+	// only set when the match is not full: the token or separator that failed to match at LastPos
+	// (empty when the whole rule matched but the path goes on) and the part of the path found instead
+	Expected string
+	Found    string
 }
 
 func (r *RuleMatch) AsMap() map[string]string {
 	ret := make(map[string]string)
 	for _, m := range r.Matches {
 		if !m.token.isConst {
-			ret[strings.Trim(m.token.descr, "<>")] = m.match
+			ret[m.token.name] = m.match
 		}
 	}
 	return ret
 }
 
+// NewRuleMatcher creates the matcher for a rule of the given rule_type
+func NewRuleMatcher(ruleType string, rule string) (*RuleMatcher, error) {
+	switch ruleType {
+	case "pathtags":
+		return NewMatcher(rule)
+	case "regex":
+		return NewRegexMatcher(rule)
+	case "glob":
+		return NewGlobMatcher(rule)
+	}
+	return nil, fmt.Errorf("Unknown rule type `%s`", ruleType)
+}
+
 func NewMatcher(rule string) (*RuleMatcher, error) {
 	re := regexp.MustCompile("<[^>]+>")
 	v := re.FindStringIndex(rule)
@@ -70,8 +93,15 @@ func NewMatcher(rule string) (*RuleMatcher, error) {
 	tokens := []ruleToken{}
 	for _, p := range places {
 		isconst, start, stop := p[0], p[1], p[2]
-		tokens = append(tokens, ruleToken{isConst: (isconst > 0), rulePos: [2]int{start, stop}, descr: rule[start:stop], terminator: ""})
-
+		tok := ruleToken{isConst: (isconst > 0), rulePos: [2]int{start, stop}, descr: rule[start:stop], terminator: ""}
+		if !tok.isConst {
+			name, validate, err := parsePlaceholder(tok.descr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid rule: %v: %s", err, rule)
+			}
+			tok.name, tok.validate = name, validate
+		}
+		tokens = append(tokens, tok)
 	}
 	for i, t := range tokens[1:] {
 		// if prev token is variable and this token is const, set terminator on prev token
@@ -97,6 +127,7 @@ func min(a, b int) int {
 	return b
 }
 
+// FindMatch matches the token at offset, on failure the attempted match is returned along with the error
 func (tok *ruleToken) FindMatch(subject string, offset int) (*tokenMatch, error) {
 	if len(subject) == 0 {
 		return nil, fmt.Errorf("Cannot match empty subject")
@@ -106,7 +137,8 @@ func (tok *ruleToken) FindMatch(subject string, offset int) (*tokenMatch, error)
 	if tok.isConst {
 		stop = min(start+len(tok.descr), len(subject))
 		if subject[start:stop] != tok.descr {
-			return nil, fmt.Errorf("Failed to match on separator `%s`", tok.descr)
+			return &tokenMatch{token: tok, matchPos: [2]int{start, stop}, match: subject[start:stop]},
+				fmt.Errorf("Failed to match on separator `%s`", tok.descr)
 		}
 	} else {
 		stop = len(subject)
@@ -115,7 +147,14 @@ func (tok *ruleToken) FindMatch(subject string, offset int) (*tokenMatch, error)
 			if idx != -1 {
 				stop = start + idx
 			} else {
-				return nil, fmt.Errorf("Failed to find terminator `%s`", tok.terminator)
+				return &tokenMatch{token: tok, matchPos: [2]int{start, len(subject)}, match: subject[start:]},
+					fmt.Errorf("Failed to find terminator `%s`", tok.terminator)
+			}
+		}
+		if tok.validate != nil {
+			if err := tok.validate(subject[start:stop]); err != nil {
+				return &tokenMatch{token: tok, matchPos: [2]int{start, stop}, match: subject[start:stop]},
+					fmt.Errorf("Invalid value at position %d: %v", start, err)
 			}
 		}
 	}
@@ -123,39 +162,63 @@ func (tok *ruleToken) FindMatch(subject string, offset int) (*tokenMatch, error)
 }
 
 func (r *RuleMatcher) Match(filename string) ([]tokenMatch, error) {
+	if r.re != nil {
+		m := r.matchRegex(filename)
+		return m.Matches, m.Err
+	}
+	ret, _, err := r.matchTokens(filename)
+	return ret, err
+}
+
+// matchTokens matches the tokens in order and stops at the first one that fails, returning its attempted match
+func (r *RuleMatcher) matchTokens(filename string) ([]tokenMatch, *tokenMatch, error) {
 	offset := 0
 	ret := []tokenMatch{}
 	for i := range r.tokens {
 		match, err := r.tokens[i].FindMatch(filename, offset)
 		if err != nil {
-			return ret, fmt.Errorf("Failed to match token `%s`: %s", r.tokens[i].descr, err.Error())
+			return ret, match, fmt.Errorf("Failed to match token `%s`: %s", r.tokens[i].descr, err.Error())
 		}
 		ret = append(ret, *match)
 		offset = match.matchPos[1]
 	}
-	return ret, nil
+	return ret, nil, nil
 }
 
-func MatchAllRules(filename string, rules []RuleMatcher) []RuleMatch {
+// MatchRule matches a single rule, a failed match still tells how far the rule got
+func (r *RuleMatcher) MatchRule(filename string) RuleMatch {
+	if r.re != nil {
+		return r.matchRegex(filename)
+	}
 	getLastPos := func(tokens []tokenMatch) int {
 		if len(tokens) == 0 {
 			return 0
 		}
 		return tokens[len(tokens)-1].matchPos[1]
 	}
+	tokens, failed, err := r.matchTokens(filename)
+	lastpos := getLastPos(tokens)
+	ret := RuleMatch{
+		Full:    len(filename) == lastpos,
+		Err:     err,
+		LastPos: lastpos,
+		Matches: tokens,
+		Rule:    r,
+	}
+	if !ret.Full {
+		ret.Found = filename[lastpos:]
+		if failed != nil {
+			ret.Expected = failed.token.descr
+			ret.Found = failed.match
+		}
+	}
+	return ret
+}
+
+func MatchAllRules(filename string, rules []RuleMatcher) []RuleMatch {
 	matches := []RuleMatch{}
 	for i := range rules {
-		matcher := &rules[i]
-		tokens, err := matcher.Match(filename)
-		lastpos := getLastPos(tokens)
-		matchResult := RuleMatch{
-			Full:    len(filename) == lastpos,
-			Err:     err,
-			LastPos: lastpos,
-			Matches: tokens,
-			Rule:    matcher,
-		}
-		matches = append(matches, matchResult)
+		matches = append(matches, rules[i].MatchRule(filename))
 	}
 	return matches
 }
@@ -238,3 +301,27 @@ func CSVToRules(csv []map[string]string, convertSlashes bool) ([]RuleMatcher, er
 	}
 	return ret, nil
 }
+
+// Render fills the placeholders of a template rule with the values, placeholders without a value are kept as is
+func (r *RuleMatcher) Render(values map[string]string) string {
+	var sb strings.Builder
+	for _, t := range r.tokens {
+		if v, ok := values[t.name]; ok && !t.isConst {
+			sb.WriteString(v)
+		} else {
+			sb.WriteString(t.descr)
+		}
+	}
+	return sb.String()
+}
+
+// Names returns the tag names of the placeholders in the order they appear
+func (r *RuleMatcher) Names() []string {
+	ret := []string{}
+	for _, t := range r.tokens {
+		if !t.isConst {
+			ret = append(ret, t.name)
+		}
+	}
+	return ret
+}
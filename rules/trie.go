@@ -0,0 +1,247 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RuleSet matches a path against many rules at once. The template rules are stored in a trie over
+// their tokens, so a token shared by many templates (usually the folders at the start) is only matched
+// once per path. Regex and glob rules can't be split into tokens and are matched one by one.
+type RuleSet struct {
+	Rules  []RuleMatcher
+	root   *trieNode
+	linear []int // rules that are not in the trie
+}
+
+type trieNode struct {
+	edges []*trieEdge // ordered by the first rule below them
+	ends  []int       // rules that have no more tokens after this node
+	// the constant edges by their text and the placeholder edges, to find the matching edges
+	// without trying every edge when there are many
+	consts    map[string]*trieEdge
+	constLens []int
+	vars      []*trieEdge
+}
+
+type trieEdge struct {
+	key   string
+	token *ruleToken // any of the equivalent tokens, they all match the same text
+	rules []int      // every rule below this edge
+	next  *trieNode
+}
+
+// tokenKey identifies tokens that always match the same text: constants by their text and placeholders
+// by their terminator and type, the tag name doesn't change what a placeholder matches
+func tokenKey(tok *ruleToken) string {
+	if tok.isConst {
+		return "c" + tok.descr
+	}
+	spec := ""
+	if i := strings.Index(tok.descr, ":"); i != -1 {
+		spec = tok.descr[i:]
+	}
+	return "v" + tok.terminator + "\x00" + spec
+}
+
+func NewRuleSet(rules []RuleMatcher) *RuleSet {
+	s := &RuleSet{Rules: rules, root: &trieNode{}, linear: []int{}}
+	for i := range rules {
+		if rules[i].re != nil {
+			s.linear = append(s.linear, i)
+			continue
+		}
+		node := s.root
+		for t := range rules[i].tokens {
+			tok := &rules[i].tokens[t]
+			key := tokenKey(tok)
+			var edge *trieEdge
+			for _, e := range node.edges {
+				if e.key == key {
+					edge = e
+					break
+				}
+			}
+			if edge == nil {
+				edge = &trieEdge{key: key, token: tok, next: &trieNode{}}
+				node.addEdge(edge)
+			}
+			edge.rules = append(edge.rules, i)
+			node = edge.next
+		}
+		node.ends = append(node.ends, i)
+	}
+	return s
+}
+
+func (n *trieNode) addEdge(e *trieEdge) {
+	n.edges = append(n.edges, e)
+	if !e.token.isConst {
+		n.vars = append(n.vars, e)
+		return
+	}
+	if n.consts == nil {
+		n.consts = map[string]*trieEdge{}
+	}
+	n.consts[e.token.descr] = e
+	for _, l := range n.constLens {
+		if l == len(e.token.descr) {
+			return
+		}
+	}
+	n.constLens = append(n.constLens, len(e.token.descr))
+}
+
+// matchingEdges returns the edges whose token matches at offset along with the end of the match
+func (n *trieNode) matchingEdges(filename string, offset int) ([]*trieEdge, []int) {
+	edges, ends := []*trieEdge{}, []int{}
+	for _, l := range n.constLens {
+		if offset+l > len(filename) {
+			continue
+		}
+		if e, ok := n.consts[filename[offset:offset+l]]; ok {
+			edges = append(edges, e)
+			ends = append(ends, offset+l)
+		}
+	}
+	for _, e := range n.vars {
+		if match, err := e.token.FindMatch(filename, offset); err == nil {
+			edges = append(edges, e)
+			ends = append(ends, match.matchPos[1])
+		}
+	}
+	return edges, ends
+}
+
+// MatchAll returns the same matches as MatchAllRules, in the order of the rules
+func (s *RuleSet) MatchAll(filename string) []RuleMatch {
+	if len(filename) == 0 {
+		// FindMatch refuses empty subjects before looking at any token
+		return MatchAllRules(filename, s.Rules)
+	}
+	ret := make([]RuleMatch, len(s.Rules))
+	s.walk(s.root, filename, 0, [][2]int{}, ret)
+	for _, i := range s.linear {
+		ret[i] = s.Rules[i].MatchRule(filename)
+	}
+	return ret
+}
+
+// FindBest returns the index of the rule FindBestRuleIndex would pick from MatchAll, or -1. Rules that
+// fail on the same token share the outcome, so only the trie nodes along the path are visited.
+func (s *RuleSet) FindBest(filename string) int {
+	if len(filename) == 0 {
+		return FindBestRuleIndex(s.MatchAll(filename))
+	}
+	b := &bestMatch{full: -1, partial: -1}
+	s.best(s.root, filename, 0, b)
+	for _, i := range s.linear {
+		m := s.Rules[i].MatchRule(filename)
+		b.add(i, m.LastPos, m.Full)
+	}
+	if b.full != -1 {
+		return b.full
+	}
+	return b.partial
+}
+
+// bestMatch keeps the first full match and the first of the longest partial matches
+type bestMatch struct {
+	full    int
+	partial int
+	lastPos int
+}
+
+func (b *bestMatch) add(i int, lastPos int, full bool) {
+	if full && (b.full == -1 || i < b.full) {
+		b.full = i
+	}
+	if lastPos > b.lastPos || (lastPos == b.lastPos && lastPos > 0 && i < b.partial) {
+		b.lastPos = lastPos
+		b.partial = i
+	}
+}
+
+func (s *RuleSet) best(node *trieNode, filename string, offset int, b *bestMatch) {
+	full := offset == len(filename)
+	if len(node.ends) > 0 {
+		b.add(node.ends[0], offset, full)
+	}
+	matched, ends := node.matchingEdges(filename, offset)
+	// every rule below the other edges stops here, the first of them represents them all
+	for _, e := range node.edges {
+		if !containsEdge(matched, e) {
+			b.add(e.rules[0], offset, full)
+			break
+		}
+	}
+	for k, e := range matched {
+		s.best(e.next, filename, ends[k], b)
+	}
+}
+
+func containsEdge(edges []*trieEdge, e *trieEdge) bool {
+	for _, m := range edges {
+		if m == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *RuleSet) walk(node *trieNode, filename string, offset int, spans [][2]int, out []RuleMatch) {
+	for _, i := range node.ends {
+		out[i] = s.result(i, filename, spans, nil, nil)
+	}
+	for _, e := range node.edges {
+		match, err := e.token.FindMatch(filename, offset)
+		if err != nil {
+			for _, i := range e.rules {
+				out[i] = s.result(i, filename, spans, match, err)
+			}
+			continue
+		}
+		s.walk(e.next, filename, match.matchPos[1], append(spans, match.matchPos), out)
+	}
+}
+
+// result builds the match of a single rule from the spans of the tokens matched on the way down the trie
+func (s *RuleSet) result(i int, filename string, spans [][2]int, failed *tokenMatch, err error) RuleMatch {
+	r := &s.Rules[i]
+	matches := make([]tokenMatch, len(spans))
+	for k, span := range spans {
+		matches[k] = tokenMatch{token: &r.tokens[k], matchPos: span, match: filename[span[0]:span[1]]}
+	}
+	lastpos := 0
+	if len(spans) > 0 {
+		lastpos = spans[len(spans)-1][1]
+	}
+	ret := RuleMatch{
+		Full:    len(filename) == lastpos,
+		LastPos: lastpos,
+		Matches: matches,
+		Rule:    r,
+	}
+	if err != nil {
+		ret.Err = &tokenError{descr: r.tokens[len(spans)].descr, err: err}
+	}
+	if !ret.Full {
+		ret.Found = filename[lastpos:]
+		if failed != nil {
+			ret.Expected = r.tokens[len(spans)].descr
+			ret.Found = failed.match
+		}
+	}
+	return ret
+}
+
+// tokenError is the error matchTokens reports, formatted only when needed since a path
+// usually fails most of the rules in the set
+type tokenError struct {
+	descr string
+	err   error
+}
+
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("Failed to match token `%s`: %s", e.descr, e.err.Error())
+}
@@ -0,0 +1,146 @@
+package rules
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var (
+	ruleConsts   = []string{"R:", "DAR", "LAM", "Screening group", "data", "2019", "отчеты"}
+	rulePlaces   = []string{"<проект>", "<дата:date(YYYYMMDD)>", "<n:int>", "<вид:enum(A,B,C)>", "<комментарий>"}
+	pathValues   = []string{"R:", "DAR", "LAM", "Screening group", "data", "2019", "отчеты", "X1", "20190801", "20191341", "42", "-7", "A", "D", "abc", ""}
+	ruleSpacers  = []string{"/", "_", "/", "."}
+	otherMatches = []struct{ ruleType, rule string }{
+		{"regex", `/R:/(?P<отдел>[^/]+)/.*`},
+		{"regex", `/data/(?P<n>[0-9]+)_.*\.txt`},
+		{"glob", "/R:/DAR/**/<проект>.txt"},
+		{"glob", "/*/LAM/*"},
+	}
+)
+
+// randomRules generates template rules that share their first tokens like the rules of a share do,
+// along with a few regex and glob rules
+func randomRules(rnd *rand.Rand, n int) []RuleMatcher {
+	ret := []RuleMatcher{}
+	for len(ret) < n {
+		if rnd.Intn(10) == 0 {
+			r := otherMatches[rnd.Intn(len(otherMatches))]
+			rm, err := NewRuleMatcher(r.ruleType, r.rule)
+			if err != nil {
+				panic(err)
+			}
+			ret = append(ret, *rm)
+			continue
+		}
+		var sb strings.Builder
+		sb.WriteString("/")
+		parts := 1 + rnd.Intn(5)
+		for i := 0; i < parts; i++ {
+			if i > 0 {
+				sb.WriteString(ruleSpacers[rnd.Intn(len(ruleSpacers))])
+			}
+			if rnd.Intn(2) == 0 {
+				sb.WriteString(ruleConsts[rnd.Intn(len(ruleConsts))])
+			} else {
+				sb.WriteString(rulePlaces[rnd.Intn(len(rulePlaces))])
+			}
+		}
+		if rnd.Intn(3) == 0 {
+			sb.WriteString("/")
+		}
+		rm, err := NewMatcher(sb.String())
+		if err != nil {
+			continue
+		}
+		ret = append(ret, *rm)
+	}
+	return ret
+}
+
+func randomPath(rnd *rand.Rand) string {
+	var sb strings.Builder
+	sb.WriteString("/")
+	parts := rnd.Intn(7)
+	for i := 0; i < parts; i++ {
+		if i > 0 {
+			sb.WriteString(ruleSpacers[rnd.Intn(len(ruleSpacers))])
+		}
+		sb.WriteString(pathValues[rnd.Intn(len(pathValues))])
+	}
+	switch rnd.Intn(4) {
+	case 0:
+		sb.WriteString("/")
+	case 1:
+		sb.WriteString(".txt")
+	}
+	if rnd.Intn(50) == 0 {
+		return ""
+	}
+	return sb.String()
+}
+
+func describeMatch(m RuleMatch) string {
+	tokens := []string{}
+	for _, t := range m.Matches {
+		tokens = append(tokens, fmt.Sprintf("%v=%q@%v", t.token.descr, t.match, t.matchPos))
+	}
+	err := ""
+	if m.Err != nil {
+		err = m.Err.Error()
+	}
+	return fmt.Sprintf("full=%v last=%v expected=%q found=%q err=%q rule=%q tokens=%v",
+		m.Full, m.LastPos, m.Expected, m.Found, err, m.Rule.Rule, tokens)
+}
+
+func TestRuleSetMatchesLikeRules(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		rules := randomRules(rnd, 1+rnd.Intn(60))
+		set := NewRuleSet(rules)
+		for p := 0; p < 200; p++ {
+			path := randomPath(rnd)
+			want := MatchAllRules(path, rules)
+			got := set.MatchAll(path)
+			if len(got) != len(want) {
+				t.Fatalf("MatchAll(%q) returned %v matches, want %v", path, len(got), len(want))
+			}
+			for i := range want {
+				if g, w := describeMatch(got[i]), describeMatch(want[i]); g != w {
+					t.Errorf("MatchAll(%q) of rule %q:\n got %v\nwant %v", path, rules[i].Rule, g, w)
+				}
+			}
+			if got, want := set.FindBest(path), FindBestRuleIndex(want); got != want {
+				t.Errorf("FindBest(%q) = %v, want %v", path, got, want)
+			}
+		}
+	}
+}
+
+func benchmarkRules() ([]RuleMatcher, []string) {
+	rnd := rand.New(rand.NewSource(2))
+	rules := randomRules(rnd, 500)
+	paths := make([]string, 1000)
+	for i := range paths {
+		paths[i] = randomPath(rnd)
+	}
+	return rules, paths
+}
+
+func BenchmarkRuleSet(b *testing.B) {
+	rules, paths := benchmarkRules()
+	set := NewRuleSet(rules)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.FindBest(paths[i%len(paths)])
+	}
+}
+
+func BenchmarkMatchAllRules(b *testing.B) {
+	rules, paths := benchmarkRules()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FindBestRuleIndex(MatchAllRules(paths[i%len(paths)], rules))
+	}
+}
@@ -5,26 +5,50 @@ import (
 	"gamtrac/scanner"
 	"gamtrac/rules"
 	"time"
-	"bytes"
 	"fmt"
-	"os/exec"
 	"os"
 	"strings"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
 )
 
-import 	"github.com/tealeg/xlsx"
 
+// RuleResultGenerator annotates files. Init receives all rules of the handler's rule types
+// once per scan, Generate is then called concurrently for every file.
+type RuleResultGenerator interface {
+	Init(rules []api.Rules) error
+	Generate(input AnnotItem) []api.AnnotResult
+}
 
-// TODO: rule violations
+// singleRule checks that a handler that works with a single pseudo-rule got exactly that
+func singleRule(ruleType string, rules []api.Rules) (api.Rules, error) {
+	if len(rules) != 1 {
+		return api.Rules{}, fmt.Errorf("%v handler expects a single rule, got %v", ruleType, len(rules))
+	}
+	return rules[0], nil
+}
 
-type RuleResultGenerator interface {
-	Generate(rule api.Rules, input AnnotItem) api.AnnotResult
+type FilePropsHandler struct {
+	RuleResultGenerator
+	rule   api.Rules
+	hashes *hashPolicy
 }
 
-type FilePropsHandler struct{ RuleResultGenerator }
+func (h *FilePropsHandler) Init(rules []api.Rules) error {
+	var err error
+	h.rule, err = singleRule("fileprops", rules)
+	if err != nil {
+		return err
+	}
+	h.hashes, err = hashPolicyFromEnv()
+	return err
+}
 
-func (*FilePropsHandler) Generate(rule api.Rules, input AnnotItem) api.AnnotResult {
+func (h *FilePropsHandler) Generate(input AnnotItem) []api.AnnotResult {
+	rule := h.rule
 	errors := []FileError{}
 	destination := input.path.Destination
 	// fmt.Println("Processing file: ", mountedAt)
@@ -36,7 +60,7 @@ func (*FilePropsHandler) Generate(rule api.Rules, input AnnotItem) api.AnnotResu
 	}
 	var hash *HashDigest = nil
 	if !info.IsDir() {
-		hash, err = computeHash(mountedAt)
+		hash, err = computeHash(h.hashes.For(destination), input)
 		if err != nil {
 			errors = append(errors, api.NewFileError(err))
 		}
@@ -55,95 +79,222 @@ func (*FilePropsHandler) Generate(rule api.Rules, input AnnotItem) api.AnnotResu
 		Hash:        hash,
 		Errors:      errors,
 	}
-	return &ret
+	return []api.AnnotResult{&ret}
 }
 
-type PathTagsHandler struct{ RuleResultGenerator }
+// principalName resolves the principal of a rule or an endpoint to an account name, empty when it is unknown
+var principalName = func(id int) string {
+	name, err := scanner.PrincipalName(os.Getenv("GAMTRAC_DOMAIN"), id)
+	if err != nil {
+		return ""
+	}
+	return name
+}
 
-func (*PathTagsHandler) Generate(r api.Rules, input AnnotItem) api.AnnotResult {
-	rule := r.Rule
-	destination := input.path.Destination
-	ruleResult := api.PathTagsResult{
-		Path:   destination,
-		RuleID: r.RuleID,
-		Values: map[string]string{},
+// ruleApplies is true when the rule is not scoped to a principal, or the file is below an endpoint of that
+// principal or owned by it. The principals of rules and endpoints are account ids: the relative id of an
+// account of the GAMTRAC_DOMAIN domain, the last part of its SID, on windows and a uid elsewhere. Owners
+// are compared by the account name, e.g. `BIOCAD\ivanov` or `ivanov`, so that a local account doesn't
+// pass for the domain account with the same relative id.
+func ruleApplies(rule api.Rules, path MountedPath) bool {
+	if rule.Principal == nil {
+		return true
 	}
-	rm, err := rules.NewMatcher(rule)
-	if err != nil {
-		// TODO: return api.ErrorResult
-		return &ruleResult
-	}
-	// match a single rule
-	matches := rules.MatchAllRules(destination, []rules.RuleMatcher{*rm})
-	i := rules.FindBestRuleIndex(matches)
-	if i != -1 {
-		m := matches[i]
-		ruleResult = api.PathTagsResult{
-			Path:   destination,
-			RuleID: r.RuleID,
-			Values: m.AsMap(),
+	if path.Principal != nil && *path.Principal == *rule.Principal {
+		return true
+	}
+	return path.Owner != "" && path.Owner == principalName(*rule.Principal)
+}
+
+// IgnoreRules are path rules that exclude the files and folders they fully match from the scans,
+// folders are matched with a trailing slash
+type IgnoreRules struct {
+	rules    []api.Rules
+	matchers []rules.RuleMatcher
+}
+
+// splitIgnoreRules separates the ignore rules from the rules that produce results
+func splitIgnoreRules(ruleDefs []api.Rules) (*IgnoreRules, []api.Rules) {
+	ignore := &IgnoreRules{}
+	rest := []api.Rules{}
+	for _, r := range ruleDefs {
+		if !r.Ignore {
+			rest = append(rest, r)
+			continue
+		}
+		rm, err := rules.NewRuleMatcher(r.RuleType, r.Rule)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot parse ignore rule %v `%v`: %v\n", r.RuleID, r.Rule, err)
+			continue
 		}
+		ignore.rules = append(ignore.rules, r)
+		ignore.matchers = append(ignore.matchers, *rm)
 	}
-	return &ruleResult
+	return ignore, rest
+}
 
+func (ign *IgnoreRules) Ignored(path MountedPath) bool {
+	for i := range ign.matchers {
+		if ruleApplies(ign.rules[i], path) && ign.matchers[i].MatchRule(path.Destination).Full {
+			return true
+		}
+	}
+	return false
 }
 
-type MagellanWspHandler struct{ RuleResultGenerator }
+// PathTagsHandler matches the path against all template, regex and glob rules and tags it
+// with the values of the best matching rule
+type PathTagsHandler struct {
+	RuleResultGenerator
+	matchers   []rules.RuleMatcher
+	rules      []api.Rules
+	principals map[int]bool    // the principals that have rules of their own
+	owners     map[string]bool // the account names of those principals
+	mu         sync.Mutex
+	sets       map[string]*pathRuleSet // by the principals of the path that have rules
+}
 
-func (*MagellanWspHandler) Generate(r api.Rules, input AnnotItem) api.AnnotResult {
-	// rule := r.Rule
+// pathRuleSet is a trie of rule matchers along with the rule of every matcher
+type pathRuleSet struct {
+	set   *rules.RuleSet
+	rules []api.Rules
+}
 
-	runPolywog := func(fn string) map[string]string {
-		cmd := exec.Command("./polywog", fn)
-		var stdout bytes.Buffer
-		cmd.Stdout = &stdout
-		err := cmd.Run()
-		if err != nil {
-			fmt.Println("Error: %v : Polywog failed with %s \n", fn, err)
-		}
-		outStr := string(stdout.Bytes())
-		outs := strings.Split(outStr, "\n")
-		ol := len(outs)
-		writingMsg := "Writing the output to: "
-		if (ol < 5 || outs[ol-2] != "Done." || outs[ol-3][:len(writingMsg)] != writingMsg) {
-			return map[string]string{}
+func newPathRuleSet(matchers []rules.RuleMatcher, ruleDefs []api.Rules, path MountedPath) *pathRuleSet {
+	ret := &pathRuleSet{rules: []api.Rules{}}
+	applied := []rules.RuleMatcher{}
+	for i := range matchers {
+		if ruleApplies(ruleDefs[i], path) {
+			applied = append(applied, matchers[i])
+			ret.rules = append(ret.rules, ruleDefs[i])
 		}
-		outfile := outs[ol-3][len(writingMsg):]
-		defer os.Remove(outfile)
-		// println(outfile)
-		xf, err := xlsx.OpenFile(outfile)
+	}
+	ret.set = rules.NewRuleSet(applied)
+	return ret
+}
+
+func (h *PathTagsHandler) Init(ruleDefs []api.Rules) error {
+	// the first full match wins, so the rules with a higher priority are tried first
+	sorted := append([]api.Rules{}, ruleDefs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority > sorted[j].Priority })
+	h.matchers, h.rules = []rules.RuleMatcher{}, []api.Rules{}
+	h.principals, h.owners = map[int]bool{}, map[string]bool{}
+	for _, r := range sorted {
+		rm, err := rules.NewRuleMatcher(r.RuleType, r.Rule)
 		if err != nil {
-			return map[string]string{}
+			// a broken rule must not stop the others from working
+			fmt.Fprintf(os.Stderr, "Cannot parse rule %v `%v`: %v\n", r.RuleID, r.Rule, err)
+			continue
 		}
-		sheets, err := xf.ToSlice()
-		ret := map[string]string{}
-		for _, rows := range sheets {
-			if (len(rows) < 2) {
-				return map[string]string{}
-			}
-			for _, row := range rows[1:] {
-				for ncol, val := range row {
-					colname := rows[0][ncol]
-					ret[colname] = val
-				}
+		h.matchers = append(h.matchers, *rm)
+		h.rules = append(h.rules, r)
+		if r.Principal != nil {
+			h.principals[*r.Principal] = true
+			if name := principalName(*r.Principal); name != "" {
+				h.owners[name] = true
 			}
 		}
+	}
+	h.sets = map[string]*pathRuleSet{}
+	return nil
+}
+
+// ruleSet returns the rules that apply to the path, the sets are built once for every
+// combination of endpoint principal and owner that have rules
+func (h *PathTagsHandler) ruleSet(path MountedPath) *pathRuleSet {
+	principals := []string{}
+	if path.Principal != nil && h.principals[*path.Principal] {
+		principals = append(principals, strconv.Itoa(*path.Principal))
+	}
+	if h.owners[path.Owner] {
+		principals = append(principals, "owner "+path.Owner)
+	}
+	key := strings.Join(principals, ",")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rs, ok := h.sets[key]
+	if !ok {
+		rs = newPathRuleSet(h.matchers, h.rules, path)
+		h.sets[key] = rs
+	}
+	return rs
+}
+
+func (h *PathTagsHandler) Generate(input AnnotItem) []api.AnnotResult {
+	destination := input.path.Destination
+	// rules scoped to other principals don't exist for this path
+	rs := h.ruleSet(input.path)
+	i := rs.set.FindBest(destination)
+	if i == -1 {
+		// none of the rules apply to this path
+		return []api.AnnotResult{}
+	}
+	m := rs.set.Rules[i].MatchRule(destination)
+	rule := rs.rules[i]
+	if !m.Full {
+		violation := newRuleViolation(rule.RuleID, destination, &m)
+		violation.Priority = rule.Priority
+		return []api.AnnotResult{violation}
+	}
+	return []api.AnnotResult{&api.PathTagsResult{
+		Path:     destination,
+		RuleID:   rule.RuleID,
+		Values:   m.AsMap(),
+		Priority: rule.Priority,
+	}}
+}
 
-		return ret
-		// return map[string]string{
-		// 	"magellan_path": outfile,
-		// }
+// newRuleViolation describes where the path stopped following the rule
+func newRuleViolation(ruleID int, path string, m *rules.RuleMatch) *api.RuleViolationResult {
+	msg := fmt.Sprintf("unexpected `%v` after position %v", m.Found, m.LastPos)
+	if m.Err != nil {
+		msg = m.Err.Error()
 	}
+	return &api.RuleViolationResult{
+		RuleID:            ruleID,
+		Path:              path,
+		ViolationRule:     m.Rule.Rule,
+		ViolationPos:      m.LastPos,
+		ViolationExpected: m.Expected,
+		ViolationFound:    m.Found,
+		ViolationMessage:  msg,
+	}
+}
+
+type MagellanWspHandler struct {
+	RuleResultGenerator
+	rule     api.Rules
+	sampleID *regexp.Regexp
+}
+
+func (h *MagellanWspHandler) Init(rules []api.Rules) error {
+	var err error
+	h.rule, err = singleRule("wsp", rules)
+	if err != nil {
+		return err
+	}
+	h.sampleID, err = sampleIDPattern()
+	return err
+}
+
+func (h *MagellanWspHandler) Generate(input AnnotItem) []api.AnnotResult {
+	r := h.rule
+
 	annot := map[string]string{}
 	fn := input.path.MountedAt
+	destination := input.path.Destination
 	if (!input.fileInfo.IsDir() && (strings.ToLower(filepath.Ext(fn)) == ".wsp")) {
-		annot = runPolywog(fn)
+		var err error
+		annot, err = readWsp(fn)
+		if err != nil {
+			return []api.AnnotResult{api.NewErrorResult(r.RuleID, destination, err)}
+		}
 	}
-	destination := input.path.Destination
 	ruleResult := api.MagellanWspResult{
 		Path:   destination,
 		RuleID: r.RuleID,
 		Values: annot,
 	}
-	return &ruleResult
+	// the workspace lists the plates and samples it was measured on
+	return append([]api.AnnotResult{&ruleResult}, newLinksResult(r.RuleID, destination, valueRefs(annot, h.sampleID))...)
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"gamtrac/api"
+	"testing"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// stubPrincipals resolves the principals of the tests without asking the domain, call the returned func to restore it
+func stubPrincipals() func() {
+	old := principalName
+	names := map[int]string{3: `BIOCAD\ivanov`, 5: `BIOCAD\sidorov`, 7: `BIOCAD\petrova`}
+	principalName = func(id int) string { return names[id] }
+	return func() { principalName = old }
+}
+
+func TestRuleApplies(t *testing.T) {
+	defer stubPrincipals()()
+	cases := []struct {
+		name      string
+		principal *int
+		path      MountedPath
+		want      bool
+	}{
+		{"shared rule", nil, MountedPath{}, true},
+		{"shared rule on a scoped endpoint", nil, MountedPath{Principal: intPtr(3), Owner: `BIOCAD\sidorov`}, true},
+		{"endpoint of the principal", intPtr(3), MountedPath{Principal: intPtr(3)}, true},
+		{"owned by the principal", intPtr(3), MountedPath{Principal: intPtr(5), Owner: `BIOCAD\ivanov`}, true},
+		{"owned by the principal on a shared endpoint", intPtr(3), MountedPath{Owner: `BIOCAD\ivanov`}, true},
+		{"local account with the same name", intPtr(3), MountedPath{Owner: `PC-17\ivanov`}, false},
+		{"other principal", intPtr(3), MountedPath{Principal: intPtr(5), Owner: `BIOCAD\sidorov`}, false},
+		{"unknown owner on a shared endpoint", intPtr(3), MountedPath{}, false},
+		{"principal without an account", intPtr(9), MountedPath{Owner: `BIOCAD\ivanov`}, false},
+		{"principal without an account on its endpoint", intPtr(9), MountedPath{Principal: intPtr(9)}, true},
+	}
+	for _, c := range cases {
+		if got := ruleApplies(api.Rules{Principal: c.principal}, c.path); got != c.want {
+			t.Errorf("%v: ruleApplies = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func pathTags(ruleID, priority int, values ...string) api.AnnotResult {
+	r := &api.PathTagsResult{RuleID: ruleID, Path: "/share/a.txt", Priority: priority, Values: map[string]string{}}
+	for i := 0; i+1 < len(values); i += 2 {
+		r.Values[values[i]] = values[i+1]
+	}
+	return r
+}
+
+func TestByPriority(t *testing.T) {
+	results := []api.AnnotResult{pathTags(1, 0), pathTags(2, 5), pathTags(3, 1), pathTags(4, 5), pathTags(5, 0)}
+	want := []int{2, 4, 3, 1, 5}
+	sorted := byPriority(results)
+	for i, r := range sorted {
+		if r.GetConfig().RuleID != want[i] {
+			t.Fatalf("byPriority ordered rules %v, want %v", ruleIDs(sorted), want)
+		}
+	}
+	// the input is left as it was
+	if results[0].GetConfig().RuleID != 1 || results[1].GetConfig().RuleID != 2 {
+		t.Errorf("byPriority reordered its input: %v", ruleIDs(results))
+	}
+}
+
+func ruleIDs(results []api.AnnotResult) []int {
+	ret := []int{}
+	for _, r := range results {
+		ret = append(ret, r.GetConfig().RuleID)
+	}
+	return ret
+}
+
+func TestCombineResultChangesets(t *testing.T) {
+	cases := []struct {
+		name    string
+		results []api.AnnotResult
+		want    map[string]string
+	}{
+		{"higher priority wins", []api.AnnotResult{pathTags(1, 1, "проект", "A"), pathTags(2, 5, "проект", "B")}, map[string]string{"проект": "B"}},
+		{"order does not matter", []api.AnnotResult{pathTags(2, 5, "проект", "B"), pathTags(1, 1, "проект", "A")}, map[string]string{"проект": "B"}},
+		{"tie keeps the first", []api.AnnotResult{pathTags(1, 2, "проект", "A"), pathTags(2, 2, "проект", "B")}, map[string]string{"проект": "A"}},
+		{"other tags are merged", []api.AnnotResult{pathTags(1, 1, "проект", "A", "метод", "ELISA"), pathTags(2, 5, "проект", "B")}, map[string]string{"проект": "B", "метод": "ELISA"}},
+		{"no results", []api.AnnotResult{}, map[string]string{}},
+	}
+	for _, c := range cases {
+		got, err := CombineResultChangesets(c.results)
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%v: got %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for tag, value := range c.want {
+			if got[tag] != value {
+				t.Errorf("%v: %v = %q, want %q", c.name, tag, got[tag], value)
+			}
+		}
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	defer stubPrincipals()()
+	ruleDefs := []api.Rules{
+		{RuleID: 1, RuleType: "glob", Rule: "/share/<проект>/*", Priority: 10},
+		{RuleID: 2, RuleType: "glob", Rule: "**/~$*", Priority: 0, Ignore: true},
+		{RuleID: 3, RuleType: "glob", Rule: "/share/tmp/**", Priority: 1, Ignore: true, Principal: intPtr(3)},
+		{RuleID: 4, RuleType: "glob", Rule: "**/.git/", Priority: 2, Ignore: true},
+		{RuleID: 5, RuleType: "glob", Rule: "/share/[", Priority: 3, Ignore: true},
+	}
+	ignore, rest := splitIgnoreRules(ruleDefs)
+	if len(rest) != 1 || rest[0].RuleID != 1 {
+		t.Errorf("splitIgnoreRules kept rules %v, want only rule 1", rest)
+	}
+	cases := []struct {
+		name string
+		path MountedPath
+		want bool
+	}{
+		{"not matched", MountedPath{Destination: "/share/X1/a.txt"}, false},
+		{"ignore overrides a higher priority rule", MountedPath{Destination: "/share/X1/~$a.docx"}, true},
+		{"folders are matched with a slash", MountedPath{Destination: "/share/X1/.git/"}, true},
+		{"file named like an ignored folder", MountedPath{Destination: "/share/X1/.git"}, false},
+		{"endpoint of the principal", MountedPath{Destination: "/share/tmp/a.txt", Principal: intPtr(3)}, true},
+		{"owned by the principal", MountedPath{Destination: "/share/tmp/a.txt", Owner: `BIOCAD\ivanov`}, true},
+		{"other principal", MountedPath{Destination: "/share/tmp/a.txt", Principal: intPtr(5), Owner: `BIOCAD\sidorov`}, false},
+		{"scoped rule without a principal", MountedPath{Destination: "/share/tmp/a.txt"}, false},
+	}
+	for _, c := range cases {
+		if got := ignore.Ignored(c.path); got != c.want {
+			t.Errorf("%v: Ignored(%v) = %v, want %v", c.name, c.path.Destination, got, c.want)
+		}
+	}
+}
+
+func TestPathTagsPrincipals(t *testing.T) {
+	defer stubPrincipals()()
+	h := &PathTagsHandler{}
+	err := h.Init([]api.Rules{
+		{RuleID: 1, RuleType: "glob", Rule: "/share/<проект>/*", Priority: 1},
+		{RuleID: 2, RuleType: "glob", Rule: "/share/<проект>/<образец>.txt", Priority: 5, Principal: intPtr(3)},
+		{RuleID: 3, RuleType: "glob", Rule: "/share/<проект>/<файл>", Priority: 9, Principal: intPtr(7)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		path MountedPath
+		want int
+	}{
+		{"shared rule", MountedPath{Destination: "/share/X1/S1.txt"}, 1},
+		{"endpoint of the principal", MountedPath{Destination: "/share/X1/S1.txt", Principal: intPtr(3)}, 2},
+		{"owned by the principal", MountedPath{Destination: "/share/X1/S1.txt", Owner: `BIOCAD\ivanov`}, 2},
+		{"higher priority rule of the owner", MountedPath{Destination: "/share/X1/S1.txt", Principal: intPtr(3), Owner: `BIOCAD\petrova`}, 3},
+		{"principal without rules", MountedPath{Destination: "/share/X1/S1.txt", Principal: intPtr(5), Owner: `BIOCAD\sidorov`}, 1},
+		{"cached rule set of the owner", MountedPath{Destination: "/share/X1/S1.txt", Owner: `BIOCAD\ivanov`}, 2},
+	}
+	for _, c := range cases {
+		results := h.Generate(AnnotItem{path: c.path})
+		if len(results) != 1 {
+			t.Errorf("%v: got %v results, want one", c.name, len(results))
+			continue
+		}
+		if got := results[0].GetConfig().RuleID; got != c.want {
+			t.Errorf("%v: tagged by rule %v, want %v", c.name, got, c.want)
+		}
+	}
+}
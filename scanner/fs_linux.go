@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"strconv"
 	"syscall"
 )
 
@@ -27,6 +28,30 @@ func GetFileOwnerUID(filename string) (*string, error) {
 	return &fileUser.Name, nil
 }
 
+// MountedOwners is false, a cifs mount shows the mounting user as the owner of every file
+const MountedOwners = false
+
+// GetFileOwnerName returns the name of the account owning the file
+func GetFileOwnerName(filename string, fi os.FileInfo) (string, error) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no owner in the file info of %v", filename)
+	}
+	return PrincipalName("", int(stat.Uid))
+}
+
+// PrincipalName returns the name of the account with the uid, the domain is only used on windows
+func PrincipalName(domain string, id int) (string, error) {
+	uid := strconv.Itoa(id)
+	return cachedName(uid, func() (string, error) {
+		u, err := user.LookupId(uid)
+		if err != nil {
+			return "", err
+		}
+		return u.Username, nil
+	})
+}
+
 func UnmountShare(local string) ([]byte, error) {
 	ret, err := exec.Command("umount", local).CombinedOutput()
 	if err != nil {
@@ -39,6 +39,65 @@ func GetFileOwnerUID(filename string) (*string, error) {
 	return &sidString, nil
 }
 
+// MountedOwners is true, the owners of the files on a share are those of the server
+const MountedOwners = true
+
+// GetFileOwnerName returns the name of the account owning the file, e.g. `BIOCAD\ivanov`
+func GetFileOwnerName(filename string, fi os.FileInfo) (string, error) {
+	var (
+		owner   *windows.SID
+		secDesc windows.Handle
+	)
+	err := acl.GetNamedSecurityInfo(
+		filename,
+		acl.SE_FILE_OBJECT,
+		acl.OWNER_SECURITY_INFORMATION,
+		&owner,
+		nil,
+		nil,
+		nil,
+		&secDesc,
+	)
+	if err != nil {
+		return "", err
+	}
+	defer windows.LocalFree(secDesc)
+	sid, err := owner.String()
+	if err != nil {
+		return "", err
+	}
+	return cachedName(sid, func() (string, error) {
+		return accountName(owner)
+	})
+}
+
+func accountName(sid *windows.SID) (string, error) {
+	account, domain, _, err := sid.LookupAccount("")
+	if err != nil {
+		return "", err
+	}
+	return domain + `\` + account, nil
+}
+
+// PrincipalName returns the name of the account with the relative id in the domain, the last part of its SID
+func PrincipalName(domain string, id int) (string, error) {
+	return cachedName(fmt.Sprintf(`%v\%v`, domain, id), func() (string, error) {
+		domainSid, _, _, err := windows.LookupSID("", domain)
+		if err != nil {
+			return "", fmt.Errorf("cannot find the domain %v: %v", domain, err)
+		}
+		prefix, err := domainSid.String()
+		if err != nil {
+			return "", err
+		}
+		sid, err := windows.StringToSid(fmt.Sprintf("%v-%v", prefix, id))
+		if err != nil {
+			return "", err
+		}
+		return accountName(sid)
+	})
+}
+
 // Remove a drive
 func UnmountShare(local string) ([]byte, error) {
 	return exec.Command("net", "use", local, "/delete").CombinedOutput()
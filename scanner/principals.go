@@ -0,0 +1,26 @@
+package scanner
+
+import "sync"
+
+// accountLookup is the outcome of looking up an account name, failures are remembered as well
+type accountLookup struct {
+	name string
+	err  error
+}
+
+var accountNames = struct {
+	sync.Mutex
+	m map[string]accountLookup
+}{m: map[string]accountLookup{}}
+
+// cachedName looks an account name up once, a scan asks for the same few owners over and over
+func cachedName(key string, lookup func() (string, error)) (string, error) {
+	accountNames.Lock()
+	defer accountNames.Unlock()
+	l, ok := accountNames.m[key]
+	if !ok {
+		l.name, l.err = lookup()
+		accountNames.m[key] = l
+	}
+	return l.name, l.err
+}
@@ -0,0 +1,158 @@
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_DELETE | unix.IN_MOVED_FROM |
+	unix.IN_MOVED_TO | unix.IN_ATTRIB | unix.IN_DELETE_SELF
+
+// WatchEvent is a single changed path, the path may not exist anymore
+type WatchEvent struct {
+	Path  string
+	IsDir bool
+}
+
+// Watcher reports changes below recursively watched directories using inotify
+type Watcher struct {
+	Events chan WatchEvent
+	Errors chan error
+	fd     int
+	m      sync.Mutex
+	dirs   map[int]string
+	done   chan struct{}
+}
+
+func NewWatcher() (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		Events: make(chan WatchEvent, 1024),
+		Errors: make(chan error, 16),
+		fd:     fd,
+		dirs:   map[int]string{},
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// AddRecursive watches root and all directories below it, calling emit for every entry found
+func (w *Watcher) AddRecursive(root string, emit func(path string, info os.FileInfo)) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			w.sendError(err)
+			return nil
+		}
+		if emit != nil {
+			emit(path, info)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			w.sendError(fmt.Errorf("cannot watch %v: %v", path, err))
+			return nil
+		}
+		w.m.Lock()
+		w.dirs[wd] = path
+		w.m.Unlock()
+		return nil
+	})
+}
+
+func (w *Watcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+func (w *Watcher) send(ev WatchEvent) {
+	select {
+	case w.Events <- ev:
+	case <-w.done:
+	}
+}
+
+func (w *Watcher) sendError(err error) {
+	select {
+	case w.Errors <- err:
+	default: // nobody is listening, drop it
+	}
+}
+
+func (w *Watcher) run() {
+	defer close(w.Events)
+	defer unix.Close(w.fd)
+	buf := make([]byte, 64*1024)
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		n, err := unix.Poll(fds, 500)
+		if err != nil && err != unix.EINTR {
+			w.sendError(err)
+			return
+		}
+		if n <= 0 {
+			continue
+		}
+		n, err = unix.Read(w.fd, buf)
+		if err != nil {
+			if err != unix.EAGAIN {
+				w.sendError(err)
+			}
+			continue
+		}
+		w.handle(buf[:n])
+	}
+}
+
+func (w *Watcher) handle(buf []byte) {
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(ev.Len)]
+		offset += unix.SizeofInotifyEvent + int(ev.Len)
+		name := string(nameBytes)
+		for len(name) > 0 && name[len(name)-1] == 0 {
+			name = name[:len(name)-1]
+		}
+		if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+			w.sendError(fmt.Errorf("inotify event queue overflow, some changes were lost"))
+			continue
+		}
+		w.m.Lock()
+		dir, ok := w.dirs[int(ev.Wd)]
+		if ev.Mask&unix.IN_IGNORED != 0 {
+			delete(w.dirs, int(ev.Wd))
+		}
+		w.m.Unlock()
+		if !ok || ev.Mask&unix.IN_IGNORED != 0 {
+			continue
+		}
+		path := dir
+		if name != "" {
+			path = filepath.Join(dir, name)
+		}
+		isDir := ev.Mask&unix.IN_ISDIR != 0
+		if isDir && ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+			// the directory may already contain files by the time the watch is set up
+			w.AddRecursive(path, func(p string, info os.FileInfo) {
+				w.send(WatchEvent{Path: p, IsDir: info.IsDir()})
+			})
+			continue
+		}
+		w.send(WatchEvent{Path: path, IsDir: isDir})
+	}
+}
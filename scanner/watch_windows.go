@@ -0,0 +1,32 @@
+// +build windows
+
+package scanner
+
+import (
+	"fmt"
+	"os"
+)
+
+// WatchEvent is a single changed path, the path may not exist anymore
+type WatchEvent struct {
+	Path  string
+	IsDir bool
+}
+
+// Watcher is not implemented on windows, only periodic scans are available
+type Watcher struct {
+	Events chan WatchEvent
+	Errors chan error
+}
+
+func NewWatcher() (*Watcher, error) {
+	return nil, fmt.Errorf("watching for changes is not supported on windows")
+}
+
+func (w *Watcher) AddRecursive(root string, emit func(path string, info os.FileInfo)) error {
+	return fmt.Errorf("watching for changes is not supported on windows")
+}
+
+func (w *Watcher) Close() error {
+	return nil
+}
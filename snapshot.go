@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gamtrac/api"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const snapshotUsage = `usage:
+  gamtrac snapshot <scan id|time> [folder]              files and tags as of a scan
+  gamtrac diff <scan id|time> <scan id|time> [folder]   files created, deleted and modified in between
+  gamtrac history <file> <tag>                          every value the tag of the file had
+times are RFC 3339 or a date like 2019-08-01, which means the end of that day`
+
+// resolveScan turns a scan ID or a point in time into the scan the snapshot is taken at
+func resolveScan(gg *api.GamtracGql, arg string) (int, error) {
+	if scan, err := strconv.Atoi(arg); err == nil {
+		return scan, nil
+	}
+	t, err := time.Parse(time.RFC3339, arg)
+	if err != nil {
+		day, dayErr := time.ParseInLocation("2006-01-02", arg, time.Local)
+		if dayErr != nil {
+			return 0, fmt.Errorf("`%v` is neither a scan id nor a time", arg)
+		}
+		t = day.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return gg.RunFetchScanAt(t)
+}
+
+func fetchSnapshot(gg *api.GamtracGql, at string, prefix string) (*api.Snapshot, error) {
+	scan, err := resolveScan(gg, at)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := gg.RunFetchSnapshot(scan, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch the snapshot of scan %v:\n%v", scan, err)
+	}
+	return snapshot, nil
+}
+
+func printSnapshot(s *api.Snapshot) {
+	fmt.Printf("Snapshot of scan %v, %v files\n", s.ScanID, len(s.Files))
+	for _, fn := range s.Filenames() {
+		fmt.Println(fn)
+		tags := s.Tags(fn)
+		for _, tag := range sortedKeys(tags) {
+			fmt.Printf("    %v: %v\n", tag, tags[tag])
+		}
+	}
+}
+
+func printSnapshotDiff(from, to *api.Snapshot, d api.SnapshotDiff) {
+	fmt.Printf("Changes from scan %v to scan %v: %v created, %v deleted, %v modified\n",
+		from.ScanID, to.ScanID, len(d.Created), len(d.Deleted), len(d.Modified))
+	for _, fn := range d.Created {
+		fmt.Printf("C %v\n", fn)
+	}
+	for _, fn := range d.Deleted {
+		fmt.Printf("D %v\n", fn)
+	}
+	for _, fd := range d.Modified {
+		fmt.Printf("M %v\n", fd.Filename)
+		for _, c := range fd.Changes {
+			switch {
+			case c.Old == nil:
+				fmt.Printf("    + %v: %v\n", c.Tag, *c.New)
+			case c.New == nil:
+				fmt.Printf("    - %v: %v\n", c.Tag, *c.Old)
+			default:
+				fmt.Printf("    ~ %v: %v -> %v\n", c.Tag, *c.Old, *c.New)
+			}
+		}
+	}
+}
+
+func printTagHistory(filename, tag string, history []api.TagHistory) {
+	fmt.Printf("History of %v of %v, %v changes\n", tag, filename, len(history))
+	value := func(v *string) string {
+		if v == nil {
+			return "-"
+		}
+		return *v
+	}
+	for _, th := range history {
+		at := ""
+		if th.ActionTstamp != nil {
+			at = th.ActionTstamp.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("scan %v %v %v: %v -> %v\n", th.ScanID, th.Action, at, value(th.OldValue), value(th.NewValue))
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// runSnapshotCommand handles the snapshot, diff and history commands, handled is false for any other command line
+func runSnapshotCommand(args []string, ac AppCredentials) (handled bool, err error) {
+	if len(args) == 0 || (args[0] != "snapshot" && args[0] != "diff" && args[0] != "history") {
+		return false, nil
+	}
+	gg := newGamtracGql(ac)
+	switch {
+	case args[0] == "snapshot" && (len(args) == 2 || len(args) == 3):
+		prefix := ""
+		if len(args) == 3 {
+			prefix = args[2]
+		}
+		s, err := fetchSnapshot(gg, args[1], prefix)
+		if err != nil {
+			return true, err
+		}
+		printSnapshot(s)
+	case args[0] == "diff" && (len(args) == 3 || len(args) == 4):
+		prefix := ""
+		if len(args) == 4 {
+			prefix = args[3]
+		}
+		from, err := fetchSnapshot(gg, args[1], prefix)
+		if err != nil {
+			return true, err
+		}
+		to, err := fetchSnapshot(gg, args[2], prefix)
+		if err != nil {
+			return true, err
+		}
+		printSnapshotDiff(from, to, api.DiffSnapshots(from, to))
+	case args[0] == "history" && len(args) == 3:
+		history, err := gg.RunFetchTagHistory(args[1], args[2])
+		if err != nil {
+			return true, fmt.Errorf("cannot fetch the history of %v:\n%v", args[1], err)
+		}
+		printTagHistory(args[1], args[2], history)
+	default:
+		return true, errors.New(snapshotUsage)
+	}
+	return true, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gamtrac/api"
+	"os"
+)
+
+const syncUsage = `usage:
+  gamtrac sync pull   copy the rules, endpoints and files of the server to the local store
+  gamtrac sync push   write the scans of the local store to the server
+the local store is the directory in GAMTRAC_LOCAL_STORE`
+
+// runSyncCommand handles the sync command, handled is false for any other command line
+func runSyncCommand(args []string, ac AppCredentials) (handled bool, err error) {
+	if len(args) == 0 || args[0] != "sync" {
+		return false, nil
+	}
+	dir := os.Getenv("GAMTRAC_LOCAL_STORE")
+	if len(args) != 2 || dir == "" {
+		return true, errors.New(syncUsage)
+	}
+	ls, err := api.OpenLocalStore(dir)
+	if err != nil {
+		return true, fmt.Errorf("cannot open the local store %v:\n%v", dir, err)
+	}
+	defer ls.Close()
+	gg := newGamtracGql(ac)
+	switch args[1] {
+	case "pull":
+		if err := ls.Pull(gg, remoteRuleTypes); err != nil {
+			return true, fmt.Errorf("cannot pull from the server:\n%v", err)
+		}
+		fmt.Printf("Pulled the server into %v\n", dir)
+	case "push":
+		pushed, err := ls.Push(gg)
+		if err != nil {
+			return true, fmt.Errorf("cannot push %v to the server, pushed %v changes before:\n%v", dir, pushed, err)
+		}
+		fmt.Printf("Pushed %v changes of %v to the server\n", pushed, dir)
+	default:
+		return true, errors.New(syncUsage)
+	}
+	return true, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// walkTree is filepath.Walk that also tells about the directories it reads: list gets the entries of
+// a directory before any of them is visited and leave is called once all of them were
+func walkTree(root string, visit filepath.WalkFunc, list func(dir string, entries []os.FileInfo) error, leave func(dir string)) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = visit(root, nil, err)
+	} else {
+		err = walkEntry(root, info, visit, list, leave)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkEntry(path string, info os.FileInfo, visit filepath.WalkFunc, list func(string, []os.FileInfo) error, leave func(string)) error {
+	if !info.IsDir() {
+		return visit(path, info, nil)
+	}
+	// like filepath.Walk a directory is visited once, with the error when it can't be read
+	entries, readErr := ioutil.ReadDir(path)
+	if err := visit(path, info, readErr); err != nil || readErr != nil {
+		return err
+	}
+	if err := list(path, entries); err != nil {
+		return err
+	}
+	defer leave(path)
+	for _, entry := range entries {
+		err := walkEntry(filepath.Join(path, entry.Name()), entry, visit, list, leave)
+		// like filepath.Walk a file can skip the rest of its directory
+		if err != nil && (!entry.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
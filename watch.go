@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"gamtrac/api"
+	"gamtrac/scanner"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// findRoot returns the mounted endpoint that contains path
+func findRoot(roots []MountedPath, path string) (MountedPath, bool) {
+	best, found := MountedPath{}, false
+	for _, r := range roots {
+		if (path == r.MountedAt || strings.HasPrefix(path, r.MountedAt+string(os.PathSeparator))) &&
+			len(r.MountedAt) > len(best.MountedAt) {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
+
+func hasErrors(results map[string][]api.AnnotResult) bool {
+	for _, rs := range results {
+		for _, r := range rs {
+			if len(api.ToScanErrors(0, r)) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watchRules are the rule handlers of the watcher. Building them parses every rule, so they are kept
+// between batches and only rebuilt when the rules change, the watcher is restarted when the endpoints do.
+type watchRules struct {
+	defs     []api.Rules
+	handlers []RuleResultGenerator
+	ignore   *IgnoreRules
+}
+
+// refresh reloads the rules and rebuilds the handlers when the rules differ from the ones they were built with
+func (wr *watchRules) refresh(gg api.Store) error {
+	remote, err := gg.RunFetchRules(remoteRuleTypes)
+	if err != nil {
+		// the last rules are better than none, without the remote ones their tags would be removed
+		if wr.handlers != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read remote rules, keeping the last ones: %v\n", err)
+			return nil
+		}
+		return fmt.Errorf("cannot read remote rules: %v", err)
+	}
+	defs := append(localRuleDefs(), remote...)
+	if wr.handlers != nil && reflect.DeepEqual(defs, wr.defs) {
+		return nil
+	}
+	handlers, ignore, err := initRuleHandlers(defs)
+	if err != nil {
+		return err
+	}
+	wr.defs, wr.handlers, wr.ignore = defs, handlers, ignore
+	return nil
+}
+
+// processWatchBatch annotates the changed paths and writes their file history as a separate small scan
+func processWatchBatch(gg api.Store, wr *watchRules, roots []MountedPath, changed map[string]bool) error {
+	if err := wr.refresh(gg); err != nil {
+		return err
+	}
+	ruleHandlers, ignore := wr.handlers, wr.ignore
+
+	filenames, removedDirs := []string{}, []string{}
+	items := []AnnotItem{}
+	for path, isDir := range changed {
+		root, ok := findRoot(roots, path)
+		if !ok {
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			mp, terr := translatePath(root, path, isDir)
+			if terr != nil || ignore.Ignored(mp) {
+				continue
+			}
+			if !os.IsNotExist(err) {
+				items = append(items, AnnotItem{path: mp, queuedAt: time.Now(), err: err})
+				continue
+			}
+			// removed, everything that was below a removed directory is gone as well
+			filenames = append(filenames, mp.Destination)
+			if isDir {
+				removedDirs = append(removedDirs, mp.Destination)
+			}
+			continue
+		}
+		mp, err := translatePath(root, path, info.IsDir())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %e\n", err)
+			continue
+		}
+		mp = withOwner(mp, info)
+		if ignore.Ignored(mp) {
+			continue
+		}
+		filenames = append(filenames, mp.Destination)
+		items = append(items, AnnotItem{path: mp, fileInfo: info, queuedAt: time.Now(), handlers: ruleHandlers, ignore: ignore})
+	}
+	// a bundle is checked again when anything in its folder changes
+	bundles := bundleHandlerOf(ruleHandlers)
+	if bundles != nil {
+		parents := map[string]bool{}
+		for path := range changed {
+			dir := filepath.Dir(path)
+			if _, ok := changed[dir]; ok || parents[dir] {
+				continue
+			}
+			parents[dir] = true
+			root, ok := findRoot(roots, dir)
+			if !ok {
+				continue
+			}
+			mp, err := translatePath(root, dir, true)
+			if err != nil || !bundles.IsFolder(mp.Destination) {
+				continue
+			}
+			info, err := os.Lstat(dir)
+			if err != nil {
+				continue
+			}
+			mp = withOwner(mp, info)
+			if ignore.Ignored(mp) {
+				continue
+			}
+			filenames = append(filenames, mp.Destination)
+			items = append(items, AnnotItem{path: mp, fileInfo: info, queuedAt: time.Now(), handlers: ruleHandlers, ignore: ignore})
+		}
+	}
+
+	// a record written by a scan in between would be overwritten with the older state annotated here,
+	// so the files are annotated, compared and written under the lock
+	dbWriteLock.Lock()
+	defer dbWriteLock.Unlock()
+	rslt := annotateAll(func(inputs chan<- AnnotItem) {
+		for _, item := range items {
+			inputs <- item
+		}
+	})
+	if bundles != nil {
+		for _, item := range items {
+			dest := item.path.Destination
+			if item.fileInfo == nil || !item.fileInfo.IsDir() || api.OnlyErrors(rslt[dest]) || !bundles.Applies(item.path) {
+				continue
+			}
+			contents, err := folderContents(item)
+			if err != nil {
+				rslt[dest] = append(rslt[dest], api.NewErrorResult(0, dest, err))
+				continue
+			}
+			rslt[dest] = bundles.Check(item.path, rslt[dest], contents)
+		}
+	}
+
+	oldFiles, err := gg.RunFetchFilesByName(filenames, removedDirs)
+	if err != nil {
+		return fmt.Errorf("cannot fetch files from server:\n%v", err)
+	}
+	changes, meta, err := GenerateChangelist(0, oldFiles, rslt)
+	if err != nil {
+		return err
+	}
+	// meta updates belong to existing records and don't need a scan
+	if err := writeMetaUpdates(gg, meta); err != nil {
+		return err
+	}
+	if len(changes) == 0 && !hasErrors(rslt) {
+		return nil
+	}
+	// only create a scan when there is something to write, most events don't change anything significant
+	rev, err := gg.RunCreateScan(api.ScanWatch)
+	if err != nil {
+		return err
+	}
+	for i := range changes {
+		changes[i].ScanID = *rev
+	}
+	if err := writeChangelist(gg, changes); err != nil {
+		return err
+	}
+	errs := []api.ScanErrors{}
+	for _, rs := range rslt {
+		errs = append(errs, scanErrorsOf(*rev, rs)...)
+	}
+	if err := writeScanErrors(gg, errs); err != nil {
+		return err
+	}
+	// the links of the changed files are replaced along with the links of the files that may refer to them
+	sampleID, err := sampleIDPattern()
+	if err != nil {
+		return err
+	}
+	lc := newLinkChanges()
+	lc.add(changes)
+	// a renamed file is gone from its old name, its record only refers to the old one by id
+	for _, old := range oldFiles {
+		if _, ok := rslt[old.Filename]; !ok {
+			lc.gone[old.Filename] = true
+		}
+	}
+	dirs := []string{}
+	for _, root := range roots {
+		mp, err := translatePath(root, root.MountedAt, true)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, mp.Destination)
+	}
+	if _, err := refreshLinks(gg, *rev, dirs, lc, sampleID); err != nil {
+		return err
+	}
+	if _, err := gg.RunFinishScan(*rev, "completed"); err != nil {
+		return err
+	}
+	fmt.Printf("Finished watch scan #%v; inserted records: %v\n", *rev, len(changes))
+	return nil
+}
+
+// watchPaths watches the endpoints for changes until the watcher fails; periodic scans are still needed
+// to reconcile changes the watcher can't see, e.g. ones made on the other side of a CIFS share
+func watchPaths(paths map[string]MountedPath, gg api.Store, stop <-chan struct{}) error {
+	w, err := scanner.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	roots := []MountedPath{}
+	for _, p := range paths {
+		if err := w.AddRecursive(p.MountedAt, nil); err != nil {
+			return err
+		}
+		roots = append(roots, p)
+	}
+
+	debounce, err := strconv.Atoi(os.Getenv("GAMTRAC_WATCH_DEBOUNCE_MS"))
+	if err != nil || debounce < 0 {
+		debounce = 2000
+	}
+	maxBatch, err := strconv.Atoi(os.Getenv("GAMTRAC_WATCH_MAX_BATCH"))
+	if err != nil || maxBatch <= 0 {
+		maxBatch = 500
+	}
+
+	wr := &watchRules{}
+	pending := map[string]bool{}
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		batch := pending
+		pending = map[string]bool{}
+		if err := processWatchBatch(gg, wr, roots, batch); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write watched changes: %v\n", err)
+		}
+	}
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return fmt.Errorf("watcher stopped")
+			}
+			pending[ev.Path] = ev.IsDir
+			if len(pending) >= maxBatch {
+				timer.Stop()
+				flush()
+			} else {
+				timer.Reset(time.Millisecond * time.Duration(debounce))
+			}
+		case err := <-w.Errors:
+			fmt.Fprintf(os.Stderr, "Watcher error: %v\n", err)
+		case <-timer.C:
+			flush()
+		case <-stop:
+			flush()
+			return fmt.Errorf("endpoints changed")
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"gamtrac/api"
+	"testing"
+)
+
+// ruleStore serves the remote rules of a test, the other store methods are not used
+type ruleStore struct {
+	api.Store
+	rules []api.Rules
+	err   error
+}
+
+func (s *ruleStore) RunFetchRules(ruleTypes []string) ([]api.Rules, error) {
+	return s.rules, s.err
+}
+
+func TestWatchRulesRefresh(t *testing.T) {
+	store := &ruleStore{rules: []api.Rules{{RuleID: 1, RuleType: "glob", Rule: "/share/<проект>/*"}}}
+	wr := &watchRules{}
+	if err := wr.refresh(store); err != nil {
+		t.Fatal(err)
+	}
+	first := wr.handlers
+	if err := wr.refresh(store); err != nil {
+		t.Fatal(err)
+	}
+	if &wr.handlers[0] != &first[0] {
+		t.Errorf("the handlers were rebuilt although the rules are the same")
+	}
+
+	store.err = fmt.Errorf("connection refused")
+	if err := wr.refresh(store); err != nil || &wr.handlers[0] != &first[0] {
+		t.Errorf("refresh with unreadable rules = %v, want the last handlers kept", err)
+	}
+
+	store.err = nil
+	store.rules = append(store.rules, api.Rules{RuleID: 2, RuleType: "glob", Rule: "**/~$*", Ignore: true})
+	if err := wr.refresh(store); err != nil {
+		t.Fatal(err)
+	}
+	if &wr.handlers[0] == &first[0] || !wr.ignore.Ignored(MountedPath{Destination: "/share/X1/~$a.docx"}) {
+		t.Errorf("the handlers were not rebuilt with the new ignore rule")
+	}
+
+	if err := (&watchRules{}).refresh(&ruleStore{err: fmt.Errorf("connection refused")}); err == nil {
+		t.Errorf("the first refresh succeeded without the remote rules")
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// maxWspCount bounds the counts read from a workspace, a larger one means the file isn't what we expect
+const maxWspCount = 1 << 16
+
+// wspReader reads the little-endian fields of a Tecan Magellan workspace. The first error sticks,
+// the later reads return zero values, so a structure is read in full and checked once.
+type wspReader struct {
+	r   *bufio.Reader
+	buf [8]byte
+	err error
+}
+
+func (r *wspReader) read(n int) []byte {
+	if r.err != nil {
+		return r.buf[:n]
+	}
+	if _, r.err = io.ReadFull(r.r, r.buf[:n]); r.err == io.EOF {
+		r.err = io.ErrUnexpectedEOF
+	}
+	return r.buf[:n]
+}
+
+func (r *wspReader) u2() int {
+	return int(binary.LittleEndian.Uint16(r.read(2)))
+}
+
+func (r *wspReader) u4() uint32 {
+	return binary.LittleEndian.Uint32(r.read(4))
+}
+
+func (r *wspReader) s4() int {
+	return int(int32(r.u4()))
+}
+
+func (r *wspReader) f8() float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(r.read(8)))
+}
+
+func (r *wspReader) skip(n int) {
+	if r.err == nil {
+		_, r.err = r.r.Discard(n)
+	}
+}
+
+// count reads a u4 count of the items that follow
+func (r *wspReader) count() int {
+	n := r.u4()
+	if r.err == nil && n > maxWspCount {
+		r.err = fmt.Errorf("implausible count %v", n)
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// ascii reads a string with a u2 length
+func (r *wspReader) ascii() string {
+	n := r.u2()
+	b := make([]byte, n)
+	if r.err == nil {
+		_, r.err = io.ReadFull(r.r, b)
+	}
+	return string(b)
+}
+
+// str reads a utf-16 string with a u2 length in characters
+func (r *wspReader) str() string {
+	n := r.u2()
+	units := make([]uint16, n)
+	for i := range units {
+		units[i] = uint16(r.u2())
+	}
+	if r.err != nil {
+		return ""
+	}
+	return string(utf16.Decode(units))
+}
+
+func (r *wspReader) strs(n int) []string {
+	ret := make([]string, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		ret = append(ret, r.str())
+	}
+	return ret
+}
+
+// date reads an ole automation date, the days since 1899-12-30 in the local time of the instrument
+func (r *wspReader) date() string {
+	days, frac := math.Modf(r.f8())
+	t := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).AddDate(0, 0, int(days))
+	return t.Add(time.Duration(math.Abs(frac)*86400) * time.Second).Format("2006.01.02 15:04")
+}
+
+func (r *wspReader) dimensions() (int, int) {
+	return int(r.u4()), int(r.u4())
+}
+
+// docHeader starts the workspace and the method stored in it
+func (r *wspReader) docHeader() (path, caption string) {
+	r.ascii()
+	r.skip(4)
+	path, caption = r.str(), r.str()
+	r.skip(2)
+	return path, caption
+}
+
+// wspHistoryEntry is an edit of the workspace or of its method
+type wspHistoryEntry struct {
+	User string
+	Date string
+}
+
+func (r *wspReader) history() []wspHistoryEntry {
+	ret := []wspHistoryEntry{}
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		r.skip(2)       // type
+		r.strs(3)       // text, message, user name
+		user := r.str() // user id
+		r.skip(10)
+		ret = append(ret, wspHistoryEntry{User: user, Date: r.date()})
+	}
+	return ret
+}
+
+// rawDataRepeats are the tagged texts of the raw data, gamtrac doesn't use them
+func (r *wspReader) rawDataRepeats() {
+	for repeats := r.count(); repeats > 0 && r.err == nil; repeats-- {
+		r.skip(4)
+		for pairs := r.count(); pairs > 0 && r.err == nil; pairs-- {
+			r.skip(8)
+			r.str()
+		}
+	}
+}
+
+// wspSample is a well of the plate layout along with its measurement
+type wspSample struct {
+	Name, Type   string
+	X, Y         int
+	Repeat       int
+	TotalRepeats int
+	Value        float64
+}
+
+// wspWorkspace is the part of a workspace that gamtrac reports
+type wspWorkspace struct {
+	InnerPath, Comment      string
+	ShortFileName           string
+	Version                 uint32
+	History                 []wspHistoryEntry
+	Device, Instrument      string
+	MagellanVersion         string
+	Method                  string
+	MethodHistory           []wspHistoryEntry
+	PlateWidth, PlateHeight int
+	Variables               []string
+	Samples                 []wspSample
+}
+
+// readWspFile reads a Magellan workspace up to its samples, the raw data that follows is skipped
+func readWspFile(in io.Reader) (*wspWorkspace, error) {
+	r := &wspReader{r: bufio.NewReader(in)}
+	ws := &wspWorkspace{}
+	ws.InnerPath, ws.Comment = r.docHeader()
+	r.skip(2 + 2) // header versions
+	ws.Version = r.u4()
+	ws.ShortFileName = r.str()
+	r.skip(2)
+	ws.History = r.history()
+	r.skip(3*4 + 2)
+	ws.PlateWidth, ws.PlateHeight = r.dimensions()
+	r.skip(30 + 4)
+	ws.MagellanVersion = r.str()
+	ws.Device = r.str()
+	r.skip(2 + 2)
+	r.str() // model
+	r.skip(4)
+	r.strs(4) // method and sample files, the method caption and the comment
+	r.skip(2)
+	r.strs(2) // load messages
+	for r.err == nil && r.u2() != 1 {
+	}
+	r.skip(10)
+	r.rawDataRepeats()
+	r.skip(6)
+	r.rawDataRepeats()
+	r.skip((r.count()+1)*4 + 8) // tags
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		r.skip(7*4 + 2 + 8 + 4) // plate definition
+		r.str()
+		r.skip(2)
+	}
+	r.skip(6)
+	r.str() // text number
+	r.skip(4)
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		r.skip(8) // error
+		r.str()
+		r.skip(4)
+	}
+	r.skip(2)
+
+	ws.Method, _ = r.docHeader()
+	r.skip(12)
+	ws.MethodHistory = r.history()
+	r.skip(14)
+	r.dimensions()
+	r.skip(34)
+	r.strs(2) // version and serial of the method
+	r.skip(2 + 2)
+	ws.Instrument = r.str()
+	r.skip(4)
+	r.str()
+	r.skip(2)
+	r.strs(2)
+	r.skip(2)
+	r.str() // description
+	r.skip(4)
+	r.str() // rtf
+	r.skip(4)
+	strsAfterVars := r.testHeader()
+	r.skip(10)
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		def := r.strs(r.u2())
+		r.skip(4)
+		// unset variables are stored as a dash
+		if len(def) >= 2 && def[0] != "-" && def[1] != "-" && def[1] != "" {
+			ws.Variables = append(ws.Variables, def[0]+"="+def[1])
+		}
+	}
+	r.strs(strsAfterVars * 2)
+	r.skip(14)
+	r.strs(r.u2())
+	r.skip(4)
+	samples, width := r.count(), r.count()
+	if samples*width > maxWspCount {
+		return nil, fmt.Errorf("implausible number of samples %vx%v", samples, width)
+	}
+	for n := samples * width; n > 0 && r.err == nil; n-- {
+		r.skip(2 + 26)
+		r.skip(2 + 2) // type
+		s := wspSample{Name: r.str(), Type: r.str()}
+		r.skip(4)
+		s.X, s.Y = r.s4(), r.s4()
+		s.Repeat, s.TotalRepeats = int(r.u4()), int(r.u4())
+		s.Value = r.f8()
+		r.skip(2 * 8)
+		for n := r.count(); n > 0 && r.err == nil; n-- {
+			r.str()
+		}
+		ws.Samples = append(ws.Samples, s)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return ws, nil
+}
+
+// testHeader reads the measurement settings of the method and returns the number of string pairs
+// that follow its variables
+func (r *wspReader) testHeader() int {
+	r.ascii() // guid
+	r.str()
+	r.skip(2 + 4 + 15*2 + 2)
+	r.str() // difference
+	r.dimensions()
+	r.strs(r.u2())
+	r.str() // formula
+	if r.u2() == 0 {
+		r.skip(6)
+	} else {
+		r.skip(22)
+		r.str() // method extension
+		r.skip(10)
+		r.str()
+		r.skip(110)
+	}
+	r.str()
+	r.skip(24 * 4)
+	w, h := r.dimensions()
+	if r.err == nil && w*h > maxWspCount {
+		r.err = fmt.Errorf("implausible plate count %vx%v", w, h)
+	}
+	r.skip(12 * w * h)
+	r.str() // peak intensity
+	r.skip(40)
+	r.str() // count rate
+	r.skip(6)
+	r.dimensions()
+	r.skip(74)
+	n := r.count()
+	r.dimensions()
+	return n
+}
+
+// wellName names a well by its zero based column and row, like A1 for the top left one
+func wellName(x, y int) string {
+	if y >= 0 && y < 26 {
+		return fmt.Sprintf("%c%d", 'A'+y, x+1)
+	}
+	return fmt.Sprintf("R%dC%d", y+1, x+1)
+}
+
+// readWsp returns the workspace values with the names polywog used for them, along with the plate
+// layout and the measured value of every named well
+func readWsp(fn string) (map[string]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ws, err := readWspFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the workspace %v: %v", fn, err)
+	}
+	ret := map[string]string{
+		"InnerPath":       ws.InnerPath,
+		"ShortFileName":   ws.ShortFileName,
+		"Version":         strconv.Itoa(int(ws.Version)),
+		"Comment":         ws.Comment,
+		"Device":          ws.Device,
+		"Instrument":      ws.Instrument,
+		"MagellanVersion": ws.MagellanVersion,
+		"Method":          ws.Method,
+		"Variables":       strings.Join(ws.Variables, " \n"), // one per line, as polywog wrote them
+		"Plate":           fmt.Sprintf("%dx%d", ws.PlateWidth, ws.PlateHeight),
+	}
+	if n := len(ws.History); n > 0 {
+		ret["CreatedAt"], ret["CreatedBy"] = ws.History[0].Date, ws.History[0].User
+		ret["LastEditAt"], ret["LastEditBy"] = ws.History[n-1].Date, ws.History[n-1].User
+	}
+	if n := len(ws.MethodHistory); n > 0 {
+		ret["MethodEditAt"], ret["MethodEditBy"] = ws.MethodHistory[n-1].Date, ws.MethodHistory[n-1].User
+	}
+	for _, s := range ws.Samples {
+		if s.Name == "" {
+			continue
+		}
+		well := "Well " + wellName(s.X, s.Y)
+		ret[well] = s.Name
+		ret[well+" Type"] = s.Type
+		value := well + " Value"
+		if s.TotalRepeats > 1 {
+			value += fmt.Sprintf(" %d", s.Repeat)
+		}
+		ret[value] = strconv.FormatFloat(s.Value, 'g', -1, 64)
+	}
+	return ret, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadWsp(t *testing.T) {
+	// polywog 0.3.10 reads the same values from the fixture, the wells are what it left out
+	got, err := readWsp(filepath.Join("testdata", "elisa.wsp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"InnerPath":       `C:\Users\lab\Documents\Magellan\wsp\ELISA_2019-08-12.wsp`,
+		"ShortFileName":   "ELISA_2019-08-12",
+		"Version":         "7",
+		"Comment":         "ELISA plate 3",
+		"Device":          "1510004321",
+		"Instrument":      "Sunrise absorbance",
+		"MagellanVersion": "7.2",
+		"CreatedAt":       "2019.08.12 12:00",
+		"CreatedBy":       "ivanov",
+		"LastEditAt":      "2019.08.13 06:00",
+		"LastEditBy":      "petrova",
+		"Method":          `C:\Users\lab\Documents\Magellan\mth\ELISA.mth`,
+		"MethodEditAt":    "2019.05.15 18:00",
+		"MethodEditBy":    "sidorov",
+		"Variables":       "Operator=Ivanov \nAntigen=HBsAg",
+		"Plate":           "12x8",
+		"Well A1":         "S-0001",
+		"Well A1 Type":    "Sample",
+		"Well A1 Value":   "0.125",
+		"Well A2":         "S-0002",
+		"Well A2 Type":    "Sample",
+		"Well A2 Value":   "1.5",
+		"Well H12":        "BL",
+		"Well H12 Type":   "Blank",
+		"Well H12 Value":  "0.04",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%v = %q, want %q", k, got[k], v)
+		}
+	}
+	for k := range got {
+		if _, ok := want[k]; !ok {
+			t.Errorf("unexpected value %v = %q", k, got[k])
+		}
+	}
+
+	// a workspace that ends before its samples is an error rather than a partial result
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "elisa.wsp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "gamtrac-wsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(data[:len(data)/2])
+	f.Close()
+	if values, err := readWsp(f.Name()); err == nil {
+		t.Errorf("readWsp of a truncated workspace = %v, want an error", values)
+	}
+}